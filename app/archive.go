@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Layer media types of docker-archive images, whose layers are usually
+// stored uncompressed.
+const (
+	mediaTypeDockerLayer     = "application/vnd.docker.image.rootfs.diff.tar"
+	mediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeDockerConfig    = "application/vnd.docker.container.image.v1+json"
+)
+
+// archiveManifest is an entry of the manifest.json of a docker-archive,
+// listing the config and layer files of an image by their path in the
+// archive.
+type archiveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// openArchive unpacks the tarball into a temporary directory and opens the
+// image named name in it, or its only image when name is empty. oci-archive
+// tarballs are OCI layouts, docker-archive tarballs are the output of docker
+// save.
+func openArchive(path, name string, docker bool) (*localSource, error) {
+	dir, cleanup, err := unpackArchive(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var src *localSource
+	if docker {
+		src, err = openDockerArchive(dir, name, "docker archive "+path)
+	} else {
+		src, err = openLayoutSource(ociLayout{dir: dir}, name, "OCI archive "+path)
+	}
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	src.cleanup = cleanup
+	return src, nil
+}
+
+// unpackArchive unpacks the tarball, read from the standard input when path
+// is "-", into a temporary directory removed by the returned function.
+func unpackArchive(path string) (string, func(), error) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(dir) }
+
+	cmd := exec.Command("tar", "-xf", path, "-C", dir)
+	cmd.Stdin = nullReader{}
+	if path == "-" {
+		cmd.Stdin = os.Stdin
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to unpack %s: %w", path, err)
+	}
+
+	return dir, cleanup, nil
+}
+
+// openDockerArchive opens the image named name in the unpacked docker-archive.
+// These archives hold no registry manifest, so one is generated from the
+// config and layer files, as Docker does when pushing the image.
+func openDockerArchive(dir, name, description string) (*localSource, error) {
+	entry, err := findArchiveImage(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return dockerArchiveSource(dir, entry, description)
+}
+
+// dockerArchiveSource returns the image of the manifest.json entry of the
+// unpacked docker-archive.
+func dockerArchiveSource(dir string, entry archiveManifest, description string) (*localSource, error) {
+	var err error
+	files := map[string]string{}
+	blob := func(path, mediaType string) (layer, error) {
+		path = filepath.Join(dir, filepath.Clean("/"+path))
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return layer{}, err
+		}
+
+		digest, err := hashFile(path)
+		if err != nil {
+			return layer{}, err
+		}
+		files[digest] = path
+
+		return layer{MediaType: mediaType, Size: info.Size(), Digest: digest}, nil
+	}
+
+	manifest := manifestResponse{SchemaVersion: 2, MediaType: mediaTypeDockerManifest}
+	if manifest.Config, err = blob(entry.Config, mediaTypeDockerConfig); err != nil {
+		return nil, err
+	}
+
+	for _, path := range entry.Layers {
+		mediaType := mediaTypeDockerLayer
+		if gzipped, err := hasMagic(filepath.Join(dir, filepath.Clean("/"+path)), gzipMagic); err != nil {
+			return nil, err
+		} else if gzipped {
+			mediaType = mediaTypeDockerLayerGzip
+		}
+
+		l, err := blob(path, mediaType)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Layers = append(manifest.Layers, l)
+	}
+
+	if manifest.raw, err = json.Marshal(manifest); err != nil {
+		return nil, err
+	}
+
+	return &localSource{
+		description: description,
+		manifest:    manifest,
+		blobSource: func(digest string) blobSource {
+			return fileSource(files[digest])
+		},
+	}, nil
+}
+
+// findArchiveImage returns the entry of the docker-archive manifest.json
+// tagged name, or its only entry when name is empty.
+func findArchiveImage(dir, name string) (archiveManifest, error) {
+	entries, err := readArchiveManifest(dir)
+	if err != nil {
+		return archiveManifest{}, err
+	}
+
+	if name == "" {
+		if len(entries) != 1 {
+			return archiveManifest{}, fmt.Errorf("docker archive has %d images, an image name is required", len(entries))
+		}
+		return entries[0], nil
+	}
+
+	for _, entry := range entries {
+		for _, tag := range entry.RepoTags {
+			if sameImage(tag, name) {
+				return entry, nil
+			}
+		}
+	}
+
+	return archiveManifest{}, fmt.Errorf("no image %s in docker archive", name)
+}
+
+// readArchiveManifest reads the manifest.json of the unpacked docker-archive.
+func readArchiveManifest(dir string) ([]archiveManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []archiveManifest
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid docker archive manifest: %w", err)
+	}
+
+	return entries, nil
+}
+
+// hasMagic reports whether the file starts with the magic bytes.
+func hasMagic(path string, magic []byte) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	start, _ := bufio.NewReader(f).Peek(len(magic))
+	return bytes.Equal(start, magic), nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cachedManifest is a registry manifest cached on disk, along with the ETag
+// it was served with.
+type cachedManifest struct {
+	ETag      string `json:"etag,omitempty"`
+	MediaType string `json:"mediaType,omitempty"`
+	Raw       []byte `json:"manifest"`
+}
+
+func (m cachedManifest) digest() string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(m.Raw))
+}
+
+// manifestCachePath returns the path of the cached manifest of the registry
+// reference, as served for the accepted media types.
+func (r *registry) manifestCachePath(accept []string) string {
+	key := strings.Join(append([]string{r.host, r.ref.repository, r.ref.manifestRef()}, accept...), "\n")
+	return filepath.Join(dataRoot, "manifest-cache", fmt.Sprintf("%x.json", sha256.Sum256([]byte(key))))
+}
+
+// cachedManifest returns the cached manifest of the reference, if any.
+func (r *registry) cachedManifest(accept []string) (cachedManifest, bool) {
+	data, err := ioutil.ReadFile(r.manifestCachePath(accept))
+	if err != nil {
+		return cachedManifest{}, false
+	}
+
+	var m cachedManifest
+	if err := json.Unmarshal(data, &m); err != nil || len(m.Raw) == 0 {
+		return cachedManifest{}, false
+	}
+
+	return m, true
+}
+
+// cacheManifest caches the manifest of the reference. The cache is only an
+// optimization, failing to write it is not an error.
+func (r *registry) cacheManifest(accept []string, m cachedManifest) {
+	path := r.manifestCachePath(accept)
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "tmp-")
+	if err != nil {
+		return
+	}
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+}
+
+// headManifest returns the digest of the manifest of the reference, as
+// reported by a HEAD request. Unlike manifest downloads, these requests do
+// not count against the Docker Hub pull rate limit.
+func (r *registry) headManifest(accept []string) (string, error) {
+	req, err := r.newRequest(http.MethodHead, "manifests/"+r.ref.manifestRef())
+	if err != nil {
+		return "", err
+	}
+
+	for _, mediaType := range accept {
+		req.Header.Add("Accept", mediaType)
+	}
+
+	var digest string
+	err = registryRetry.do("checking image manifest", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+		defer cancel()
+
+		resp, err := r.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return retryable(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		if err := checkStatus(resp, "failed to check image manifest"); err != nil {
+			return err
+		}
+
+		digest = resp.Header.Get("Docker-Content-Digest")
+		return nil
+	})
+
+	return digest, err
+}
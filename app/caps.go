@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// capabilities are the names of the Linux capabilities, by number.
+var capabilities = []string{
+	"CHOWN", "DAC_OVERRIDE", "DAC_READ_SEARCH", "FOWNER", "FSETID", "KILL", "SETGID", "SETUID",
+	"SETPCAP", "LINUX_IMMUTABLE", "NET_BIND_SERVICE", "NET_BROADCAST", "NET_ADMIN", "NET_RAW", "IPC_LOCK", "IPC_OWNER",
+	"SYS_MODULE", "SYS_RAWIO", "SYS_CHROOT", "SYS_PTRACE", "SYS_PACCT", "SYS_ADMIN", "SYS_BOOT", "SYS_NICE",
+	"SYS_RESOURCE", "SYS_TIME", "SYS_TTY_CONFIG", "MKNOD", "LEASE", "AUDIT_WRITE", "AUDIT_CONTROL", "SETFCAP",
+	"MAC_OVERRIDE", "MAC_ADMIN", "SYSLOG", "WAKE_ALARM", "BLOCK_SUSPEND", "AUDIT_READ", "PERFMON", "BPF",
+	"CHECKPOINT_RESTORE",
+}
+
+// defaultCapabilities are the capabilities of container processes, as with
+// Docker: the ones needed by common programs running as root, but none
+// allowing to administrate the host.
+var defaultCapabilities = []string{
+	"CHOWN", "DAC_OVERRIDE", "FSETID", "FOWNER", "MKNOD", "NET_RAW", "SETGID", "SETUID",
+	"SETFCAP", "SETPCAP", "NET_BIND_SERVICE", "SYS_CHROOT", "KILL", "AUDIT_WRITE",
+}
+
+// capabilityNumber returns the number of the capability, named with or
+// without the CAP_ prefix, in any case.
+func capabilityNumber(name string) (int, error) {
+	name = strings.TrimPrefix(strings.ToUpper(name), "CAP_")
+	for i, c := range capabilities {
+		if c == name {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown capability %q", name)
+}
+
+// containerCapabilities returns the names of the capabilities of container
+// processes: the default ones, without the dropped ones, then with the added
+// ones. ALL adds or drops every capability.
+func containerCapabilities(add, drop []string) ([]string, error) {
+	set := map[string]bool{}
+	for _, name := range defaultCapabilities {
+		set[name] = true
+	}
+
+	apply := func(names []string, value bool) error {
+		for _, name := range names {
+			if strings.EqualFold(name, "ALL") {
+				for _, c := range capabilities {
+					set[c] = value
+				}
+				continue
+			}
+
+			n, err := capabilityNumber(name)
+			if err != nil {
+				return err
+			}
+			set[capabilities[n]] = value
+		}
+		return nil
+	}
+	if err := apply(drop, false); err != nil {
+		return nil, err
+	}
+	if err := apply(add, true); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name, ok := range set {
+		if ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Capability constants missing from the syscall package.
+const (
+	prCapbsetDrop       = 24
+	linuxCapabilityV3   = 0x20080522
+	capabilityDataWords = 2
+)
+
+// capHeader and capData are the arguments of the capset system call.
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// limitCapabilities restricts the capabilities of the current thread, and of
+// the command it executes, to the named ones: the others are dropped from the
+// bounding set, which bounds the capabilities gained by executing programs,
+// and from the current sets.
+func limitCapabilities(names []string) error {
+	keep := make([]bool, len(capabilities))
+	for _, name := range names {
+		n, err := capabilityNumber(name)
+		if err != nil {
+			return err
+		}
+		keep[n] = true
+	}
+
+	var data [capabilityDataWords]capData
+	for n := range capabilities {
+		if keep[n] {
+			continue
+		}
+
+		// Capabilities unknown to the kernel cannot be held.
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, uintptr(n), 0)
+		if errno != 0 && errno != syscall.EINVAL {
+			return fmt.Errorf("failed to drop capability %s: %w", capabilities[n], errno)
+		}
+	}
+
+	for n := range capabilities {
+		if keep[n] {
+			bit := uint32(1) << uint(n%32)
+			data[n/32].effective |= bit
+			data[n/32].permitted |= bit
+			data[n/32].inheritable |= bit
+		}
+	}
+
+	// Capabilities the thread does not hold cannot be kept.
+	var current [capabilityDataWords]capData
+	header := capHeader{version: linuxCapabilityV3}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&current[0])), 0); errno != 0 {
+		return fmt.Errorf("failed to get capabilities: %w", errno)
+	}
+	for i := range data {
+		data[i].effective &= current[i].permitted
+		data[i].permitted &= current[i].permitted
+		data[i].inheritable &= current[i].permitted | current[i].inheritable
+	}
+
+	header = capHeader{version: linuxCapabilityV3}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("failed to set capabilities: %w", errno)
+	}
+
+	return nil
+}
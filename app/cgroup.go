@@ -0,0 +1,801 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted, and cgroupParent
+// the cgroup holding the cgroups of containers.
+const (
+	cgroupRoot   = "/sys/fs/cgroup"
+	cgroupParent = "mydocker"
+)
+
+// cgroup2SuperMagic is the filesystem type of the cgroup v2 hierarchy,
+// missing from the syscall package.
+const cgroup2SuperMagic = 0x63677270
+
+// minMemory is the lowest memory limit, as with Docker: containers cannot
+// start with less.
+const minMemory = 6 * 1024 * 1024
+
+// resources are the resource limits of a container, enforced by a cgroup of
+// its own. Zero values are unlimited.
+type resources struct {
+	// memory is the hard memory limit, and memoryHigh the limit above which
+	// the container processes are throttled and their memory reclaimed.
+	memory     bytesFlag
+	memoryHigh bytesFlag
+
+	// memorySwap is the limit of memory and swap used together, -1 being
+	// unlimited. Without it, containers may use as much swap as memory.
+	memorySwap bytesFlag
+
+	// memorySwappiness is the tendency of the kernel to swap the container
+	// memory out, from 0 to 100, or -1 to inherit the host one.
+	memorySwappiness int
+
+	// cpus is the number of CPUs the container may use, converted to a CPU
+	// quota over the default period. cpuQuota and cpuPeriod set them
+	// directly, in microseconds.
+	cpus      float64
+	cpuQuota  int64
+	cpuPeriod int64
+
+	// cpuShares is the relative CPU weight of the container, 1024 being the
+	// default, as with cgroup v1.
+	cpuShares int64
+
+	// cpusetCPUs and cpusetMems are the CPUs and memory nodes the container
+	// is pinned to, as lists such as 0-3,5.
+	cpusetCPUs string
+	cpusetMems string
+
+	// pidsLimit is the maximum number of processes of the container.
+	pidsLimit int64
+
+	// deviceReadBps and deviceWriteBps throttle the I/O of the container on
+	// block devices, as <device path>:<rate> values, the rate being in
+	// bytes per second. blkioWeight is the relative I/O weight of the
+	// container, from 10 to 1000 as with cgroup v1.
+	deviceReadBps  []string
+	deviceWriteBps []string
+	blkioWeight    int
+
+	// devices, when set, are the only devices the container can access.
+	devices []deviceRule
+}
+
+// defaultCPUPeriod is the CPU quota period of the kernel, in microseconds.
+const defaultCPUPeriod = 100000
+
+// limited reports whether the container needs a cgroup of its own.
+func (r resources) limited() bool {
+	return r.memory > 0 || r.memoryHigh > 0 || r.memorySwap != 0 || r.memorySwappiness >= 0 ||
+		r.cpus > 0 || r.cpuQuota > 0 || r.cpuPeriod > 0 || r.cpuShares > 0 ||
+		r.cpusetCPUs != "" || r.cpusetMems != "" || r.pidsLimit > 0 ||
+		len(r.deviceReadBps) > 0 || len(r.deviceWriteBps) > 0 || r.blkioWeight > 0
+}
+
+// validate checks the resource limits as Docker does.
+func (r resources) validate() error {
+	if r.memory > 0 && r.memory < minMemory {
+		return fmt.Errorf("minimum memory limit allowed is %dMB", minMemory>>20)
+	}
+	if r.memory > 0 && r.memoryHigh > r.memory {
+		return errors.New("the memory high limit must be lower than the memory limit")
+	}
+	if r.memorySwap > 0 && r.memory == 0 {
+		return errors.New("you should always set the memory limit when using the memory swap limit")
+	}
+	if r.memorySwap > 0 && r.memorySwap < r.memory {
+		return errors.New("minimum memory swap limit should be larger than the memory limit")
+	}
+	if r.memorySwappiness < -1 || r.memorySwappiness > 100 {
+		return fmt.Errorf("invalid value: %d, valid memory swappiness range is 0-100", r.memorySwappiness)
+	}
+
+	if r.cpus > 0 && (r.cpuQuota > 0 || r.cpuPeriod > 0) {
+		return errors.New("conflicting options: --cpus cannot be set with --cpu-quota or --cpu-period")
+	}
+	if r.cpus < 0 || r.cpus > float64(runtime.NumCPU()) {
+		return fmt.Errorf("range of CPUs is from 0.01 to %d.00, as there are only %d CPUs available", runtime.NumCPU(), runtime.NumCPU())
+	}
+	if r.cpuPeriod != 0 && (r.cpuPeriod < 1000 || r.cpuPeriod > 1000000) {
+		return errors.New("CPU period cannot be less than 1ms (i.e. 1000) or larger than 1s (i.e. 1000000)")
+	}
+	if r.cpuQuota != 0 && r.cpuQuota < 1000 {
+		return errors.New("CPU quota cannot be less than 1ms (i.e. 1000)")
+	}
+	if r.cpuShares != 0 && (r.cpuShares < 2 || r.cpuShares > 262144) {
+		return fmt.Errorf("invalid CPU shares %d, expected a value from 2 to 262144", r.cpuShares)
+	}
+
+	if r.cpusetCPUs != "" {
+		if err := checkCPUSet(r.cpusetCPUs, "CPUs", "/sys/devices/system/cpu/online"); err != nil {
+			return err
+		}
+	}
+	if r.cpusetMems != "" {
+		if err := checkCPUSet(r.cpusetMems, "memory nodes", "/sys/devices/system/node/online"); err != nil {
+			return err
+		}
+	}
+
+	if r.blkioWeight != 0 && (r.blkioWeight < 10 || r.blkioWeight > 1000) {
+		return fmt.Errorf("invalid blkio weight %d, expected a value from 10 to 1000", r.blkioWeight)
+	}
+
+	return nil
+}
+
+// cfsQuota returns the CPU quota of the container and its period, in
+// microseconds, the quota being -1 when unlimited, and whether they are set.
+func (r resources) cfsQuota() (int64, int64, bool) {
+	quota, period := int64(-1), int64(defaultCPUPeriod)
+	if r.cpus > 0 {
+		quota = int64(r.cpus * defaultCPUPeriod)
+	}
+	if r.cpuQuota > 0 {
+		quota = r.cpuQuota
+	}
+	if r.cpuPeriod > 0 {
+		period = r.cpuPeriod
+	}
+
+	return quota, period, r.cpus > 0 || r.cpuQuota > 0 || r.cpuPeriod > 0
+}
+
+// deviceRate is a rate limit of a block device, in bytes per second.
+type deviceRate struct {
+	write  bool
+	device string
+	rate   int64
+}
+
+// deviceRates returns the block device rate limits of the container.
+func (r resources) deviceRates() ([]deviceRate, error) {
+	var rates []deviceRate
+	for _, spec := range r.deviceReadBps {
+		device, rate, err := parseDeviceRate(spec)
+		if err != nil {
+			return nil, err
+		}
+		rates = append(rates, deviceRate{device: device, rate: rate})
+	}
+	for _, spec := range r.deviceWriteBps {
+		device, rate, err := parseDeviceRate(spec)
+		if err != nil {
+			return nil, err
+		}
+		rates = append(rates, deviceRate{write: true, device: device, rate: rate})
+	}
+
+	return rates, nil
+}
+
+// cgroupFile is a cgroup interface file of a controller, and the value
+// written to it. When the kernel does not provide the file, the alias one is
+// written instead if any, and optional files are skipped.
+type cgroupFile struct {
+	controller string
+	name       string
+	alias      string
+	value      string
+	optional   bool
+}
+
+// files returns the cgroup v2 interface files setting the resource limits.
+func (r resources) files() ([]cgroupFile, error) {
+	var files []cgroupFile
+
+	if r.memory > 0 {
+		files = append(files, cgroupFile{controller: "memory", name: "memory.max", value: strconv.FormatInt(int64(r.memory), 10)})
+	}
+	if r.memoryHigh > 0 {
+		files = append(files, cgroupFile{controller: "memory", name: "memory.high", value: strconv.FormatInt(int64(r.memoryHigh), 10)})
+	}
+
+	// cgroup v2 limits the swap alone, and only provides the swap limit with
+	// swap accounting enabled.
+	switch {
+	case r.memorySwap < 0:
+		files = append(files, cgroupFile{controller: "memory", name: "memory.swap.max", value: "max"})
+	case r.memorySwap > 0:
+		files = append(files, cgroupFile{controller: "memory", name: "memory.swap.max", value: strconv.FormatInt(int64(r.memorySwap-r.memory), 10)})
+	case r.memory > 0:
+		files = append(files, cgroupFile{controller: "memory", name: "memory.swap.max", value: strconv.FormatInt(int64(r.memory), 10), optional: true})
+	}
+
+	if quota, period, ok := r.cfsQuota(); ok {
+		max := "max"
+		if quota > 0 {
+			max = strconv.FormatInt(quota, 10)
+		}
+		files = append(files, cgroupFile{controller: "cpu", name: "cpu.max", value: fmt.Sprintf("%s %d", max, period)})
+	}
+
+	// Shares from 2 to 262144 map linearly to weights from 1 to 10000, as
+	// with runc, the default 1024 shares mapping to a weight of 39.
+	if r.cpuShares > 0 {
+		weight := 1 + (r.cpuShares-2)*9999/262142
+		files = append(files, cgroupFile{controller: "cpu", name: "cpu.weight", value: strconv.FormatInt(weight, 10)})
+	}
+
+	if r.cpusetCPUs != "" {
+		files = append(files, cgroupFile{controller: "cpuset", name: "cpuset.cpus", value: r.cpusetCPUs})
+	}
+	if r.cpusetMems != "" {
+		files = append(files, cgroupFile{controller: "cpuset", name: "cpuset.mems", value: r.cpusetMems})
+	}
+
+	if r.pidsLimit > 0 {
+		files = append(files, cgroupFile{controller: "pids", name: "pids.max", value: strconv.FormatInt(r.pidsLimit, 10)})
+	}
+
+	rates, err := r.deviceRates()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range rates {
+		key := "rbps"
+		if d.write {
+			key = "wbps"
+		}
+		files = append(files, cgroupFile{controller: "io", name: "io.max", value: fmt.Sprintf("%s %s=%d", d.device, key, d.rate)})
+	}
+
+	// Weights from 10 to 1000 map to weights from 1 to 10000, as runc does.
+	if r.blkioWeight > 0 {
+		weight := 1 + (r.blkioWeight-10)*9999/990
+		files = append(files, cgroupFile{controller: "io", name: "io.weight", value: fmt.Sprintf("default %d", weight)})
+	}
+
+	return files, nil
+}
+
+// parseDeviceRate parses a <device path>:<rate> value, returning the device
+// number of the block device as <major>:<minor> and the rate in bytes.
+func parseDeviceRate(spec string) (string, int64, error) {
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid device rate %q, expected <device path>:<rate>", spec)
+	}
+
+	rate, err := parseBytes(spec[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid device rate %q: %w", spec, err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(spec[:i], &st); err != nil {
+		return "", 0, fmt.Errorf("invalid device rate %q: %w", spec, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return "", 0, fmt.Errorf("invalid device rate %q: %s is not a block device", spec, spec[:i])
+	}
+
+	major, minor := deviceMajorMinor(st.Rdev)
+	return fmt.Sprintf("%d:%d", major, minor), rate, nil
+}
+
+// checkCPUSet checks that the CPUs or memory nodes of the list are online, as
+// listed in the online file.
+func checkCPUSet(spec, what, online string) error {
+	requested, err := parseCPUSet(spec)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(online)
+	if err != nil {
+		return err
+	}
+	available, err := parseCPUSet(strings.TrimSpace(string(data)))
+	if err != nil {
+		return err
+	}
+
+	for n := range requested {
+		if !available[n] {
+			return fmt.Errorf("requested %s are not available - requested %s, available: %s", what, spec, strings.TrimSpace(string(data)))
+		}
+	}
+
+	return nil
+}
+
+// parseCPUSet parses a list of CPUs or memory nodes, such as 0-3,5.
+func parseCPUSet(spec string) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpuset %q, expected a list such as 0-3,5", spec)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("invalid cpuset %q, expected a list such as 0-3,5", spec)
+			}
+		}
+
+		for n := first; n <= last; n++ {
+			set[n] = true
+		}
+	}
+
+	return set, nil
+}
+
+// Cgroup drivers: the runtime creates the cgroups of containers under their
+// parent cgroup, or systemd creates them as transient scopes of their parent
+// slice.
+const (
+	cgroupfsDriver = "cgroupfs"
+	systemdDriver  = "systemd"
+)
+
+// cgroupPlacement is where the cgroups of containers are created.
+type cgroupPlacement struct {
+	driver string
+
+	// parent is the parent cgroup of containers, as a path in the cgroup
+	// hierarchies, or their slice with the systemd driver. Defaults to
+	// cgroupParent, or to the system slice.
+	parent string
+}
+
+// addCgroupFlags registers the flags placing the cgroups of containers.
+func addCgroupFlags(fs *flag.FlagSet, p *cgroupPlacement) {
+	fs.StringVar(&p.driver, "cgroup-driver", cgroupfsDriver, "cgroup driver (cgroupfs, systemd), systemd creating transient scopes for containers")
+	fs.StringVar(&p.parent, "cgroup-parent", "", "parent cgroup of containers, or their slice with the systemd driver, defaults to /mydocker or system.slice")
+}
+
+// parentDir returns the path of the parent cgroup of containers in the
+// cgroup hierarchies.
+func (p cgroupPlacement) parentDir() (string, error) {
+	switch p.driver {
+	case cgroupfsDriver:
+		if p.parent == "" {
+			return "/" + cgroupParent, nil
+		}
+		return filepath.Join("/", p.parent), nil
+	case systemdDriver:
+		return slicePath(p.slice())
+	default:
+		return "", fmt.Errorf("invalid cgroup driver %q, expected %s or %s", p.driver, cgroupfsDriver, systemdDriver)
+	}
+}
+
+// dirName returns the name of the cgroup of the container in its parent.
+func (p cgroupPlacement) dirName(id string) string {
+	if p.driver == systemdDriver {
+		return scopeName(id)
+	}
+	return id
+}
+
+// containerID returns the ID of the container whose cgroup is named name in
+// the parent cgroup, if any.
+func (p cgroupPlacement) containerID(name string) (string, bool) {
+	if p.driver == systemdDriver {
+		id := strings.TrimSuffix(strings.TrimPrefix(name, scopePrefix), ".scope")
+		return id, id != name && strings.HasPrefix(name, scopePrefix)
+	}
+	return name, true
+}
+
+// cgroup is the cgroup of a container: a directory of the cgroup v2
+// hierarchy, or one in each cgroup v1 hierarchy of the controllers it uses.
+type cgroup struct {
+	// dirs are the cgroup directories by controller, the cgroup v2 one being
+	// the only one, without controller.
+	dirs map[string]string
+
+	// scope is the systemd scope of the container with the systemd driver,
+	// created in slice when the container process is attached, and files
+	// are then written to its cgroup.
+	scope   string
+	slice   string
+	files   []cgroupFile
+	devices []deviceRule
+}
+
+// unifiedHierarchy reports whether the host uses the cgroup v2 hierarchy,
+// mounted at cgroupRoot, rather than the cgroup v1 ones.
+func unifiedHierarchy() bool {
+	var st syscall.Statfs_t
+	return syscall.Statfs(cgroupRoot, &st) == nil && st.Type == cgroup2SuperMagic
+}
+
+// createCgroup creates the cgroup of the container, limiting its resources,
+// with cgroup v2 when the host uses it, and cgroup v1 otherwise. With the
+// systemd driver, the cgroup is only created once the container process is
+// attached.
+func createCgroup(id string, r resources, p cgroupPlacement) (*cgroup, error) {
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+
+	parent, err := p.parentDir()
+	if err != nil {
+		return nil, err
+	}
+
+	var files []cgroupFile
+	if unifiedHierarchy() {
+		files, err = r.files()
+	} else {
+		files, err = r.v1Files()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if unifiedHierarchy() && r.memorySwappiness >= 0 {
+		fmt.Fprintf(os.Stderr, "memory swappiness is not supported by cgroup v2, ignoring it\n")
+	}
+
+	if p.driver == systemdDriver {
+		return &cgroup{scope: scopeName(id), slice: p.slice(), files: files, devices: r.devices}, nil
+	}
+
+	if !unifiedHierarchy() {
+		return createCgroupV1(filepath.Join(parent, id), files)
+	}
+
+	var controllers []string
+	for _, f := range files {
+		if len(controllers) == 0 || controllers[len(controllers)-1] != f.controller {
+			controllers = append(controllers, f.controller)
+		}
+	}
+
+	// Controllers are only available in a cgroup once enabled in all its
+	// ancestors.
+	dir := cgroupRoot
+	for _, name := range strings.Split(strings.Trim(parent, "/"), "/") {
+		if err := enableControllers(dir, controllers); err != nil {
+			return nil, err
+		}
+
+		dir = filepath.Join(dir, name)
+		if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create the %s cgroup: %w", parent, err)
+		}
+	}
+	if err := enableControllers(dir, controllers); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, id)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the container cgroup: %w", err)
+	}
+
+	cg := &cgroup{dirs: map[string]string{"": path}, devices: r.devices}
+	if err := cg.write(files); err != nil {
+		cg.remove()
+		return nil, err
+	}
+
+	return cg, nil
+}
+
+// enableControllers enables the controllers in the children of the cgroup.
+func enableControllers(dir string, controllers []string) error {
+	if len(controllers) == 0 {
+		return nil
+	}
+
+	available, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+
+	var enable []string
+	for _, c := range controllers {
+		found := false
+		for _, a := range strings.Fields(string(available)) {
+			found = found || a == c
+		}
+		if !found {
+			return fmt.Errorf("the %s cgroup controller is not available", c)
+		}
+		enable = append(enable, "+"+c)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0); err != nil {
+		return fmt.Errorf("failed to enable the %s cgroup controllers: %w", strings.Join(controllers, ", "), err)
+	}
+
+	return nil
+}
+
+// cgroupMounts returns the mount points of the cgroup hierarchies by
+// controller, the cgroup v2 one being the only one, without controller.
+func cgroupMounts() (map[string]string, error) {
+	if unifiedHierarchy() {
+		return map[string]string{"": cgroupRoot}, nil
+	}
+	return v1Mounts()
+}
+
+// openCgroup returns the cgroup of the running container, if it has one.
+func openCgroup(id string, p cgroupPlacement) (*cgroup, bool) {
+	parent, err := p.parentDir()
+	if err != nil {
+		return nil, false
+	}
+	mounts, err := cgroupMounts()
+	if err != nil {
+		return nil, false
+	}
+
+	cg := &cgroup{dirs: map[string]string{}}
+	for controller, mount := range mounts {
+		path := filepath.Join(mount, parent, p.dirName(id))
+		if _, err := os.Stat(path); err == nil {
+			cg.dirs[controller] = path
+		}
+	}
+
+	return cg, len(cg.dirs) > 0
+}
+
+// cgroupIDs returns the IDs of the containers with a cgroup.
+func cgroupIDs(p cgroupPlacement) ([]string, error) {
+	parent, err := p.parentDir()
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := cgroupMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	var ids []string
+	for _, mount := range mounts {
+		files, err := ioutil.ReadDir(filepath.Join(mount, parent))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, f := range files {
+			if id, ok := p.containerID(f.Name()); ok && f.IsDir() && !found[id] {
+				found[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// dir returns the directory of the cgroup holding the interface files of the
+// controller, if any.
+func (cg *cgroup) dir(controller string) (string, bool) {
+	if dir, ok := cg.dirs[""]; ok {
+		return dir, true
+	}
+
+	dir, ok := cg.dirs[controller]
+	return dir, ok
+}
+
+// write writes the interface files of the cgroup, in order, then restricts
+// its devices on cgroup v2, as cgroup v1 does with interface files.
+func (cg *cgroup) write(files []cgroupFile) error {
+	if err := cg.writeFiles(files); err != nil {
+		return err
+	}
+
+	if dir, ok := cg.dirs[""]; ok && len(cg.devices) > 0 {
+		return limitDevices(dir, cg.devices)
+	}
+	return nil
+}
+
+func (cg *cgroup) writeFiles(files []cgroupFile) error {
+	for _, f := range files {
+		dir, ok := cg.dir(f.controller)
+		if !ok {
+			return fmt.Errorf("the %s cgroup controller is not available", f.controller)
+		}
+
+		// cgroupfs refuses to create missing files with EACCES.
+		path := filepath.Join(dir, f.name)
+		if _, err := os.Stat(path); os.IsNotExist(err) && f.alias != "" {
+			path = filepath.Join(dir, f.alias)
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if f.optional {
+				continue
+			}
+			return fmt.Errorf("failed to set %s: not supported by the kernel", f.name)
+		}
+		if err := ioutil.WriteFile(path, []byte(f.value), 0); err != nil {
+			return fmt.Errorf("failed to set %s: %w", f.name, err)
+		}
+	}
+
+	return nil
+}
+
+// read returns the value of an interface file of the cgroup.
+func (cg *cgroup) read(controller, name string) (string, error) {
+	dir, ok := cg.dir(controller)
+	if !ok {
+		return "", fmt.Errorf("the %s cgroup controller is not available", controller)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// attach moves the process into the cgroup. With the systemd driver, the
+// scope of the container is started with the process instead, and the
+// resource limits are then set.
+func (cg *cgroup) attach(pid int) error {
+	if cg.scope != "" {
+		return cg.startScope(pid)
+	}
+
+	for _, dir := range cg.dirs {
+		if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0); err != nil {
+			return fmt.Errorf("failed to move the container process into its cgroup: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// oomKills returns the number of processes of the cgroup killed by the OOM
+// killer so far.
+func (cg *cgroup) oomKills() int {
+	name := "memory.events"
+	if _, ok := cg.dirs[""]; !ok {
+		name = "memory.oom_control"
+	}
+
+	value, err := cg.read("memory", name)
+	if err != nil {
+		return 0
+	}
+
+	for _, line := range strings.Split(value, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+
+	return 0
+}
+
+// remove kills the processes left in the cgroup, and removes it once they
+// exited. systemd removes the cgroups of scopes itself.
+func (cg *cgroup) remove() {
+	cg.kill()
+
+	if cg.scope != "" {
+		cg.stopScope()
+		return
+	}
+
+	for _, dir := range cg.dirs {
+		for i := 0; i < 100; i++ {
+			if err := syscall.Rmdir(dir); !errors.Is(err, syscall.EBUSY) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// kill kills the processes of the cgroup. They are frozen first, when the
+// kernel cannot kill them all at once, so that they cannot fork while being
+// killed.
+func (cg *cgroup) kill() {
+	if dir, ok := cg.dirs[""]; ok {
+		if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0); err == nil {
+			return
+		}
+	}
+
+	thaw := cg.freeze()
+	defer thaw()
+
+	for _, dir := range cg.dirs {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+		if err != nil {
+			continue
+		}
+		for _, field := range strings.Fields(string(data)) {
+			if pid, err := strconv.Atoi(field); err == nil {
+				_ = syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	}
+}
+
+// freeze freezes the processes of the cgroup, when the freezer is available,
+// and returns a function thawing them.
+func (cg *cgroup) freeze() func() {
+	file, frozen, thawed := "cgroup.freeze", "1", "0"
+	dir, ok := cg.dirs[""]
+	if !ok {
+		file, frozen, thawed = "freezer.state", "FROZEN", "THAWED"
+		if dir, ok = cg.dirs["freezer"]; !ok {
+			return func() {}
+		}
+	}
+
+	path := filepath.Join(dir, file)
+	if err := ioutil.WriteFile(path, []byte(frozen), 0); err != nil {
+		return func() {}
+	}
+
+	return func() { _ = ioutil.WriteFile(path, []byte(thawed), 0) }
+}
+
+// bytesFlag is a flag holding a size in bytes, given with an optional b, k,
+// m or g unit suffix as with Docker, or -1 for unlimited.
+type bytesFlag int64
+
+func (f *bytesFlag) String() string { return strconv.FormatInt(int64(*f), 10) }
+
+func (f *bytesFlag) Set(value string) error {
+	if value == "-1" {
+		*f = -1
+		return nil
+	}
+
+	n, err := parseBytes(value)
+	if err != nil {
+		return err
+	}
+	*f = bytesFlag(n)
+	return nil
+}
+
+// parseBytes parses a size in bytes with an optional b, k, m or g unit
+// suffix, in powers of 1024. Units may end with b, as in mb.
+func parseBytes(value string) (int64, error) {
+	s := strings.ToLower(value)
+	if len(s) > 2 && strings.HasSuffix(s, "b") && strings.ContainsAny(s[len(s)-2:len(s)-1], "kmg") {
+		s = s[:len(s)-1]
+	}
+
+	unit := int64(1)
+	if i := len(s) - 1; i > 0 && strings.ContainsAny(s[i:], "bkmg") {
+		unit = map[byte]int64{'b': 1, 'k': 1 << 10, 'm': 1 << 20, 'g': 1 << 30}[s[i]]
+		s = s[:i]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes with an optional b, k, m or g suffix", value)
+	}
+
+	return n * unit, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// v1Mounts returns the mount points of the cgroup v1 hierarchies, by
+// controller. Controllers mounted together, such as cpu and cpuacct, share
+// their mount point.
+func v1Mounts() (map[string]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The mount point is the fifth field, and the filesystem type and
+		// super block options follow the separator.
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field != "-" || i < 5 || i+3 >= len(fields) || fields[i+1] != "cgroup" {
+				continue
+			}
+			for _, option := range strings.Split(fields[i+3], ",") {
+				if option != "rw" && option != "ro" && !strings.Contains(option, "=") {
+					mounts[option] = fields[4]
+				}
+			}
+		}
+	}
+
+	return mounts, scanner.Err()
+}
+
+// v1Files returns the cgroup v1 interface files setting the resource limits.
+func (r resources) v1Files() ([]cgroupFile, error) {
+	var files []cgroupFile
+
+	// cgroup v1 cannot throttle memory: the soft limit, down to which the
+	// container memory is reclaimed first under memory pressure, is the
+	// closest to the high limit.
+	if r.memory > 0 {
+		files = append(files, cgroupFile{controller: "memory", name: "memory.limit_in_bytes", value: strconv.FormatInt(int64(r.memory), 10)})
+	}
+	if r.memoryHigh > 0 {
+		files = append(files, cgroupFile{controller: "memory", name: "memory.soft_limit_in_bytes", value: strconv.FormatInt(int64(r.memoryHigh), 10)})
+	}
+
+	// cgroup v1 limits memory and swap together, once the memory limit is
+	// set.
+	switch {
+	case r.memorySwap != 0:
+		files = append(files, cgroupFile{controller: "memory", name: "memory.memsw.limit_in_bytes", value: strconv.FormatInt(int64(r.memorySwap), 10)})
+	case r.memory > 0:
+		files = append(files, cgroupFile{controller: "memory", name: "memory.memsw.limit_in_bytes", value: strconv.FormatInt(int64(2*r.memory), 10), optional: true})
+	}
+	if r.memorySwappiness >= 0 {
+		files = append(files, cgroupFile{controller: "memory", name: "memory.swappiness", value: strconv.Itoa(r.memorySwappiness)})
+	}
+
+	// The period is set first, as the quota cannot exceed it.
+	if quota, period, ok := r.cfsQuota(); ok {
+		files = append(files,
+			cgroupFile{controller: "cpu", name: "cpu.cfs_period_us", value: strconv.FormatInt(period, 10)},
+			cgroupFile{controller: "cpu", name: "cpu.cfs_quota_us", value: strconv.FormatInt(quota, 10)},
+		)
+	}
+	if r.cpuShares > 0 {
+		files = append(files, cgroupFile{controller: "cpu", name: "cpu.shares", value: strconv.FormatInt(r.cpuShares, 10)})
+	}
+
+	if r.cpusetCPUs != "" {
+		files = append(files, cgroupFile{controller: "cpuset", name: "cpuset.cpus", value: r.cpusetCPUs})
+	}
+	if r.cpusetMems != "" {
+		files = append(files, cgroupFile{controller: "cpuset", name: "cpuset.mems", value: r.cpusetMems})
+	}
+
+	if r.pidsLimit > 0 {
+		files = append(files, cgroupFile{controller: "pids", name: "pids.max", value: strconv.FormatInt(r.pidsLimit, 10)})
+	}
+
+	rates, err := r.deviceRates()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range rates {
+		name := "blkio.throttle.read_bps_device"
+		if d.write {
+			name = "blkio.throttle.write_bps_device"
+		}
+		files = append(files, cgroupFile{controller: "blkio", name: name, value: fmt.Sprintf("%s %d", d.device, d.rate)})
+	}
+	// The weight is set by the BFQ I/O scheduler, when used.
+	if r.blkioWeight > 0 {
+		files = append(files, cgroupFile{controller: "blkio", name: "blkio.weight", alias: "blkio.bfq.weight", value: strconv.Itoa(r.blkioWeight)})
+	}
+
+	// The devices are allowed one by one, once all denied.
+	if len(r.devices) > 0 {
+		files = append(files, cgroupFile{controller: "devices", name: "devices.deny", value: "a"})
+		for _, d := range r.devices {
+			files = append(files, cgroupFile{controller: "devices", name: "devices.allow", value: d.String()})
+		}
+	}
+
+	return files, nil
+}
+
+// createCgroupV1 creates the cgroup at path in the cgroup v1 hierarchies of
+// the controllers of the files, and of the freezer, used to kill the
+// container processes, then writes the files.
+func createCgroupV1(path string, files []cgroupFile) (*cgroup, error) {
+	mounts, err := v1Mounts()
+	if err != nil {
+		return nil, err
+	}
+
+	controllers := []string{"freezer"}
+	for _, f := range files {
+		controllers = append(controllers, f.controller)
+	}
+
+	cg := &cgroup{dirs: map[string]string{}}
+	for _, controller := range controllers {
+		if _, ok := cg.dirs[controller]; ok {
+			continue
+		}
+
+		mount, ok := mounts[controller]
+		if !ok {
+			if controller == "freezer" {
+				continue
+			}
+			cg.remove()
+			return nil, fmt.Errorf("the %s cgroup controller is not mounted", controller)
+		}
+
+		dir, err := createV1Dir(mount, path, controller)
+		if err != nil {
+			cg.remove()
+			return nil, err
+		}
+		cg.dirs[controller] = dir
+	}
+
+	if err := cg.write(files); err != nil {
+		cg.remove()
+		return nil, err
+	}
+
+	return cg, nil
+}
+
+// createV1Dir creates the cgroup at path, and its missing ancestors, in the
+// cgroup v1 hierarchy mounted at mount. The cgroup may already exist when the
+// hierarchy is shared with another controller.
+func createV1Dir(mount, path, controller string) (string, error) {
+	dir := mount
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		dir = filepath.Join(dir, name)
+		if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+			return "", fmt.Errorf("failed to create the %s cgroup: %w", controller, err)
+		}
+
+		// New cpuset cgroups have no CPUs and memory nodes, and cannot hold
+		// processes until given the ones of their parent.
+		if controller == "cpuset" {
+			if err := inheritCpuset(dir); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return dir, nil
+}
+
+// inheritCpuset gives the cpuset cgroup the CPUs and memory nodes of its
+// parent, when it has none.
+func inheritCpuset(dir string) error {
+	for _, name := range []string{"cpuset.cpus", "cpuset.mems"} {
+		value, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(value)) != "" {
+			continue
+		}
+
+		if value, err = ioutil.ReadFile(filepath.Join(filepath.Dir(dir), name)); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), value, 0); err != nil {
+			return fmt.Errorf("failed to set %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// command is a command of the CLI, or a subcommand of a command group, run
+// with the arguments following its name.
+type command struct {
+	name        string
+	description string
+	run         func(argv []string) error
+}
+
+// newFlagSet returns the flag set of a command, exiting on invalid flags,
+// whose usage message shows the synopsis of the command arguments then its
+// options.
+func newFlagSet(name, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s %s\n", os.Args[0], name, synopsis)
+
+		options := false
+		fs.VisitAll(func(*flag.Flag) { options = true })
+		if options {
+			fmt.Fprintf(fs.Output(), "\nOptions:\n")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// dispatch runs the command named by the first argument, among the commands
+// of a group, the top-level ones for an empty group, and returns its error.
+// help, -h and --help list the commands, or show the usage of the one named
+// after them.
+func dispatch(group string, commands []command, argv []string) error {
+	prefix := os.Args[0]
+	if group != "" {
+		prefix += " " + group
+	}
+
+	if len(argv) < 1 {
+		printCommands(os.Stderr, prefix, commands)
+		os.Exit(2)
+	}
+
+	name := argv[0]
+	switch name {
+	case "help", "-h", "--help":
+		if len(argv) < 2 {
+			printCommands(os.Stdout, prefix, commands)
+			return nil
+		}
+		name, argv = argv[1], []string{argv[1], "--help"}
+	}
+
+	for _, c := range commands {
+		if c.name == name {
+			return c.run(argv[1:])
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: unknown command %q\nRun '%s --help' for the list of commands.\n", prefix, name, prefix)
+	os.Exit(2)
+	return nil
+}
+
+// printCommands prints the usage of a command group with its commands and
+// their description. Commands without description are internal ones.
+func printCommands(out io.Writer, prefix string, commands []command) {
+	fmt.Fprintf(out, "Usage: %s <command> [options] <args>...\n\nCommands:\n", prefix)
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, c := range commands {
+		if c.description != "" {
+			fmt.Fprintf(w, "  %s\t%s\n", c.name, c.description)
+		}
+	}
+	_ = w.Flush()
+}
+
+// Exit codes of failures, as with Docker, telling apart the ones of the
+// runtime from the ones of the container command.
+const (
+	exitRuntimeError = 125
+	exitCannotInvoke = 126
+	exitNotFound     = 127
+)
+
+// exitError is an error to exit with a specific code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// fatal prints the error and exits with its code, 125 unless it is an
+// exitError.
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+
+	code := exitRuntimeError
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.code
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,940 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// container is the root filesystem of an image, ready to run commands.
+type container struct {
+	id      string
+	name    string
+	image   string
+	rootDir string
+	env     []string
+	ids     *identities
+
+	// hostname is the name of the container in its UTS namespace, or the
+	// host one.
+	hostname string
+
+	// ipc and network are the IPC namespace and network modes of the
+	// container.
+	ipc     string
+	network string
+
+	// published are the host ports forwarded to the container with
+	// slirp4netns, and stopNetwork stops the slirp4netns process of the
+	// last container process started.
+	published   []portMapping
+	stopNetwork func()
+
+	// egressRate and ingressRate cap the bandwidth of the container network
+	// interface, in bytes per second.
+	egressRate  int64
+	ingressRate int64
+
+	// cloneflags are the namespaces the container process is created in,
+	// and joins the namespaces of other containers, by ID, it joins.
+	cloneflags uintptr
+	joins      []namespaceJoin
+
+	// cgroup limits the resources of the container, if any, and oomKills
+	// is the number of processes the OOM killer killed in it before the last
+	// container process started.
+	cgroup   *cgroup
+	oomKills int
+
+	// ulimits are the resource limits of the container process, as
+	// <name>=<soft>[:<hard>] values, and oomScoreAdj adjusts its likelihood
+	// of being killed by the OOM killer.
+	ulimits     []string
+	oomScoreAdj int
+
+	// capabilities are the names of the capabilities of the container
+	// process, and seccomp its seccomp profile, if any.
+	capabilities []string
+	seccomp      string
+
+	// processLabel and mountLabel are the SELinux labels of the container
+	// processes and files, on SELinux hosts.
+	processLabel string
+	mountLabel   string
+
+	// noNewPrivileges keeps the container processes from gaining privileges
+	// by executing setuid programs or programs with file capabilities.
+	noNewPrivileges bool
+
+	// devices are the host devices exposed in the container, and gpus the
+	// GPUs, in the nvidia-container-cli format.
+	devices []deviceMapping
+	gpus    string
+
+	// readOnly mounts the root filesystem read-only, and tmpfs are mounted
+	// in the container, as <path>[:<options>] values.
+	readOnly bool
+	tmpfs    []string
+
+	// volumes are the host paths bind mounted in the container.
+	volumes []bindMount
+
+	// workdir is the working directory of the container process, and user
+	// the one it runs as, if not root.
+	workdir string
+	user    *containerUser
+
+	// entrypoint and cmd are the command line of the container process
+	// when run without arguments, the ones of the image unless overridden.
+	entrypoint []string
+	cmd        []string
+
+	// listeners are passed to the container process from file descriptor 3
+	// on.
+	listeners []listener
+
+	// unmountRootfs releases the root filesystem mounted by the storage
+	// driver, if any.
+	unmountRootfs func()
+
+	// releaseVolumes allows the named volumes used to be removed again.
+	releaseVolumes []func()
+}
+
+// createContainer pulls the image and extracts it in a new root directory.
+func createContainer(image string, opts *runOptions) (*container, error) {
+	ids, err := openIdentities()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := ids.newID()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.name != "" {
+		if err := ids.claimName(opts.name, id); err != nil {
+			ids.releaseID(id)
+			return nil, err
+		}
+	}
+
+	c := &container{
+		id:    id,
+		name:  opts.name,
+		image: image,
+		ids:   ids,
+
+		hostname: opts.hostname,
+		ipc:      opts.ipc,
+		network:  opts.network,
+
+		readOnly:    opts.readOnly,
+		tmpfs:       opts.tmpfs,
+		egressRate:  int64(opts.egressRate),
+		ingressRate: int64(opts.ingressRate),
+		ulimits:     opts.ulimits,
+		oomScoreAdj: opts.oomScoreAdj,
+	}
+
+	if c.cloneflags, err = cloneFlags(opts); err != nil {
+		c.remove()
+		return nil, err
+	}
+	for _, j := range namespaceJoins(opts) {
+		if j.container, err = ids.lookup(j.container); err != nil {
+			c.remove()
+			return nil, err
+		}
+		c.joins = append(c.joins, j)
+	}
+
+	// Containers in the host UTS namespace have the host hostname.
+	if c.cloneflags&syscall.CLONE_NEWUTS == 0 {
+		if c.hostname != "" {
+			c.remove()
+			return nil, fmt.Errorf("the hostname cannot be set in the host UTS namespace")
+		}
+		if c.hostname, err = os.Hostname(); err != nil {
+			c.remove()
+			return nil, err
+		}
+	}
+	if c.hostname == "" {
+		c.hostname = shortID(id)
+	}
+
+	for _, spec := range opts.publish {
+		p, err := parsePublish(spec)
+		if err != nil {
+			c.remove()
+			return nil, err
+		}
+		c.published = append(c.published, p)
+	}
+	if len(c.published) > 0 && c.network != networkSlirp {
+		c.remove()
+		return nil, fmt.Errorf("publishing ports requires the %s network", networkSlirp)
+	}
+	for _, spec := range c.ulimits {
+		if _, err := parseUlimit(spec); err != nil {
+			c.remove()
+			return nil, err
+		}
+	}
+	if c.oomScoreAdj < -1000 || c.oomScoreAdj > 1000 {
+		c.remove()
+		return nil, fmt.Errorf("invalid OOM score adjustment %d, expected a value from -1000 to 1000", c.oomScoreAdj)
+	}
+
+	if c.capabilities, err = containerCapabilities(opts.capAdd, opts.capDrop); err != nil {
+		c.remove()
+		return nil, err
+	}
+	if err := c.setSecurityOpts(opts.securityOpts); err != nil {
+		c.remove()
+		return nil, err
+	}
+
+	if (c.egressRate > 0 || c.ingressRate > 0) && c.network != networkSlirp {
+		c.remove()
+		return nil, fmt.Errorf("limiting the bandwidth requires the %s network", networkSlirp)
+	}
+
+	if opts.workdir != "" && !filepath.IsAbs(opts.workdir) {
+		c.remove()
+		return nil, fmt.Errorf("invalid working directory %q, it must be an absolute path", opts.workdir)
+	}
+
+	for _, spec := range c.tmpfs {
+		if _, err := parseTmpfs(spec); err != nil {
+			c.remove()
+			return nil, err
+		}
+	}
+	for _, spec := range opts.volumes {
+		m, err := parseVolume(spec)
+		if err != nil {
+			c.remove()
+			return nil, err
+		}
+		if m.volume == "" {
+			if _, err = os.Stat(m.hostPath); os.IsNotExist(err) {
+				err = os.MkdirAll(m.hostPath, 0755)
+			}
+			if err != nil {
+				c.remove()
+				return nil, fmt.Errorf("failed to create the volume %s: %w", m.hostPath, err)
+			}
+		}
+		c.volumes = append(c.volumes, m)
+	}
+	for _, spec := range opts.mounts {
+		m, err := parseMount(spec)
+		if err != nil {
+			c.remove()
+			return nil, err
+		}
+		if m.kind == mountTypeTmpfs {
+			c.tmpfs = append(c.tmpfs, m.tmpfs)
+		} else {
+			c.volumes = append(c.volumes, m.bind)
+		}
+	}
+	for _, spec := range opts.devices {
+		d, err := parseDevice(spec)
+		if err != nil {
+			c.remove()
+			return nil, err
+		}
+		c.devices = append(c.devices, d)
+	}
+	if opts.gpus != "" {
+		if c.gpus, err = parseGPUs(opts.gpus); err != nil {
+			c.remove()
+			return nil, err
+		}
+		if _, err := exec.LookPath(nvidiaContainerCLI); err != nil {
+			c.remove()
+			return nil, fmt.Errorf("exposing GPUs requires %s, from the NVIDIA Container Toolkit", nvidiaContainerCLI)
+		}
+	}
+
+	// Containers get a cgroup of their own, restricting the devices they can
+	// access, as they keep CAP_MKNOD. Without limits or placement, failing
+	// to create it is only a warning, on hosts without a writable cgroup
+	// hierarchy. In rootless mode, where only the devices of the user are
+	// accessible, they only get one when limited or placed.
+	r := opts.resources
+	if !rootless() {
+		r.devices = append(r.devices, defaultDeviceRules...)
+		for _, d := range c.devices {
+			rule, err := d.rule()
+			if err != nil {
+				c.remove()
+				return nil, err
+			}
+			r.devices = append(r.devices, rule)
+		}
+		if c.gpus != "" {
+			rules, err := gpuDeviceRules()
+			if err != nil {
+				c.remove()
+				return nil, err
+			}
+			r.devices = append(r.devices, rules...)
+		}
+	}
+	required := r.limited() || opts.cgroup.parent != "" || opts.cgroup.driver != cgroupfsDriver
+	if !rootless() || required {
+		if c.cgroup, err = createCgroup(id, r, opts.cgroup); err != nil && required {
+			c.remove()
+			return nil, err
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create the container cgroup, its devices are not restricted: %s\n", err)
+			c.cgroup = nil
+		}
+	}
+
+	if err := c.setup(opts); err != nil {
+		c.remove()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *container) setup(opts *runOptions) error {
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	image := c.image
+	if opts.lockFile != "" {
+		if image, err = lockedImage(image, opts.lockFile); err != nil {
+			return err
+		}
+	}
+
+	// Registry images are resolved first and pulled while extracting them.
+	var r *registry
+	var manifest manifestResponse
+	if isLocalSource(image) {
+		manifest, err = openImage(s, image, opts.pull)
+	} else {
+		var ref reference
+		if ref, err = parseReference(image); err == nil {
+			r, manifest, err = resolveImage(s, ref, opts.pull)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if opts.verifyKey != "" {
+		if err := verifySignature(c.image, manifest, opts.verifyKey); err != nil {
+			return err
+		}
+	}
+
+	if opts.pooled {
+		c.rootDir = acquirePooled(s, c.image, manifest)
+	}
+
+	// Without a pooled root filesystem, the storage driver creates it from
+	// the image layers.
+	var unpack func(layer) error
+	var driver storageDriver
+	if c.rootDir == "" {
+		if _, driver, err = openStorageDriver(opts.storageDriver); err != nil {
+			return err
+		}
+		if c.rootDir, err = ioutil.TempDir("", "docker"); err != nil {
+			return err
+		}
+		unpack = func(l layer) error { return driver.unpack(s, l, c.rootDir) }
+	}
+
+	if r != nil {
+		err = s.pullImage(r, manifest, unpack)
+	} else if unpack != nil {
+		for _, l := range manifest.Layers {
+			if err = unpack(l); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if driver != nil {
+		rootDir, unmount, err := driver.mount(s, manifest, c.rootDir, c.mountLabel)
+		if err != nil {
+			return err
+		}
+		c.rootDir, c.unmountRootfs = rootDir, unmount
+	} else if c.mountLabel != "" {
+		if err := relabel(c.rootDir, c.mountLabel); err != nil {
+			return err
+		}
+	}
+
+	config, err := s.config(manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+	c.env = imageEnv(config)
+	c.entrypoint, c.cmd = imageCommand(config, opts.entrypoint)
+	c.workdir = opts.workdir
+	if c.workdir == "" {
+		c.workdir = config.Config.WorkingDir
+	}
+	c.env = append(c.env, "HOSTNAME="+c.hostname)
+
+	var pid int
+	for _, j := range c.joins {
+		if j.flag == syscall.CLONE_NEWNET {
+			if pid, err = c.ids.containerPID(j.container); err != nil {
+				return err
+			}
+		}
+	}
+	if err := setupNameFiles(c.rootDir, c.hostname, c.network, pid); err != nil {
+		return err
+	}
+
+	// The host timezone is only inherited when it can be set up, an
+	// explicit one must be.
+	if tz := opts.timezone; tz != "" {
+		if err := setupTimezone(c.rootDir, tz); err != nil {
+			return err
+		}
+		c.env = append(c.env, "TZ="+tz)
+	} else if tz := hostTimezone(); tz != "" && setupTimezone(c.rootDir, tz) == nil {
+		c.env = append(c.env, "TZ="+tz)
+	}
+
+	env, err := containerEnv(opts)
+	if err != nil {
+		return err
+	}
+	c.env = mergeEnv(c.env, env)
+
+	// Containers run as root unless the options or the image set a user,
+	// whose home is the default HOME.
+	spec := opts.user
+	if spec == "" {
+		spec = config.Config.User
+	}
+	resolved := spec
+	if resolved == "" {
+		resolved = "0"
+	}
+	user, err := resolveUser(c.rootDir, resolved)
+	if err != nil {
+		return err
+	}
+	if spec != "" {
+		c.user = &user
+	}
+	c.env = mergeEnv([]string{"HOME=" + user.home}, c.env)
+
+	if err := c.setupVolumes(s); err != nil {
+		return err
+	}
+
+	return c.setupSockets(opts)
+}
+
+// setupVolumes creates the missing named volumes mounted in the container,
+// and keeps them from being removed while in use. Empty volumes are given the
+// content of the image directory they are mounted on, as with Docker.
+func (c *container) setupVolumes(s *store) error {
+	for i, m := range c.volumes {
+		if m.volume == "" {
+			continue
+		}
+
+		v, release, err := s.useVolume(m.volume)
+		if err != nil {
+			return err
+		}
+		c.releaseVolumes = append(c.releaseVolumes, release)
+		c.volumes[i].hostPath = v.Mountpoint
+		if m.noCopy {
+			continue
+		}
+
+		source, err := resolvePath(c.rootDir, m.containerPath)
+		if err != nil {
+			return err
+		}
+		if err := s.populateVolume(v, source); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setupSockets adds the exposed host sockets to the bind mounts of the
+// container, mounted from within it as volumes, and gathers the listening
+// sockets inherited by this process or opened for the container process.
+func (c *container) setupSockets(opts *runOptions) error {
+	for _, spec := range opts.exposedSockets {
+		m, err := parseExposedSocket(spec)
+		if err != nil {
+			return err
+		}
+		c.volumes = append(c.volumes, m)
+	}
+
+	c.listeners = inheritedListeners()
+	for _, spec := range opts.listen {
+		l, err := openListener(spec)
+		if err != nil {
+			return err
+		}
+		c.listeners = append(c.listeners, l)
+	}
+
+	if len(c.listeners) > 0 {
+		c.env = append(c.env, listenEnv(c.listeners)...)
+	}
+
+	return nil
+}
+
+// remove deletes the container root directory, and releases its identity.
+func (c *container) remove() {
+	if c.stopNetwork != nil {
+		c.stopNetwork()
+	}
+
+	if c.cgroup != nil {
+		c.cgroup.remove()
+	}
+
+	for _, l := range c.listeners {
+		l.close()
+	}
+
+	if c.unmountRootfs != nil {
+		c.unmountRootfs()
+	}
+
+	for _, release := range c.releaseVolumes {
+		release()
+	}
+
+	if c.rootDir != "" {
+		_ = os.RemoveAll(c.rootDir)
+	}
+
+	c.ids.releasePID(c.id)
+	if c.name != "" {
+		c.ids.releaseName(c.name, c.id)
+	}
+	c.ids.releaseID(c.id)
+}
+
+// defaultPath is the PATH of containers whose image does not set one.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// imageEnv returns the environment the image configuration sets for its
+// containers, with a default PATH when missing.
+func imageEnv(config imageConfig) []string {
+	env := append([]string{}, config.Config.Env...)
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") {
+			return env
+		}
+	}
+
+	return append(env, "PATH="+defaultPath)
+}
+
+// imageCommand returns the entrypoint and command of the image configuration,
+// as overridden by the entrypoint option: as with Docker, setting it, empty to
+// clear the entrypoint, also clears the command.
+func imageCommand(config imageConfig, entrypoint optionalFlag) ([]string, []string) {
+	if entrypoint.value == nil {
+		return config.Config.Entrypoint, config.Config.Cmd
+	}
+	if *entrypoint.value == "" {
+		return nil, nil
+	}
+	return []string{*entrypoint.value}, nil
+}
+
+// commandLine returns the command line of the container process: the
+// entrypoint followed by the arguments, or by cmd without arguments.
+func commandLine(entrypoint, cmd, args []string) ([]string, error) {
+	if len(args) > 0 {
+		cmd = args
+	}
+
+	line := append(append([]string{}, entrypoint...), cmd...)
+	if len(line) == 0 {
+		return nil, errors.New("no command specified, as argument or by the image")
+	}
+	return line, nil
+}
+
+// namespaces names the namespaces containers can be created in.
+var namespaces = []struct {
+	name string
+	flag uintptr
+}{
+	{"mnt", syscall.CLONE_NEWNS},
+	{"pid", syscall.CLONE_NEWPID},
+	{"uts", syscall.CLONE_NEWUTS},
+	{"ipc", syscall.CLONE_NEWIPC},
+	{"net", syscall.CLONE_NEWNET},
+	{"cgroup", cloneNewCgroup},
+}
+
+// setSecurityOpts applies the <name>=<value> security options to the
+// container. Boolean options can be given without a value.
+func (c *container) setSecurityOpts(opts []string) error {
+	c.seccomp = seccompDefault
+	labeled := selinuxEnabled()
+	for _, opt := range opts {
+		name, value := opt, ""
+		if i := strings.Index(opt, "="); i >= 0 {
+			name, value = opt[:i], opt[i+1:]
+		} else if name != "no-new-privileges" {
+			return fmt.Errorf("invalid security option %q, expected <name>=<value>", opt)
+		}
+
+		switch name {
+		case "no-new-privileges":
+			switch value {
+			case "", "true":
+				c.noNewPrivileges = true
+			case "false":
+				c.noNewPrivileges = false
+			default:
+				return fmt.Errorf("invalid no-new-privileges option %q, expected true or false", value)
+			}
+		case "seccomp":
+			c.seccomp = ""
+			if value == seccompUnconfined {
+				continue
+			}
+
+			// The profile is loaded by the container process, from another
+			// working directory, and checked beforehand.
+			path, err := filepath.Abs(value)
+			if err != nil {
+				return err
+			}
+			if auditArch == 0 {
+				return fmt.Errorf("seccomp filters are not supported on this architecture")
+			}
+			profile, err := loadSeccompProfile(path)
+			if err != nil {
+				return err
+			}
+			if _, err := profile.compile(c.capabilities); err != nil {
+				return fmt.Errorf("invalid seccomp profile %s: %w", path, err)
+			}
+			c.seccomp = path
+		case "label":
+			if value != "disable" {
+				return fmt.Errorf("invalid label option %q, expected disable", value)
+			}
+			labeled = false
+		default:
+			return fmt.Errorf("unknown security option %q", name)
+		}
+	}
+
+	if c.seccomp == seccompDefault && auditArch == 0 {
+		fmt.Fprintf(os.Stderr, "seccomp filters are not supported on this architecture, running the container unconfined\n")
+		c.seccomp = ""
+	}
+
+	if labeled {
+		c.processLabel, c.mountLabel = containerLabels(c.id)
+	}
+
+	return nil
+}
+
+// cloneNewCgroup creates a new cgroup namespace, missing from the syscall
+// package.
+const cloneNewCgroup = 0x02000000
+
+// Namespace modes: the container gets a namespace of its own, or shares the
+// host one.
+const (
+	namespacePrivate = "private"
+	namespaceHost    = "host"
+)
+
+// cloneFlags returns the namespaces to create the container process in.
+func cloneFlags(opts *runOptions) (uintptr, error) {
+	flags := uintptr(syscall.CLONE_NEWNS)
+
+	switch opts.uts {
+	case namespacePrivate:
+		flags |= syscall.CLONE_NEWUTS
+	case namespaceHost:
+	default:
+		return 0, fmt.Errorf("invalid UTS namespace mode %q, expected %s or %s", opts.uts, namespacePrivate, namespaceHost)
+	}
+
+	switch {
+	case opts.pid == namespacePrivate:
+		flags |= syscall.CLONE_NEWPID
+	case opts.pid == namespaceHost, strings.HasPrefix(opts.pid, namespaceContainer) && opts.pid != namespaceContainer:
+	default:
+		return 0, fmt.Errorf("invalid PID namespace mode %q, expected %s, %s or %s<name or ID>", opts.pid, namespacePrivate, namespaceHost, namespaceContainer)
+	}
+
+	switch opts.ipc {
+	case namespacePrivate:
+		flags |= syscall.CLONE_NEWIPC
+	case namespaceHost:
+	default:
+		return 0, fmt.Errorf("invalid IPC mode %q, expected %s or %s", opts.ipc, namespacePrivate, namespaceHost)
+	}
+
+	switch opts.cgroupns {
+	case namespacePrivate:
+		flags |= cloneNewCgroup
+	case namespaceHost:
+	default:
+		return 0, fmt.Errorf("invalid cgroup namespace mode %q, expected %s or %s", opts.cgroupns, namespacePrivate, namespaceHost)
+	}
+
+	switch {
+	case opts.network == networkNone, opts.network == networkSlirp:
+		flags |= syscall.CLONE_NEWNET
+	case opts.network == namespaceHost, strings.HasPrefix(opts.network, namespaceContainer) && opts.network != namespaceContainer:
+	default:
+		return 0, fmt.Errorf("invalid network mode %q, expected %s, %s, %s or %s<name or ID>", opts.network, networkNone, namespaceHost, networkSlirp, namespaceContainer)
+	}
+
+	return flags, nil
+}
+
+// command returns the command running the program in the container, to be
+// started with start or run, its standard streams being left to the caller.
+// The process starts as this executable, which sets up the container before
+// executing the program.
+func (c *container) command(command string, args []string) *exec.Cmd {
+	initArgs := []string{initCommand, "-ipc", c.ipc, "-network", c.network}
+	cloneflags := c.cloneflags
+	if cloneflags&syscall.CLONE_NEWUTS != 0 {
+		initArgs = append(initArgs, "-hostname", c.hostname)
+	}
+
+	// Processes set up once started wait on the pipe passed after the
+	// listeners.
+	if c.delayed() {
+		initArgs = append(initArgs, "-wait-fd", strconv.Itoa(3+len(c.listeners)))
+	}
+	if c.egressRate > 0 {
+		initArgs = append(initArgs, "-egress-rate", strconv.FormatInt(c.egressRate, 10))
+	}
+	if c.ingressRate > 0 {
+		initArgs = append(initArgs, "-ingress-rate", strconv.FormatInt(c.ingressRate, 10))
+	}
+	for _, spec := range c.ulimits {
+		initArgs = append(initArgs, "-ulimit", spec)
+	}
+	if c.oomScoreAdj != 0 {
+		initArgs = append(initArgs, "-oom-score-adj", strconv.Itoa(c.oomScoreAdj))
+	}
+	initArgs = append(initArgs, "-capabilities", strings.Join(c.capabilities, ","))
+	if c.seccomp != "" {
+		initArgs = append(initArgs, "-seccomp", c.seccomp)
+	}
+	if c.processLabel != "" {
+		initArgs = append(initArgs, "-process-label", c.processLabel, "-mount-label", c.mountLabel)
+	}
+	if c.noNewPrivileges {
+		initArgs = append(initArgs, "-no-new-privileges")
+	}
+	for _, d := range c.devices {
+		initArgs = append(initArgs, "-device", d.hostPath+":"+d.containerPath)
+	}
+	if c.readOnly {
+		initArgs = append(initArgs, "-read-only")
+	}
+	for _, spec := range c.tmpfs {
+		initArgs = append(initArgs, "-tmpfs", spec)
+	}
+	for _, m := range c.volumes {
+		initArgs = append(initArgs, "-volume", m.String())
+	}
+	if c.workdir != "" {
+		initArgs = append(initArgs, "-workdir", c.workdir)
+	}
+	if c.user != nil {
+		groups := make([]string, len(c.user.groups))
+		for i, g := range c.user.groups {
+			groups[i] = strconv.Itoa(g)
+		}
+		initArgs = append(initArgs, "-user", fmt.Sprintf("%d:%d", c.user.uid, c.user.gid), "-groups", strings.Join(groups, ","))
+	}
+	// The cgroup namespace is created once in the cgroup, which is then its
+	// root.
+	if c.cgroup != nil && cloneflags&cloneNewCgroup != 0 {
+		initArgs = append(initArgs, "-unshare-cgroupns")
+		cloneflags &^= cloneNewCgroup
+	}
+
+	cmd := exec.Command("/proc/self/exe", append(append(initArgs, c.rootDir, command), args...)...)
+	cmd.Env = c.env
+	cmd.Stdin = nullReader{}
+	for _, l := range c.listeners {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, l.file)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: cloneflags,
+	}
+
+	return cmd
+}
+
+// delayed reports whether the container process must wait to be set up from
+// the outside once started.
+func (c *container) delayed() bool {
+	return c.cgroup != nil || c.network == networkSlirp || c.gpus != ""
+}
+
+// start starts the container process returned by command, moves it into the
+// container cgroup and connects it to the network.
+func (c *container) start(cmd *exec.Cmd) error {
+	if c.stopNetwork != nil {
+		c.stopNetwork()
+		c.stopNetwork = nil
+	}
+
+	if !c.delayed() {
+		return c.startProcess(cmd)
+	}
+
+	// The init waits until the pipe is closed.
+	wait, ready, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	cmd.ExtraFiles = append(cmd.ExtraFiles, wait)
+	err = c.startProcess(cmd)
+	_ = wait.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := c.attach(cmd.Process.Pid); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+
+	return nil
+}
+
+// startProcess starts the container process in the namespaces it joins, and
+// records its PID.
+func (c *container) startProcess(cmd *exec.Cmd) error {
+	if err := startInNamespaces(cmd, c.ids, c.joins); err != nil {
+		return err
+	}
+
+	if err := c.ids.setPID(c.id, cmd.Process.Pid); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+	return nil
+}
+
+// attach moves the started container process into the container cgroup,
+// exposes the GPUs in its mount namespace, and connects it to the network.
+func (c *container) attach(pid int) error {
+	if c.cgroup != nil {
+		if err := c.cgroup.attach(pid); err != nil {
+			return err
+		}
+		c.oomKills = c.cgroup.oomKills()
+	}
+
+	if c.gpus != "" {
+		if err := configureGPUs(pid, c.rootDir, c.gpus); err != nil {
+			return err
+		}
+	}
+
+	if c.network == networkSlirp {
+		stop, err := startSlirp(pid, c.published)
+		if err != nil {
+			return err
+		}
+		c.stopNetwork = stop
+	}
+
+	return nil
+}
+
+// oomKilled reports whether the OOM killer killed processes of the container
+// since its last process started, as they exceeded its memory limit.
+func (c *container) oomKilled() bool {
+	return c.cgroup != nil && c.cgroup.oomKills() > c.oomKills
+}
+
+// run starts the container process returned by command, and waits for it to
+// exit.
+func (c *container) run(cmd *exec.Cmd) error {
+	if err := c.start(cmd); err != nil {
+		return err
+	}
+
+	return cmd.Wait()
+}
+
+// extractImage extracts the layers of a stored image into rootDir.
+func extractImage(s *store, manifest manifestResponse, rootDir string) error {
+	for _, l := range manifest.Layers {
+		if err := extractLayer(s.blobPath(l.Digest), l, rootDir, applyWhiteouts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractLayer extracts the layer blob at path into rootDir, as applyLayer
+// does.
+func extractLayer(path string, l layer, rootDir string, whiteouts whiteoutFormat) error {
+	layer, err := openLayer(path, l)
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+
+	if err := applyLayer(layer, rootDir, whiteouts); err != nil {
+		return err
+	}
+
+	// Read the padding after the end of the archive, so that decompression
+	// and decryption errors found at the end of the stream are reported.
+	_, err = io.Copy(ioutil.Discard, layer)
+	return err
+}
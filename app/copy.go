@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// Usage: your_docker.sh copy [options] <source image> <destination image>
+func copyCmd(argv []string) error {
+	copyFlags := newFlagSet("copy", "[options] <source image> <destination image>")
+	addRegistryFlags(copyFlags)
+	copyFlags.Int64Var(&pushChunkSize, "chunk-size", pushChunkSize, "size of blob upload chunks in bytes, 0 to upload blobs in one request")
+	_ = copyFlags.Parse(argv)
+
+	if copyFlags.NArg() != 2 {
+		copyFlags.Usage()
+		os.Exit(2)
+	}
+
+	srcRef, err := parseReference(copyFlags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	dstRef, err := parseReference(copyFlags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	src, manifest, err := openRepository(srcRef)
+	if err != nil {
+		return err
+	}
+
+	dst, err := connectRegistry(dstRef, "https", dstRef.apiHost(), "pull,push")
+	if err != nil {
+		return err
+	}
+
+	if err := copyImage(src, dst, manifest); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: digest: %s size: %d\n", dstRef, manifest.digest(), len(manifest.raw))
+
+	return nil
+}
+
+// copyImage copies the blobs and manifest of an image from a repository to
+// another. Blobs are streamed from the source to the destination registry,
+// or mounted when both repositories live in the same registry.
+func copyImage(src, dst *registry, manifest manifestResponse) error {
+	for _, blob := range append(manifest.Layers, manifest.Config) {
+		p := newProgress(blob.Digest, blob.Size)
+
+		exists, err := dst.hasBlob(blob.Digest)
+		if err != nil {
+			return err
+		}
+		if exists {
+			p.status("Layer already exists")
+			continue
+		}
+
+		err = registryRetry.do("copying blob "+blob.Digest, func() error {
+			var query string
+			if src.host == dst.host {
+				query = url.Values{"mount": {blob.Digest}, "from": {src.ref.repository}}.Encode()
+			}
+
+			location, err := dst.startUpload(query)
+			if err != nil {
+				return err
+			}
+			if location == "" {
+				p.status("Mounted from " + src.ref.repository)
+				return nil
+			}
+
+			if err := dst.sendBlob(location, src.blobSource(blob.Digest), blob.Digest, p); err != nil {
+				return err
+			}
+			p.status("Pushed")
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return dst.putManifest(manifest)
+}
+
+// blobSource streams the blob from the registry.
+func (r *registry) blobSource(digest string) blobSource {
+	return func() (io.ReadCloser, int64, error) {
+		req, err := r.newRequest(http.MethodGet, "blobs/"+digest)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, 0, retryable(err)
+		}
+
+		if err := checkStatus(resp, "failed to get image blob"); err != nil {
+			_ = resp.Body.Close()
+			return nil, 0, err
+		}
+
+		return resp.Body, resp.ContentLength, nil
+	}
+}
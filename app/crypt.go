@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+// Annotations of encrypted layers, as written by ocicrypt: the layer key
+// wrapped for each recipient as JWE documents, and the public cipher options.
+const (
+	encKeysJWEAnnotation  = "org.opencontainers.image.enc.keys.jwe"
+	encPubOptsAnnotation  = "org.opencontainers.image.enc.pubopts"
+	encryptedMediaTypeTag = "+encrypted"
+	aesCTRHMACSHA256      = "AES_256_CTR_HMAC_SHA256"
+)
+
+// decryptionKeys are the paths of the PEM private keys encrypted layers are
+// decrypted with.
+var decryptionKeys []string
+
+// addDecryptionFlags registers the flags configuring layer decryption.
+func addDecryptionFlags(fs *flag.FlagSet) {
+	fs.Var((*stringsFlag)(&decryptionKeys), "decryption-key", "PEM private key to decrypt encrypted layers with (repeatable)")
+}
+
+// isEncrypted reports whether the layer is encrypted.
+func isEncrypted(l layer) bool {
+	return strings.HasSuffix(l.MediaType, encryptedMediaTypeTag)
+}
+
+// layerCipherOptions are the public or private options of a layer cipher.
+// Binary values are base64 encoded.
+type layerCipherOptions struct {
+	Cipher        string            `json:"cipher,omitempty"`
+	Hmac          []byte            `json:"hmac,omitempty"`
+	SymmetricKey  []byte            `json:"symkey,omitempty"`
+	Digest        string            `json:"digest,omitempty"`
+	CipherOptions map[string][]byte `json:"cipheroptions,omitempty"`
+}
+
+// decryptLayer returns the decrypted content of the encrypted layer read from
+// r. The layer key is unwrapped with one of the decryption keys, and the
+// integrity of the layer is checked once it is entirely read.
+func decryptLayer(r io.Reader, l layer) (io.Reader, error) {
+	if len(decryptionKeys) == 0 {
+		return nil, fmt.Errorf("layer %s is encrypted, a --decryption-key is required", l.Digest)
+	}
+
+	var public layerCipherOptions
+	if opts := l.Annotations[encPubOptsAnnotation]; opts != "" {
+		data, err := base64.StdEncoding.DecodeString(opts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid layer cipher options: %w", err)
+		}
+		if err := json.Unmarshal(data, &public); err != nil {
+			return nil, fmt.Errorf("invalid layer cipher options: %w", err)
+		}
+	}
+
+	private, err := unwrapLayerKey(l)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherType := public.Cipher
+	if cipherType == "" {
+		cipherType = aesCTRHMACSHA256
+	}
+	if cipherType != aesCTRHMACSHA256 {
+		return nil, fmt.Errorf("unsupported layer cipher %s", cipherType)
+	}
+
+	block, err := aes.NewCipher(private.SymmetricKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := private.CipherOptions["nonce"]
+	if len(nonce) != block.BlockSize() {
+		return nil, errors.New("invalid layer cipher nonce")
+	}
+
+	return &ctrReader{
+		r:      r,
+		stream: cipher.NewCTR(block, nonce),
+		hmac:   hmac.New(sha256.New, private.SymmetricKey),
+		sum:    public.Hmac,
+	}, nil
+}
+
+// ctrReader decrypts an AES-CTR stream, checking its HMAC at the end.
+type ctrReader struct {
+	r      io.Reader
+	stream cipher.Stream
+	hmac   hash.Hash
+	sum    []byte
+}
+
+func (c *ctrReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.hmac.Write(b[:n])
+	c.stream.XORKeyStream(b[:n], b[:n])
+
+	if err == io.EOF && !hmac.Equal(c.hmac.Sum(nil), c.sum) {
+		return n, errors.New("encrypted layer integrity check failed")
+	}
+
+	return n, err
+}
+
+// unwrapLayerKey returns the private cipher options of the layer, unwrapping
+// them from its JWE documents with the first matching decryption key.
+func unwrapLayerKey(l layer) (layerCipherOptions, error) {
+	wrapped := l.Annotations[encKeysJWEAnnotation]
+	if wrapped == "" {
+		return layerCipherOptions{}, fmt.Errorf("layer %s is not encrypted with JWE, the only supported key wrapping", l.Digest)
+	}
+
+	var keys []crypto.PrivateKey
+	for _, path := range decryptionKeys {
+		key, err := readPrivateKey(path)
+		if err != nil {
+			return layerCipherOptions{}, err
+		}
+		keys = append(keys, key)
+	}
+
+	for _, doc := range strings.Split(wrapped, ",") {
+		data, err := base64.StdEncoding.DecodeString(doc)
+		if err != nil {
+			continue
+		}
+
+		for _, key := range keys {
+			plaintext, err := decryptJWE(data, key)
+			if err != nil {
+				continue
+			}
+
+			var opts layerCipherOptions
+			if err := json.Unmarshal(plaintext, &opts); err != nil {
+				return layerCipherOptions{}, fmt.Errorf("invalid layer key: %w", err)
+			}
+			return opts, nil
+		}
+	}
+
+	return layerCipherOptions{}, fmt.Errorf("no decryption key matches layer %s", l.Digest)
+}
+
+// readPrivateKey reads a PEM encoded RSA or EC private key.
+func readPrivateKey(path string) (crypto.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM encoded private key", path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid private key: %w", path, err)
+	}
+
+	return key, nil
+}
+
+// jweHeader holds the JWE header parameters used to unwrap keys.
+type jweHeader struct {
+	Alg string `json:"alg,omitempty"`
+	Enc string `json:"enc,omitempty"`
+	Apu string `json:"apu,omitempty"`
+	Apv string `json:"apv,omitempty"`
+	Epk *struct {
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	} `json:"epk,omitempty"`
+}
+
+// merge fills the parameters unset in h from other.
+func (h *jweHeader) merge(other jweHeader) {
+	if h.Alg == "" {
+		h.Alg = other.Alg
+	}
+	if h.Enc == "" {
+		h.Enc = other.Enc
+	}
+	if h.Apu == "" {
+		h.Apu = other.Apu
+	}
+	if h.Apv == "" {
+		h.Apv = other.Apv
+	}
+	if h.Epk == nil {
+		h.Epk = other.Epk
+	}
+}
+
+type jweRecipient struct {
+	Header       jweHeader `json:"header"`
+	EncryptedKey string    `json:"encrypted_key"`
+}
+
+// decryptJWE decrypts a JWE document in JSON serialization with the private
+// key. Keys are wrapped with RSA-OAEP, RSA-OAEP-256 or ECDH-ES+A256KW, and the
+// content encrypted with A256GCM, as ocicrypt does.
+func decryptJWE(data []byte, key crypto.PrivateKey) ([]byte, error) {
+	var doc struct {
+		Protected   string         `json:"protected"`
+		Unprotected jweHeader      `json:"unprotected"`
+		Recipients  []jweRecipient `json:"recipients"`
+		IV          string         `json:"iv"`
+		Ciphertext  string         `json:"ciphertext"`
+		Tag         string         `json:"tag"`
+		AAD         string         `json:"aad"`
+
+		// Flattened serialization, for a single recipient.
+		jweRecipient
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Recipients) == 0 {
+		doc.Recipients = []jweRecipient{doc.jweRecipient}
+	}
+
+	var protected jweHeader
+	if doc.Protected != "" {
+		data, err := base64.RawURLEncoding.DecodeString(doc.Protected)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &protected); err != nil {
+			return nil, err
+		}
+	}
+
+	iv, err := base64.RawURLEncoding.DecodeString(doc.IV)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(doc.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := base64.RawURLEncoding.DecodeString(doc.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	aad := doc.Protected
+	if doc.AAD != "" {
+		aad += "." + doc.AAD
+	}
+
+	for _, recipient := range doc.Recipients {
+		header := recipient.Header
+		header.merge(protected)
+		header.merge(doc.Unprotected)
+
+		if header.Enc != "A256GCM" {
+			return nil, fmt.Errorf("unsupported JWE content encryption %s", header.Enc)
+		}
+
+		encryptedKey, err := base64.RawURLEncoding.DecodeString(recipient.EncryptedKey)
+		if err != nil {
+			continue
+		}
+
+		cek, err := unwrapJWEKey(header, encryptedKey, key)
+		if err != nil {
+			continue
+		}
+
+		block, err := aes.NewCipher(cek)
+		if err != nil {
+			continue
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			continue
+		}
+
+		plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(aad))
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+
+	return nil, errors.New("no JWE recipient matches the key")
+}
+
+// unwrapJWEKey decrypts the content encryption key of a JWE recipient.
+func unwrapJWEKey(header jweHeader, encryptedKey []byte, key crypto.PrivateKey) ([]byte, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		switch header.Alg {
+		case "RSA-OAEP":
+			return rsa.DecryptOAEP(sha1.New(), nil, key, encryptedKey, nil)
+		case "RSA-OAEP-256":
+			return rsa.DecryptOAEP(sha256.New(), nil, key, encryptedKey, nil)
+		}
+
+	case *ecdsa.PrivateKey:
+		if header.Alg != "ECDH-ES+A256KW" || header.Epk == nil {
+			break
+		}
+
+		x, errX := base64.RawURLEncoding.DecodeString(header.Epk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(header.Epk.Y)
+		if errX != nil || errY != nil {
+			return nil, errors.New("invalid JWE ephemeral key")
+		}
+
+		curve := key.Curve
+		px, py := new(big.Int).SetBytes(x), new(big.Int).SetBytes(y)
+		if !curve.IsOnCurve(px, py) {
+			return nil, errors.New("invalid JWE ephemeral key")
+		}
+
+		zx, _ := curve.ScalarMult(px, py, key.D.Bytes())
+		shared := zx.Bytes()
+		z := append(make([]byte, (curve.Params().BitSize+7)/8-len(shared)), shared...)
+
+		apu, _ := base64.RawURLEncoding.DecodeString(header.Apu)
+		apv, _ := base64.RawURLEncoding.DecodeString(header.Apv)
+		kek := concatKDF(z, header.Alg, apu, apv, 32)
+
+		return aesKeyUnwrap(kek, encryptedKey)
+	}
+
+	return nil, fmt.Errorf("unsupported JWE key algorithm %s for %T", header.Alg, key)
+}
+
+// concatKDF derives a key of size bytes from the shared secret, as specified
+// by NIST SP 800-56A for JWA ECDH-ES.
+func concatKDF(z []byte, alg string, apu, apv []byte, size int) []byte {
+	var info bytes.Buffer
+	for _, field := range [][]byte{[]byte(alg), apu, apv} {
+		_ = binary.Write(&info, binary.BigEndian, uint32(len(field)))
+		info.Write(field)
+	}
+	_ = binary.Write(&info, binary.BigEndian, uint32(size*8))
+
+	var out []byte
+	for counter := uint32(1); len(out) < size; counter++ {
+		h := sha256.New()
+		_ = binary.Write(h, binary.BigEndian, counter)
+		h.Write(z)
+		h.Write(info.Bytes())
+		out = h.Sum(out)
+	}
+
+	return out[:size]
+}
+
+// aesKeyUnwrap unwraps a key wrapped with AES key wrap (RFC 3394).
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, errors.New("invalid wrapped key")
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/8 - 1
+	a := binary.BigEndian.Uint64(wrapped)
+	r := make([][]byte, n)
+	for i := range r {
+		r[i] = append([]byte(nil), wrapped[(i+1)*8:(i+2)*8]...)
+	}
+
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			binary.BigEndian.PutUint64(buf, a^uint64(n*j+i))
+			block.Decrypt(buf, append(buf[:8], r[i-1]...))
+			a = binary.BigEndian.Uint64(buf)
+			r[i-1] = append(r[i-1][:0], buf[8:]...)
+		}
+	}
+
+	if a != 0xa6a6a6a6a6a6a6a6 {
+		return nil, errors.New("wrapped key integrity check failed")
+	}
+
+	return bytes.Join(r, nil), nil
+}
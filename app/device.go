@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// deviceMapping is a host device exposed in the container, with the
+// permissions of the container processes on it: r to read, w to write and m
+// to create the device node.
+type deviceMapping struct {
+	hostPath      string
+	containerPath string
+	permissions   string
+}
+
+// parseDevice parses a <host path>[:<container path>][:<permissions>] value,
+// the device keeping its host path in the container and all the permissions
+// by default.
+func parseDevice(spec string) (deviceMapping, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 {
+		return deviceMapping{}, fmt.Errorf("invalid device %q, expected <host path>[:<container path>][:<permissions>]", spec)
+	}
+
+	d := deviceMapping{hostPath: parts[0], containerPath: parts[0], permissions: "rwm"}
+	switch {
+	case len(parts) == 3:
+		d.containerPath, d.permissions = parts[1], parts[2]
+	case len(parts) == 2 && validDevicePermissions(parts[1]):
+		d.permissions = parts[1]
+	case len(parts) == 2:
+		d.containerPath = parts[1]
+	}
+
+	if !filepath.IsAbs(d.hostPath) || !filepath.IsAbs(d.containerPath) {
+		return deviceMapping{}, fmt.Errorf("invalid device %q: paths must be absolute", spec)
+	}
+	if !validDevicePermissions(d.permissions) {
+		return deviceMapping{}, fmt.Errorf("invalid device %q: invalid permissions %q, expected a combination of r, w and m", spec, d.permissions)
+	}
+	d.containerPath = filepath.Clean(d.containerPath)
+
+	if _, err := d.rule(); err != nil {
+		return deviceMapping{}, err
+	}
+
+	return d, nil
+}
+
+func validDevicePermissions(permissions string) bool {
+	if permissions == "" {
+		return false
+	}
+	for _, c := range permissions {
+		if !strings.ContainsRune("rwm", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// rule returns the cgroup rule allowing the device in the container.
+func (d deviceMapping) rule() (deviceRule, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(d.hostPath, &st); err != nil {
+		return deviceRule{}, fmt.Errorf("failed to expose device %s: %w", d.hostPath, err)
+	}
+
+	var kind byte
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		kind = 'c'
+	case syscall.S_IFBLK:
+		kind = 'b'
+	default:
+		return deviceRule{}, fmt.Errorf("failed to expose device %s: not a device", d.hostPath)
+	}
+
+	major, minor := deviceMajorMinor(uint64(st.Rdev))
+	return deviceRule{kind: kind, major: major, minor: minor, access: d.permissions}, nil
+}
+
+// createDevice creates the device node in the container /dev, once mounted,
+// as the host one, which is found under the host root until detached. In a
+// user namespace, where devices cannot be created, the host one is bind
+// mounted.
+func createDevice(hostPath, containerPath string) error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(hostRoot, hostPath), &st); err != nil {
+		return fmt.Errorf("failed to expose device %s: %w", hostPath, err)
+	}
+
+	path, err := containerTarget(containerPath)
+	if err != nil {
+		return fmt.Errorf("failed to expose device %s: %w", hostPath, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// The mode given to mknod is subject to the umask.
+	err = syscall.Mknod(path, st.Mode, int(st.Rdev))
+	switch {
+	case err == nil:
+		if err = os.Chmod(path, os.FileMode(st.Mode&0777)); err == nil {
+			err = os.Chown(path, int(st.Uid), int(st.Gid))
+		}
+	case os.IsExist(err):
+		return fmt.Errorf("failed to expose device %s: %s already exists", hostPath, containerPath)
+	case errors.Is(err, syscall.EPERM):
+		var f *os.File
+		if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666); err == nil {
+			if err = f.Close(); err == nil {
+				err = syscall.Mount(filepath.Join(hostRoot, hostPath), path, "", syscall.MS_BIND, "")
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to expose device %s: %w", hostPath, err)
+	}
+
+	return nil
+}
+
+// deviceRule allows access to devices: of a kind, a for all, c for character
+// and b for block ones, with major and minor numbers, -1 for any.
+type deviceRule struct {
+	kind         byte
+	major, minor int64
+	access       string
+}
+
+// defaultDeviceRules are the devices containers can access, as with Docker:
+// the standard ones created in /dev and terminals. Device nodes of any kind
+// can be created, but not used.
+var defaultDeviceRules = []deviceRule{
+	{kind: 'c', major: -1, minor: -1, access: "m"},
+	{kind: 'b', major: -1, minor: -1, access: "m"},
+	{kind: 'c', major: 1, minor: 3, access: "rwm"},
+	{kind: 'c', major: 1, minor: 5, access: "rwm"},
+	{kind: 'c', major: 1, minor: 7, access: "rwm"},
+	{kind: 'c', major: 1, minor: 8, access: "rwm"},
+	{kind: 'c', major: 1, minor: 9, access: "rwm"},
+	{kind: 'c', major: 5, minor: 0, access: "rwm"},
+	{kind: 'c', major: 5, minor: 1, access: "rwm"},
+	{kind: 'c', major: 5, minor: 2, access: "rwm"},
+	{kind: 'c', major: 136, minor: -1, access: "rwm"},
+}
+
+// String formats the rule as written to the cgroup v1 devices.allow file.
+func (r deviceRule) String() string {
+	number := func(n int64) string {
+		if n < 0 {
+			return "*"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return fmt.Sprintf("%c %s:%s %s", r.kind, number(r.major), number(r.minor), r.access)
+}
+
+// bpfInsn is an eBPF instruction.
+type bpfInsn struct {
+	code uint8
+	regs uint8 // destination register in the low bits, source in the high ones
+	off  int16
+	imm  int32
+}
+
+// eBPF opcodes, and constants of the cgroup device programs, missing from the
+// syscall package.
+const (
+	bpfLdxMemW  = 0x61 // dst = *(u32 *)(src + off)
+	bpfAndK     = 0x54 // dst &= imm, 32-bit
+	bpfRshK     = 0x74 // dst >>= imm, 32-bit
+	bpfMovX     = 0xbc // dst = src, 32-bit
+	bpfMov64K   = 0xb7 // dst = imm
+	bpfJneK     = 0x55 // if dst != imm goto pc + off
+	bpfExit     = 0x95
+	bpfProgLoad = 5
+	bpfAttach   = 8
+
+	bpfProgTypeCgroupDevice = 15
+	bpfCgroupDevice         = 6
+	bpfAllowMulti           = 2
+
+	bpfDevcgDevBlock   = 1
+	bpfDevcgDevChar    = 2
+	bpfDevcgAccMknod   = 1
+	bpfDevcgAccRead    = 2
+	bpfDevcgAccWrite   = 4
+	bpfDevcgAccessMask = bpfDevcgAccMknod | bpfDevcgAccRead | bpfDevcgAccWrite
+)
+
+// deviceProgram returns the eBPF program of a cgroup v2 allowing access to
+// the devices of the rules only. It gets the device type, access, major and
+// minor numbers in a struct bpf_cgroup_dev_ctx, and returns 1 to allow the
+// access.
+func deviceProgram(rules []deviceRule) []bpfInsn {
+	// r2 holds the type, r3 the access, r4 the major and r5 the minor.
+	prog := []bpfInsn{
+		{code: bpfLdxMemW, regs: 2 | 1<<4, off: 0},
+		{code: bpfAndK, regs: 2, imm: 0xffff},
+		{code: bpfLdxMemW, regs: 3 | 1<<4, off: 0},
+		{code: bpfRshK, regs: 3, imm: 16},
+		{code: bpfLdxMemW, regs: 4 | 1<<4, off: 4},
+		{code: bpfLdxMemW, regs: 5 | 1<<4, off: 8},
+	}
+
+	for _, r := range rules {
+		var block []bpfInsn
+		switch r.kind {
+		case 'c':
+			block = append(block, bpfInsn{code: bpfJneK, regs: 2, imm: bpfDevcgDevChar})
+		case 'b':
+			block = append(block, bpfInsn{code: bpfJneK, regs: 2, imm: bpfDevcgDevBlock})
+		}
+
+		var access int32
+		for _, c := range r.access {
+			switch c {
+			case 'r':
+				access |= bpfDevcgAccRead
+			case 'w':
+				access |= bpfDevcgAccWrite
+			case 'm':
+				access |= bpfDevcgAccMknod
+			}
+		}
+		if access != bpfDevcgAccessMask {
+			// The access must be one of the allowed ones.
+			block = append(block,
+				bpfInsn{code: bpfMovX, regs: 1 | 3<<4},
+				bpfInsn{code: bpfAndK, regs: 1, imm: ^access & bpfDevcgAccessMask},
+				bpfInsn{code: bpfJneK, regs: 1, imm: 0},
+			)
+		}
+
+		if r.major >= 0 {
+			block = append(block, bpfInsn{code: bpfJneK, regs: 4, imm: int32(r.major)})
+		}
+		if r.minor >= 0 {
+			block = append(block, bpfInsn{code: bpfJneK, regs: 5, imm: int32(r.minor)})
+		}
+
+		// The jumps skip to the next rule.
+		block = append(block, bpfInsn{code: bpfMov64K, regs: 0, imm: 1}, bpfInsn{code: bpfExit})
+		for i := range block {
+			if block[i].code == bpfJneK {
+				block[i].off = int16(len(block) - i - 1)
+			}
+		}
+		prog = append(prog, block...)
+	}
+
+	return append(prog, bpfInsn{code: bpfMov64K, regs: 0, imm: 0}, bpfInsn{code: bpfExit})
+}
+
+// bpfProgLoadAttr and bpfAttachAttr are the parts of union bpf_attr used to
+// load and attach programs.
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+}
+
+type bpfAttachAttr struct {
+	targetFD    uint32
+	attachBpfFD uint32
+	attachType  uint32
+	attachFlags uint32
+}
+
+// limitDevices restricts the devices the processes of the cgroup v2 at dir
+// can access to the ones of the rules, with an eBPF program.
+func limitDevices(dir string, rules []deviceRule) error {
+	nr, ok := syscallNumbers["bpf"]
+	if !ok {
+		return fmt.Errorf("device rules are not supported on this architecture")
+	}
+
+	prog := deviceProgram(rules)
+	license := []byte("Apache-2.0\x00")
+	attr := bpfProgLoadAttr{
+		progType: bpfProgTypeCgroupDevice,
+		insnCnt:  uint32(len(prog)),
+		insns:    uint64(uintptr(unsafe.Pointer(&prog[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	fd, _, errno := syscall.Syscall(uintptr(nr), bpfProgLoad, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return fmt.Errorf("failed to load the device rules: %w", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	cgroupFD, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(cgroupFD)
+
+	// Programs attached to the ancestors, e.g. by systemd, apply too.
+	attach := bpfAttachAttr{targetFD: uint32(cgroupFD), attachBpfFD: uint32(fd), attachType: bpfCgroupDevice, attachFlags: bpfAllowMulti}
+	if _, _, errno := syscall.Syscall(uintptr(nr), bpfAttach, uintptr(unsafe.Pointer(&attach)), unsafe.Sizeof(attach)); errno != 0 {
+		return fmt.Errorf("failed to apply the device rules: %w", errno)
+	}
+
+	return nil
+}
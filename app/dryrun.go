@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// printPullPlan prints the manifest an image pull would resolve to, and which
+// of its layers would be downloaded or are already stored.
+func printPullPlan(s *store, ref reference) error {
+	_, manifest, err := openRepository(ref)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Image:   %s\n", ref)
+	fmt.Printf("Digest:  %s\n", manifest.digest())
+
+	return printLayers(os.Stdout, s, manifest)
+}
+
+// printRunPlan prints what running the command in a container would do: the
+// image it resolves to and the layers to download, how the root filesystem is
+// created, and how the container process is isolated and configured.
+func printRunPlan(image string, command []string, opts *runOptions, watches []bindMount) error {
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	var manifest manifestResponse
+	var source string
+	src, err := openLocalSource(image)
+	if err != nil {
+		return err
+	}
+
+	if src != nil {
+		src.close()
+		manifest = src.manifest
+		source = "no, read from " + src.description
+	} else {
+		ref, err := parseReference(image)
+		if err != nil {
+			return err
+		}
+
+		var r *registry
+		if r, manifest, err = resolveImage(s, ref, opts.pull); err != nil {
+			return err
+		}
+
+		image = ref.String()
+		source = fmt.Sprintf("no, using the local image (policy %s)", opts.pull)
+		if r != nil {
+			source = fmt.Sprintf("yes, from %s (policy %s)", r.host, opts.pull)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Image:\t%s\n", image)
+	fmt.Fprintf(w, "Digest:\t%s\n", manifest.digest())
+	fmt.Fprintf(w, "Pull:\t%s\n", source)
+
+	driver, _, err := openStorageDriver(opts.storageDriver)
+	if err != nil {
+		return err
+	}
+
+	rootfs := fmt.Sprintf("created by the %s storage driver", driver)
+	if opts.pooled {
+		if ready := len(readyContainers(poolDir(s, manifest))); ready > 0 {
+			rootfs = fmt.Sprintf("taken from the warm pool (%d ready)", ready)
+		} else {
+			rootfs += ", the warm pool being empty"
+		}
+	}
+	if opts.readOnly {
+		rootfs += ", read-only"
+	}
+	fmt.Fprintf(w, "Root filesystem:\t%s\n", rootfs)
+
+	var names []string
+	flags, err := cloneFlags(opts)
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		if flags&ns.flag != 0 {
+			names = append(names, ns.name)
+		}
+	}
+	for _, j := range namespaceJoins(opts) {
+		for _, ns := range namespaces {
+			if j.flag == ns.flag {
+				names = append(names, fmt.Sprintf("%s of %s", ns.name, j.container))
+			}
+		}
+	}
+	fmt.Fprintf(w, "Namespaces:\t%s\n", strings.Join(names, ", "))
+
+	if opts.name != "" {
+		fmt.Fprintf(w, "Name:\t%s\n", opts.name)
+	}
+	if opts.hostname != "" {
+		fmt.Fprintf(w, "Hostname:\t%s\n", opts.hostname)
+	}
+	if opts.timezone != "" {
+		fmt.Fprintf(w, "Timezone:\t%s\n", opts.timezone)
+	} else if tz := hostTimezone(); tz != "" {
+		fmt.Fprintf(w, "Timezone:\t%s (host)\n", tz)
+	}
+	env, err := containerEnv(opts)
+	if err != nil {
+		return err
+	}
+	for i, e := range env {
+		label := ""
+		if i == 0 {
+			label = "Environment:"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", label, e)
+	}
+	if opts.user != "" {
+		fmt.Fprintf(w, "User:\t%s\n", opts.user)
+	}
+	if opts.workdir != "" {
+		fmt.Fprintf(w, "Working directory:\t%s\n", opts.workdir)
+	}
+	// The configuration of images that are not pulled yet is unknown.
+	if config, err := s.config(manifest.Config.Digest); err == nil {
+		entrypoint, cmd := imageCommand(config, opts.entrypoint)
+		if command, err = commandLine(entrypoint, cmd, command); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "Command:\t%s\n", strings.Join(command, " "))
+
+	// The security options are checked as when creating the container.
+	c := &container{}
+	if c.capabilities, err = containerCapabilities(opts.capAdd, opts.capDrop); err != nil {
+		return err
+	}
+	if err := c.setSecurityOpts(opts.securityOpts); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Capabilities:\t%s\n", strings.Join(c.capabilities, ", "))
+	seccomp := c.seccomp
+	switch seccomp {
+	case "":
+		seccomp = seccompUnconfined
+	case seccompDefault:
+		seccomp = "default profile"
+	}
+	fmt.Fprintf(w, "Seccomp:\t%s\n", seccomp)
+	if c.noNewPrivileges {
+		fmt.Fprintf(w, "No new privileges:\tyes\n")
+	}
+	if opts.gpus != "" {
+		gpus, err := parseGPUs(opts.gpus)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "GPUs:\t%s\n", gpus)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := printLayers(os.Stdout, s, manifest); err != nil {
+		return err
+	}
+
+	limits, err := planLimits(opts.resources, opts.ulimits)
+	if err != nil {
+		return err
+	}
+	printTable(os.Stdout, "Limits", "LIMIT\tVALUE", limits)
+
+	var devices []string
+	for _, spec := range opts.devices {
+		d, err := parseDevice(spec)
+		if err != nil {
+			return err
+		}
+		devices = append(devices, fmt.Sprintf("%s\t%s\t%s", d.hostPath, d.containerPath, d.permissions))
+	}
+	printTable(os.Stdout, "Devices", "HOST PATH\tCONTAINER PATH\tPERMISSIONS", devices)
+
+	var mounts []string
+	for _, m := range watches {
+		mounts = append(mounts, fmt.Sprintf("%s\t%s\tbind, watched", m.hostPath, m.containerPath))
+	}
+	for _, spec := range opts.exposedSockets {
+		m, err := parseExposedSocket(spec)
+		if err != nil {
+			return err
+		}
+		mounts = append(mounts, fmt.Sprintf("%s\t%s\tbind, socket", m.hostPath, m.containerPath))
+	}
+	for _, spec := range opts.volumes {
+		m, err := parseVolume(spec)
+		if err != nil {
+			return err
+		}
+		mounts = append(mounts, planMount(m))
+	}
+	tmpfs := opts.tmpfs
+	for _, spec := range opts.mounts {
+		m, err := parseMount(spec)
+		if err != nil {
+			return err
+		}
+		if m.kind == mountTypeTmpfs {
+			tmpfs = append(tmpfs, m.tmpfs)
+			continue
+		}
+		mounts = append(mounts, planMount(m.bind))
+	}
+	if opts.readOnly {
+		for _, m := range readOnlyTmpfs {
+			mounts = append(mounts, fmt.Sprintf("tmpfs\t%s\ttmpfs", m.target))
+		}
+	}
+	for _, spec := range tmpfs {
+		m, err := parseTmpfs(spec)
+		if err != nil {
+			return err
+		}
+		mounts = append(mounts, fmt.Sprintf("tmpfs\t%s\ttmpfs", m.target))
+	}
+	printTable(os.Stdout, "Mounts", "SOURCE\tDESTINATION\tTYPE", mounts)
+
+	var listeners []string
+	inherited := inheritedListeners()
+	for i, l := range inherited {
+		listeners = append(listeners, fmt.Sprintf("%d\t%s\tinherited", listenFDsStart+i, l.name))
+	}
+	for i, spec := range opts.listen {
+		listeners = append(listeners, fmt.Sprintf("%d\t%s\topened", listenFDsStart+len(inherited)+i, spec))
+	}
+	printTable(os.Stdout, "Listeners", "FD\tADDRESS\tSOURCE", listeners)
+
+	return nil
+}
+
+// printLayers prints the layers of the image, and whether they are already
+// stored or would be downloaded.
+func printLayers(out io.Writer, s *store, manifest manifestResponse) error {
+	var rows []string
+	var download int64
+	for _, l := range manifest.Layers {
+		status := "cached"
+		if !s.hasBlob(l.Digest) {
+			status = "download"
+			download += l.Size
+		}
+		rows = append(rows, fmt.Sprintf("%s\t%s\t%s", l.Digest, formatBytes(l.Size), status))
+	}
+
+	printTable(out, "Layers", "DIGEST\tSIZE\tSTATUS", rows)
+	_, err := fmt.Fprintf(out, "\nTo download: %s\n", formatBytes(download))
+	return err
+}
+
+// planLimits returns the rows of the resource limits and ulimits in the
+// limits table.
+func planLimits(r resources, ulimits []string) ([]string, error) {
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+
+	var rows []string
+	add := func(name string, value interface{}) {
+		rows = append(rows, fmt.Sprintf("%s\t%v", name, value))
+	}
+	if r.memory > 0 {
+		add("memory", formatBytes(int64(r.memory)))
+	}
+	if r.memoryHigh > 0 {
+		add("memory high", formatBytes(int64(r.memoryHigh)))
+	}
+	switch {
+	case r.memorySwap < 0:
+		add("memory and swap", "unlimited")
+	case r.memorySwap > 0:
+		add("memory and swap", formatBytes(int64(r.memorySwap)))
+	}
+	if r.memorySwappiness >= 0 {
+		add("memory swappiness", r.memorySwappiness)
+	}
+	if quota, period, ok := r.cfsQuota(); ok && quota > 0 {
+		add("CPUs", fmt.Sprintf("%.2f (%dus every %dus)", float64(quota)/float64(period), quota, period))
+	}
+	if r.cpuShares > 0 {
+		add("CPU shares", r.cpuShares)
+	}
+	if r.cpusetCPUs != "" {
+		add("CPU set", r.cpusetCPUs)
+	}
+	if r.cpusetMems != "" {
+		add("memory nodes", r.cpusetMems)
+	}
+	if r.pidsLimit > 0 {
+		add("processes", r.pidsLimit)
+	}
+	if r.blkioWeight > 0 {
+		add("block I/O weight", r.blkioWeight)
+	}
+
+	rates, err := r.deviceRates()
+	if err != nil {
+		return nil, err
+	}
+	for _, rate := range rates {
+		name := "reads of " + rate.device
+		if rate.write {
+			name = "writes to " + rate.device
+		}
+		add(name, formatBytes(rate.rate)+"/s")
+	}
+
+	for _, spec := range ulimits {
+		if _, err := parseUlimit(spec); err != nil {
+			return nil, err
+		}
+		add("ulimit", spec)
+	}
+
+	return rows, nil
+}
+
+// planMount returns the row of the bind mount in the mounts table.
+func planMount(m bindMount) string {
+	source, kind := m.hostPath, "bind"
+	if m.volume != "" {
+		source, kind = m.volume, "volume"
+	}
+	if m.readOnly {
+		kind += ", read-only"
+	}
+	if m.propagation != "" {
+		kind += ", " + m.propagation
+	}
+	if m.noCopy {
+		kind += ", nocopy"
+	}
+	return fmt.Sprintf("%s\t%s\t%s", source, m.containerPath, kind)
+}
+
+// printTable prints a titled section of tab separated rows, omitted when
+// there are no rows.
+func printTable(out io.Writer, title, header string, rows []string) {
+	if len(rows) == 0 {
+		return
+	}
+
+	fmt.Fprintf(out, "\n%s:\n", title)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "  %s\n", header)
+	for _, row := range rows {
+		fmt.Fprintf(w, "  %s\n", row)
+	}
+	_ = w.Flush()
+}
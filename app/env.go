@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// containerEnv returns the environment variables the options set, the ones of
+// the env files then the -e ones.
+func containerEnv(opts *runOptions) ([]string, error) {
+	var specs []string
+	for _, path := range opts.envFiles {
+		fileSpecs, err := readEnvFile(path)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, fileSpecs...)
+	}
+
+	return parseEnv(append(specs, opts.env...))
+}
+
+// parseEnv returns the environment variables of -e values, <name>=<value> to
+// set a variable, or <name> to pass the host one through, skipped when unset.
+func parseEnv(specs []string) ([]string, error) {
+	var env []string
+	for _, spec := range specs {
+		name := spec
+		if i := strings.Index(spec, "="); i >= 0 {
+			name = spec[:i]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("invalid environment variable %q", spec)
+		}
+
+		if name != spec {
+			env = append(env, spec)
+		} else if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+
+	return env, nil
+}
+
+// mergeEnv sets the variables of vars in env, replacing the ones of the same
+// name.
+func mergeEnv(env, vars []string) []string {
+	env = append([]string{}, env...)
+	for _, v := range vars {
+		name := v[:strings.Index(v, "=")+1]
+
+		replaced := false
+		for i, e := range env {
+			if strings.HasPrefix(e, name) {
+				env[i], replaced = v, true
+			}
+		}
+		if !replaced {
+			env = append(env, v)
+		}
+	}
+
+	return env
+}
+
+// readEnvFile returns the variables of an env file as -e values, one per line,
+// ignoring blank lines and comments starting with #. Double quoted values are
+// unquoted with Go escape sequences, and single quoted ones taken literally.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var specs []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value := line, ""
+		i := strings.Index(line, "=")
+		if i >= 0 {
+			name, value = line[:i], line[i+1:]
+		}
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("%s:%d: invalid variable name %q", path, n, name)
+		}
+		if i < 0 {
+			specs = append(specs, name)
+			continue
+		}
+
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid quoted value of %s", path, n, name)
+			}
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		}
+		specs = append(specs, name+"="+value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return specs, nil
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Whiteout files mark the paths of lower layers a layer deletes. An opaque
+// whiteout in a directory hides all the content lower layers put in it.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// paxXattrPrefix prefixes the PAX records holding extended attributes.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// whiteoutFormat is how whiteouts are extracted.
+type whiteoutFormat int
+
+const (
+	// applyWhiteouts removes the lower files from the root filesystem.
+	applyWhiteouts whiteoutFormat = iota
+	// overlayWhiteouts converts whiteouts to the overlayfs format.
+	overlayWhiteouts
+	// keepWhiteouts extracts whiteouts as the regular files they are in
+	// the layer, which fuse-overlayfs understands.
+	keepWhiteouts
+)
+
+// applyLayer extracts the uncompressed layer tar stream on top of the root
+// filesystem extracted from the lower layers. Entries are resolved with
+// resolvePath, so that they cannot be written outside rootDir.
+//
+// Unless whiteouts are applied, rootDir holds the layer alone, to be used as
+// an overlay lower directory.
+func applyLayer(r io.Reader, rootDir string, whiteouts whiteoutFormat) error {
+	// Paths extracted from this layer, kept by opaque whiteouts.
+	extracted := map[string]bool{}
+	// Hard links whose target comes later in the archive.
+	var links []*tar.Header
+	// Directories, whose times are set once their content is extracted.
+	var dirs []*tar.Header
+	dirPaths := map[*tar.Header]string{}
+	// Ownership is only preserved when allowed to change it.
+	own := &ownership{disabled: os.Geteuid() != 0}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// Long names and PAX records are handled by the tar reader, and
+		// global PAX headers apply to no file.
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		path, err := resolvePath(rootDir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if path == rootDir {
+			if hdr.Typeflag == tar.TypeDir {
+				dirs = append(dirs, hdr)
+				dirPaths[hdr] = path
+			}
+			continue
+		}
+
+		dir, base := filepath.Split(path)
+		var whiteout string
+		if strings.HasPrefix(base, whiteoutPrefix) && base != whiteoutOpaque {
+			if whiteout, err = whiteoutTarget(rootDir, hdr.Name); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case whiteouts == keepWhiteouts:
+
+		case whiteouts == overlayWhiteouts && strings.HasPrefix(base, whiteoutPrefix):
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			if err := overlayWhiteout(dir, base); err != nil {
+				return fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+			continue
+
+		case base == whiteoutOpaque:
+			if err := removeLowerContent(filepath.Clean(dir), extracted); err != nil {
+				return err
+			}
+			continue
+
+		case whiteout != "":
+			if err := os.RemoveAll(whiteout); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse, tar.TypeSymlink, tar.TypeLink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		default:
+			fmt.Fprintf(os.Stderr, "%s: skipping unsupported tar entry type %q\n", hdr.Name, hdr.Typeflag)
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeLink {
+			target, err := resolvePath(rootDir, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if _, err := os.Lstat(target); os.IsNotExist(err) {
+				links = append(links, hdr)
+				continue
+			}
+		}
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		if err := extractEntry(tr, hdr, rootDir, path); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		extracted[path] = true
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			dirs = append(dirs, hdr)
+			dirPaths[hdr] = path
+		case tar.TypeLink:
+		default:
+			if err := setMetadata(hdr, path, own); err != nil {
+				return fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+		}
+	}
+
+	for _, hdr := range links {
+		path, err := resolvePath(rootDir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		if err := extractEntry(tr, hdr, rootDir, path); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setMetadata(dirs[i], dirPaths[dirs[i]], own); err != nil {
+			return fmt.Errorf("%s: %w", dirs[i].Name, err)
+		}
+	}
+
+	return nil
+}
+
+// whiteoutTarget returns the path of the file the whiteout named name removes,
+// within rootDir. Whiteouts must name a file of their directory.
+func whiteoutTarget(rootDir, name string) (string, error) {
+	dir, base := filepath.Split(name)
+	target := strings.TrimPrefix(base, whiteoutPrefix)
+	if target == "" || target == "." || target == ".." || strings.Contains(target, "/") {
+		return "", fmt.Errorf("%s: invalid whiteout", name)
+	}
+
+	path, err := resolvePath(rootDir, filepath.Join(dir, target))
+	if err != nil {
+		return "", err
+	}
+	if path == rootDir {
+		return "", fmt.Errorf("%s: invalid whiteout", name)
+	}
+
+	return path, nil
+}
+
+// maxSymlinks bounds the symlinks followed when resolving a path, as the
+// kernel does.
+const maxSymlinks = 40
+
+// resolvePath returns the host path of name in the root filesystem. Symlinks
+// in its parent directories are followed as if rootDir was the root
+// directory, absolute targets included, while the last component is left
+// unresolved. Names and symlink chains leading outside rootDir through ".."
+// are refused.
+func resolvePath(rootDir, name string) (string, error) {
+	rel := filepath.Clean(strings.TrimLeft(name, "/"))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s: path escapes the root filesystem", name)
+	}
+	if rel == "." {
+		return rootDir, nil
+	}
+
+	pending := strings.Split(filepath.Dir(rel), "/")
+	var resolved []string
+	links := 0
+	for len(pending) > 0 {
+		component := pending[0]
+		pending = pending[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", fmt.Errorf("%s: symlinks lead outside the root filesystem", name)
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		path := filepath.Join(rootDir, filepath.Join(resolved...), component)
+		info, err := os.Lstat(path)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, component)
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", name)
+		}
+
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = nil
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+
+	return filepath.Join(rootDir, filepath.Join(resolved...), filepath.Base(rel)), nil
+}
+
+// resolveTarget returns the host path of name in the root filesystem as
+// resolvePath does, following the last component as well when it is a
+// symlink, for paths written to or mounted over.
+func resolveTarget(rootDir, name string) (string, error) {
+	path, err := resolvePath(rootDir, name)
+	for links := 0; err == nil; links++ {
+		info, statErr := os.Lstat(path)
+		if statErr != nil || info.Mode()&os.ModeSymlink == 0 {
+			break
+		}
+		if links == maxSymlinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", name)
+		}
+
+		target, linkErr := os.Readlink(path)
+		if linkErr != nil {
+			return "", linkErr
+		}
+		if !filepath.IsAbs(target) {
+			dir, relErr := filepath.Rel(rootDir, filepath.Dir(path))
+			if relErr != nil {
+				return "", relErr
+			}
+			target = filepath.Join("/", dir, target)
+		}
+		path, err = resolvePath(rootDir, target)
+	}
+
+	return path, err
+}
+
+// extractEntry creates the file of the tar header at path, replacing what
+// lower layers put there, unless both are directories. Its metadata is set
+// by setMetadata.
+func extractEntry(tr *tar.Reader, hdr *tar.Header, rootDir, path string) error {
+	info, err := os.Lstat(path)
+	if err == nil && !(info.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	mode := os.FileMode(hdr.Mode).Perm()
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, mode); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return nil
+
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if err != nil {
+			return err
+		}
+
+		if isSparse(hdr) {
+			err = writeSparse(f, tr)
+		} else {
+			_, err = io.Copy(f, tr)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+
+	case tar.TypeSymlink:
+		return os.Symlink(hdr.Linkname, path)
+
+	case tar.TypeLink:
+		target, err := resolvePath(rootDir, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		return os.Link(target, path)
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		fileType := map[byte]uint32{
+			tar.TypeChar:  syscall.S_IFCHR,
+			tar.TypeBlock: syscall.S_IFBLK,
+			tar.TypeFifo:  syscall.S_IFIFO,
+		}[hdr.Typeflag]
+
+		return syscall.Mknod(path, fileType|uint32(mode), deviceNumber(hdr.Devmajor, hdr.Devminor))
+
+	default:
+		return fmt.Errorf("unsupported tar entry type %q", hdr.Typeflag)
+	}
+}
+
+// isSparse reports whether the tar entry is a GNU sparse file, in the old GNU
+// format or with GNU.sparse PAX records.
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sparseBlockSize is the size of the runs of zeros left as holes in sparse
+// files.
+const sparseBlockSize = 4096
+
+// writeSparse writes the content of a sparse file entry to f, leaving holes
+// instead of writing blocks of zeros. The tar reader hands out the holes as
+// zeros rather than exposing the sparse map, so they are found again here.
+func writeSparse(f *os.File, r io.Reader) error {
+	zeros := make([]byte, sparseBlockSize)
+	buf := make([]byte, 32*sparseBlockSize)
+
+	var size int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		for _, block := range splitBlocks(buf[:n], sparseBlockSize) {
+			if bytes.Equal(block, zeros[:len(block)]) {
+				if _, err := f.Seek(int64(len(block)), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := f.Write(block); err != nil {
+				return err
+			}
+			size += int64(len(block))
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	// Seeking past the end does not extend the file when it ends in a hole.
+	return f.Truncate(size)
+}
+
+// splitBlocks splits b in blocks of the given size, the last one possibly
+// shorter.
+func splitBlocks(b []byte, size int) [][]byte {
+	var blocks [][]byte
+	for len(b) > size {
+		blocks = append(blocks, b[:size])
+		b = b[size:]
+	}
+	if len(b) > 0 {
+		blocks = append(blocks, b)
+	}
+
+	return blocks
+}
+
+// ownership tracks how file ownership is preserved while extracting a layer.
+type ownership struct {
+	// disabled is set without the privileges to change ownership.
+	disabled bool
+	// unmapped is set once a file owner missing from the user namespace has
+	// been reported.
+	unmapped bool
+}
+
+// setMetadata sets the ownership, mode, extended attributes and the access
+// and modification times recorded in the tar header on the extracted file,
+// without following symlinks.
+//
+// Without the privileges to change ownership, files are left owned by the
+// current user and chown is turned off. In a user namespace, e.g. rootless,
+// files owned by users outside of the mapped ranges are owned by root
+// instead. Extended attributes that cannot be set, such as
+// security.capability, are skipped with a warning.
+func setMetadata(hdr *tar.Header, path string, own *ownership) error {
+	// Changing the owner clears the setuid and setgid bits, and the
+	// security.capability attribute, so it comes first.
+	if !own.disabled {
+		err := os.Lchown(path, hdr.Uid, hdr.Gid)
+		if errors.Is(err, syscall.EINVAL) {
+			if !own.unmapped {
+				fmt.Fprintf(os.Stderr, "%s: owner %d:%d is not mapped in the user namespace, such files will be owned by root\n", hdr.Name, hdr.Uid, hdr.Gid)
+				own.unmapped = true
+			}
+			err = os.Lchown(path, 0, 0)
+		}
+
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) {
+			fmt.Fprintf(os.Stderr, "cannot preserve file ownership, files will be owned by the current user: %s\n", err)
+			own.disabled = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	// Check the file type on disk rather than in the header, so that a
+	// symlink replacing a directory in the same layer is not followed.
+	if info, err := os.Lstat(path); err != nil {
+		return err
+	} else if info.Mode()&os.ModeSymlink == 0 {
+		mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range hdr.PAXRecords {
+		name := strings.TrimPrefix(key, paxXattrPrefix)
+		if name == key {
+			continue
+		}
+
+		if err := lsetxattr(path, name, []byte(value)); errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EPERM) {
+			fmt.Fprintf(os.Stderr, "%s: cannot set extended attribute %s: %s\n", hdr.Name, name, err)
+		} else if err != nil {
+			return fmt.Errorf("setting extended attribute %s: %w", name, err)
+		}
+	}
+
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+
+	return lutimes(path, atime, hdr.ModTime)
+}
+
+func lsetxattr(path, name string, value []byte) error {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	namePtr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+
+	var valuePtr unsafe.Pointer
+	if len(value) > 0 {
+		valuePtr = unsafe.Pointer(&value[0])
+	}
+
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(namePtr)), uintptr(valuePtr), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Arguments of utimensat missing from the syscall package.
+const (
+	atFDCWD           = -0x64
+	atSymlinkNoFollow = 0x100
+)
+
+func lutimes(path string, atime, mtime time.Time) error {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	dirfd := atFDCWD
+	ts := []syscall.Timespec{syscall.NsecToTimespec(atime.UnixNano()), syscall.NsecToTimespec(mtime.UnixNano())}
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(&ts[0])), atSymlinkNoFollow, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// deviceNumber encodes the device major and minor numbers as the Linux dev_t.
+func deviceNumber(major, minor int64) int {
+	return int((major&0xfff)<<8 | (major&^0xfff)<<32 | minor&0xff | (minor&^0xff)<<12)
+}
+
+// deviceMajorMinor splits a Linux device number into its major and minor
+// numbers.
+func deviceMajorMinor(dev uint64) (int64, int64) {
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	return int64(major), int64(minor)
+}
+
+// removeLowerContent removes the content of the directory that was not
+// extracted from the current layer, as required by an opaque whiteout.
+func removeLowerContent(dir string, extracted map[string]bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if path == dir || extracted[path] {
+			return nil
+		}
+
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
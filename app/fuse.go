@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// fuseOverlayDriver mounts the root filesystem of containers as an overlay
+// with fuse-overlayfs, for rootless containers on kernels not allowing
+// unprivileged overlayfs mounts. Layers are unpacked once in the store with
+// their whiteout files, as fuse-overlayfs understands them and unprivileged
+// users cannot create overlayfs whiteouts.
+type fuseOverlayDriver struct{}
+
+func (fuseOverlayDriver) unpack(s *store, l layer, dir string) error {
+	return s.unpackLayer(l, keepWhiteouts)
+}
+
+func (fuseOverlayDriver) mount(s *store, manifest manifestResponse, dir, label string) (string, func(), error) {
+	return mountOverlay(s, manifest, dir, label, keepWhiteouts, func(rootDir, options string) error {
+		out, err := exec.Command("fuse-overlayfs", "-o", options, rootDir).CombinedOutput()
+		if msg := strings.TrimSpace(string(out)); err != nil && msg != "" {
+			return fmt.Errorf("fuse-overlayfs: %w: %s", err, msg)
+		}
+		return err
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// gpusAll exposes all the GPUs of the host.
+const gpusAll = "all"
+
+// parseGPUs parses the GPUs to expose, as with Docker: all of them, a number
+// of them, or a device=<index or UUID>[,...] list. It returns them in the
+// format of nvidia-container-cli.
+func parseGPUs(spec string) (string, error) {
+	if spec == gpusAll {
+		return gpusAll, nil
+	}
+
+	if strings.HasPrefix(spec, "device=") {
+		devices := strings.TrimPrefix(spec, "device=")
+		if devices == "" {
+			return "", fmt.Errorf("invalid GPUs %q, expected device=<index or UUID>[,...]", spec)
+		}
+		return devices, nil
+	}
+
+	count, err := strconv.Atoi(spec)
+	if err != nil || count < 1 {
+		return "", fmt.Errorf("invalid GPUs %q, expected %s, a number of GPUs or device=<index or UUID>[,...]", spec, gpusAll)
+	}
+	indexes := make([]string, count)
+	for i := range indexes {
+		indexes[i] = strconv.Itoa(i)
+	}
+	return strings.Join(indexes, ","), nil
+}
+
+// nvidiaContainerCLI is the program of the NVIDIA Container Toolkit setting up
+// GPUs in containers.
+const nvidiaContainerCLI = "nvidia-container-cli"
+
+// configureGPUs exposes the GPUs in the container of the process pid, whose
+// root filesystem is still mounted at rootDir, with nvidia-container-cli: it
+// creates the GPU devices and mounts the driver libraries and programs. The
+// device rules of the container cgroup are set beforehand, with
+// gpuDeviceRules.
+func configureGPUs(pid int, rootDir, devices string) error {
+	var args []string
+	if rootless() {
+		args = append(args, "--user")
+	} else {
+		args = append(args, "--load-kmods")
+	}
+
+	ldconfig := "@/sbin/ldconfig"
+	if _, err := os.Stat("/sbin/ldconfig.real"); err == nil {
+		ldconfig = "@/sbin/ldconfig.real"
+	}
+	args = append(args, "configure", "--no-cgroups", "--ldconfig="+ldconfig, "--device="+devices,
+		"--compute", "--utility", "--pid="+strconv.Itoa(pid), rootDir)
+
+	out, err := exec.Command(nvidiaContainerCLI, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to expose the GPUs: %s: %w: %s", nvidiaContainerCLI, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// gpuDeviceRules returns the cgroup rules allowing the NVIDIA devices, whose
+// major numbers are listed in /proc/devices, some being allocated when the
+// driver loads.
+func gpuDeviceRules() ([]deviceRule, error) {
+	f, err := os.Open("/proc/devices")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []deviceRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Block devices:") {
+			break
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "nvidia") {
+			continue
+		}
+		major, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		rules = append(rules, deviceRule{kind: 'c', major: major, minor: -1, access: "rwm"})
+	}
+
+	return rules, scanner.Err()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const shortIDLength = 12
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// idGenerator generates container identifiers.
+type idGenerator interface {
+	generate() (string, error)
+}
+
+// randomIDGenerator generates 64 hexadecimal characters IDs, as Docker does.
+type randomIDGenerator struct{}
+
+func (randomIDGenerator) generate() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// identities hands out container IDs and names. Each identity is reserved by
+// exclusively creating a file named after it, under a lock, so concurrent
+// invocations can never claim the same one. Reservation files record the ID
+// and the PID of the owning process, so that reservations left by dead
+// processes are reclaimed.
+type identities struct {
+	dir string
+	gen idGenerator
+}
+
+func openIdentities() (*identities, error) {
+	ids := &identities{
+		dir: filepath.Join(dataRoot, "identities"),
+		gen: randomIDGenerator{},
+	}
+
+	for _, sub := range []string{"ids", "names", "pids"} {
+		if err := os.MkdirAll(filepath.Join(ids.dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	return ids, nil
+}
+
+// newID generates and reserves an ID whose short form is unique.
+func (ids *identities) newID() (string, error) {
+	for {
+		id, err := ids.gen.generate()
+		if err != nil {
+			return "", err
+		}
+
+		err = ids.claim(ids.idPath(id), id)
+		if err == nil {
+			return id, nil
+		} else if !os.IsExist(err) {
+			return "", err
+		}
+	}
+}
+
+// releaseID releases an ID reserved by newID.
+func (ids *identities) releaseID(id string) {
+	ids.release(ids.idPath(id), id)
+}
+
+// claimName reserves the name for the given ID.
+func (ids *identities) claimName(name, id string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid container name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+
+	err := ids.claim(filepath.Join(ids.dir, "names", name), id)
+	if os.IsExist(err) {
+		return fmt.Errorf("the container name %q is already in use", name)
+	}
+
+	return err
+}
+
+// releaseName releases the name, if reserved for the given ID.
+func (ids *identities) releaseName(name, id string) {
+	ids.release(filepath.Join(ids.dir, "names", name), id)
+}
+
+// lookup resolves a container name, ID or ID prefix to a full ID.
+func (ids *identities) lookup(nameOrID string) (string, error) {
+	if id, pid, err := readReservation(filepath.Join(ids.dir, "names", nameOrID)); err == nil && processAlive(pid) {
+		return id, nil
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(ids.dir, "ids"))
+	if err != nil {
+		return "", err
+	}
+
+	var found []string
+	for _, f := range files {
+		id, pid, err := readReservation(filepath.Join(ids.dir, "ids", f.Name()))
+		if err == nil && processAlive(pid) && nameOrID != "" && strings.HasPrefix(id, nameOrID) {
+			found = append(found, id)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no such container: %s", nameOrID)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("multiple containers match %q", nameOrID)
+	}
+}
+
+// nameOf returns the name reserved for the ID, if any.
+func (ids *identities) nameOf(id string) string {
+	files, err := ioutil.ReadDir(filepath.Join(ids.dir, "names"))
+	if err != nil {
+		return ""
+	}
+
+	for _, f := range files {
+		if owner, _, err := readReservation(filepath.Join(ids.dir, "names", f.Name())); err == nil && owner == id {
+			return f.Name()
+		}
+	}
+
+	return ""
+}
+
+// setPID records the PID of the process of the container with the ID, so
+// that other containers can join its namespaces.
+func (ids *identities) setPID(id string, pid int) error {
+	path := filepath.Join(ids.dir, "pids", shortID(id))
+	if err := ioutil.WriteFile(path+".tmp", []byte(fmt.Sprintf("%s %d\n", id, pid)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// containerPID returns the PID of the process of the running container with
+// the ID.
+func (ids *identities) containerPID(id string) (int, error) {
+	owner, pid, err := readReservation(filepath.Join(ids.dir, "pids", shortID(id)))
+	if err != nil || owner != id || !processAlive(pid) {
+		return 0, fmt.Errorf("container %s is not running", shortID(id))
+	}
+	return pid, nil
+}
+
+// releasePID removes the PID recorded for the container with the ID.
+func (ids *identities) releasePID(id string) {
+	ids.release(filepath.Join(ids.dir, "pids", shortID(id)), id)
+}
+
+// idPath returns the reservation file of an ID, named after its short form.
+func (ids *identities) idPath(id string) string {
+	return filepath.Join(ids.dir, "ids", shortID(id))
+}
+
+func (ids *identities) claim(path, id string) error {
+	unlock, err := lockFile(filepath.Join(ids.dir, "lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Reclaim the reservation of a dead process.
+	if _, pid, err := readReservation(path); err == nil && !processAlive(pid) {
+		_ = os.Remove(path)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%s %d\n", id, os.Getpid())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+	}
+
+	return err
+}
+
+func (ids *identities) release(path, id string) {
+	if owner, _, err := readReservation(path); err == nil && owner == id {
+		_ = os.Remove(path)
+	}
+}
+
+func readReservation(path string) (string, int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return "", 0, fmt.Errorf("invalid reservation %s", path)
+	}
+
+	pid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid reservation %s", path)
+	}
+
+	return fields[0], pid, nil
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// shortID returns the short form of an ID.
+func shortID(id string) string {
+	if len(id) > shortIDLength {
+		return id[:shortIDLength]
+	}
+
+	return id
+}
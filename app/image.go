@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// addStoreFlags registers the flags configuring the local image store.
+func addStoreFlags(fs *flag.FlagSet) {
+	fs.StringVar(&dataRoot, "data-root", dataRoot, "directory holding the local image store")
+}
+
+// Pull policies, deciding whether images are pulled before running them.
+const (
+	pullAlways  = "always"
+	pullMissing = "missing"
+	pullNever   = "never"
+)
+
+// Usage: your_docker.sh pull [options] <image>
+func pullCmd(argv []string) error {
+	pullFlags := newFlagSet("pull", "[options] <image>")
+	addStoreFlags(pullFlags)
+	addRegistryFlags(pullFlags)
+	dryRun := pullFlags.Bool("dry-run", false, "print the layers that would be downloaded, without pulling them")
+	_ = pullFlags.Parse(argv)
+
+	if pullFlags.NArg() != 1 {
+		pullFlags.Usage()
+		os.Exit(2)
+	}
+
+	ref, err := parseReference(pullFlags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		if err := printPullPlan(s, ref); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	manifest, err := pullImage(s, ref)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Digest: %s\n", manifest.digest())
+	fmt.Printf("Status: Downloaded image for %s\n", ref)
+
+	return nil
+}
+
+// pullImage pulls the image into the store, and returns its manifest.
+func pullImage(s *store, ref reference) (manifestResponse, error) {
+	client, manifest, err := openRepository(ref)
+	if err != nil {
+		return manifestResponse{}, err
+	}
+
+	if err := s.pullImage(client, manifest, nil); err != nil {
+		return manifestResponse{}, err
+	}
+
+	return manifest, nil
+}
+
+// ensureImage returns the manifest of the image, pulling it according to the
+// pull policy.
+func ensureImage(s *store, ref reference, policy string) (manifestResponse, error) {
+	r, manifest, err := resolveImage(s, ref, policy)
+	if err != nil {
+		return manifestResponse{}, err
+	}
+
+	if r != nil {
+		if err := s.pullImage(r, manifest, nil); err != nil {
+			return manifestResponse{}, err
+		}
+	}
+
+	return manifest, nil
+}
+
+// resolveImage returns the manifest of the image according to the pull
+// policy, without pulling it. The registry is returned when the image must be
+// pulled, and is nil when the local image is used.
+func resolveImage(s *store, ref reference, policy string) (*registry, manifestResponse, error) {
+	switch policy {
+	case pullAlways:
+		return openRepository(ref)
+	case pullMissing, pullNever:
+	default:
+		return nil, manifestResponse{}, fmt.Errorf("invalid pull policy %q", policy)
+	}
+
+	manifest, err := s.localImage(ref)
+	if err == nil {
+		return nil, manifest, nil
+	}
+
+	if policy == pullNever {
+		return nil, manifestResponse{}, fmt.Errorf("image %s not found locally: %w", ref, err)
+	}
+
+	return openRepository(ref)
+}
+
+// Usage: your_docker.sh image <command> [options] <args>...
+func imageCmd(argv []string) error {
+	return dispatch("image", []command{
+		{"verify", "Verify the blobs of the local images", imageVerifyCmd},
+	}, argv)
+}
+
+// Usage: your_docker.sh image verify [--repull] [options]
+func imageVerifyCmd(argv []string) error {
+	verifyFlags := newFlagSet("image verify", "[--repull] [options]")
+	addStoreFlags(verifyFlags)
+	addRegistryFlags(verifyFlags)
+	addDecryptionFlags(verifyFlags)
+	repull := verifyFlags.Bool("repull", false, "download corrupted or missing blobs again")
+	_ = verifyFlags.Parse(argv)
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	corrupted, err := verifyImages(s, *repull)
+	if err != nil {
+		return err
+	}
+
+	if corrupted > 0 {
+		fmt.Printf("%d corrupted blobs\n", corrupted)
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+// blobCheck verifies blobs of the store, remembering the result of each blob
+// as they are shared between images.
+type blobCheck struct {
+	store   *store
+	checked map[string]error
+}
+
+// verify checks the stored blob matches its digest and, when diffID is not
+// empty, that its uncompressed content matches diffID. The content of
+// encrypted layers is only checked when decryption keys are given.
+func (c *blobCheck) verify(blob layer, diffID string) error {
+	if isEncrypted(blob) && len(decryptionKeys) == 0 {
+		diffID = ""
+	}
+
+	key := blob.Digest + " " + diffID
+	if err, ok := c.checked[key]; ok {
+		return err
+	}
+
+	actual, err := hashFile(c.store.blobPath(blob.Digest))
+	if err == nil && actual != blob.Digest {
+		err = fmt.Errorf("digest mismatch: got %s", actual)
+	}
+
+	if err == nil && diffID != "" {
+		actual, err = layerDiffID(c.store.blobPath(blob.Digest), blob)
+		if err == nil && actual != diffID {
+			err = fmt.Errorf("diff ID mismatch: expected %s, got %s", diffID, actual)
+		}
+	}
+
+	c.checked[key] = err
+	return err
+}
+
+// forget drops the results of the given blob, once downloaded again.
+func (c *blobCheck) forget(digest string) {
+	for key := range c.checked {
+		if strings.HasPrefix(key, digest+" ") {
+			delete(c.checked, key)
+		}
+	}
+}
+
+// verifyImages checks the manifest, config and layers of every stored image,
+// reporting corrupted or missing blobs. With repull, they are downloaded again
+// from the registry of the image, once for the images sharing them. It
+// returns the number of blobs still corrupted.
+func verifyImages(s *store, repull bool) (int, error) {
+	images, err := s.images()
+	if err != nil {
+		return 0, err
+	}
+
+	names := make([]string, 0, len(images))
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	check := &blobCheck{store: s, checked: map[string]error{}}
+	corrupted := map[string]bool{}
+	repaired := map[string]bool{}
+
+	for _, name := range names {
+		ref, err := parseReference(name)
+		if err != nil {
+			return len(corrupted), err
+		}
+
+		var client *registry
+		repair := func(digest string, cause error) bool {
+			fmt.Printf("%s: %s: %s\n", name, digest, cause)
+			if ok, done := repaired[digest]; done || !repull {
+				if !ok {
+					corrupted[digest] = true
+				}
+				return ok
+			}
+
+			if client == nil {
+				if client, err = registryLogin(ref); err != nil {
+					fmt.Printf("%s: %s: re-pull failed: %s\n", name, digest, err)
+					corrupted[digest] = true
+					return false
+				}
+			}
+
+			_ = os.Remove(s.blobPath(digest))
+			if err := s.repull(client, digest, digest == images[name]); err != nil {
+				fmt.Printf("%s: %s: re-pull failed: %s\n", name, digest, err)
+				corrupted[digest], repaired[digest] = true, false
+				return false
+			}
+
+			check.forget(digest)
+			repaired[digest] = true
+			fmt.Printf("%s: %s: re-pulled\n", name, digest)
+			return true
+		}
+
+		ok := true
+		manifestDigest := images[name]
+		if err := check.verify(layer{Digest: manifestDigest}, ""); err != nil && !repair(manifestDigest, err) {
+			continue
+		}
+
+		manifest, err := s.manifest(manifestDigest)
+		if err != nil {
+			fmt.Printf("%s: %s: %s\n", name, manifestDigest, err)
+			corrupted[manifestDigest] = true
+			continue
+		}
+
+		if err := check.verify(manifest.Config, ""); err != nil && !repair(manifest.Config.Digest, err) {
+			continue
+		}
+
+		config, err := s.config(manifest.Config.Digest)
+		if err != nil {
+			fmt.Printf("%s: %s: %s\n", name, manifest.Config.Digest, err)
+			corrupted[manifest.Config.Digest] = true
+			continue
+		}
+
+		for i, l := range manifest.Layers {
+			var diffID string
+			if i < len(config.RootFS.DiffIDs) {
+				diffID = config.RootFS.DiffIDs[i]
+			}
+
+			err := check.verify(l, diffID)
+			if err != nil && repair(l.Digest, err) {
+				if err = check.verify(l, diffID); err != nil {
+					fmt.Printf("%s: %s: %s\n", name, l.Digest, err)
+					corrupted[l.Digest] = true
+				}
+			}
+			if err != nil {
+				ok = false
+			}
+		}
+
+		if ok {
+			fmt.Printf("%s: OK\n", name)
+		}
+	}
+
+	return len(corrupted), nil
+}
+
+// repull downloads the given blob again. Manifests are not served as blobs
+// by registries, and must be fetched by digest instead.
+func (s *store) repull(r *registry, digest string, isManifest bool) error {
+	if !isManifest {
+		return s.fetchBlob(r, digest, nil)
+	}
+
+	pinned := *r
+	pinned.ref.digest = digest
+	raw, _, err := pinned.fetchRawManifest(mediaTypeDockerManifest, mediaTypeOCIManifest, mediaTypeDockerManifestList, mediaTypeOCIIndex)
+	if err != nil {
+		return err
+	}
+
+	if actual := fmt.Sprintf("sha256:%x", sha256.Sum256(raw)); actual != digest {
+		return fmt.Errorf("digest mismatch: got %s", actual)
+	}
+	_, err = s.putBlob(raw)
+	return err
+}
+
+// layerDiffID returns the digest of the uncompressed content of a layer.
+func layerDiffID(path string, l layer) (string, error) {
+	r, err := openLayer(path, l)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"time"
+)
+
+// Usage: your_docker.sh import [options] <rootfs tarball|-> <image>
+func importCmd(argv []string) error {
+	importFlags := newFlagSet("import", "[options] <rootfs tarball|-> <image>")
+	addStoreFlags(importFlags)
+	message := importFlags.String("m", "", "commit message recorded in the image history")
+	_ = importFlags.Parse(argv)
+
+	if importFlags.NArg() != 2 {
+		importFlags.Usage()
+		os.Exit(2)
+	}
+
+	ref, err := parseReference(importFlags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := importRootfs(s, importFlags.Arg(0), *message)
+	if err != nil {
+		return err
+	}
+
+	if err := s.tagImage(ref, manifest.digest()); err != nil {
+		return err
+	}
+
+	fmt.Println(manifest.Config.Digest)
+
+	return nil
+}
+
+// importRootfs stores the filesystem tarball, read from the standard input
+// when path is "-", as the single layer of a new image, as docker import does.
+// The tarball may be compressed; the layer is stored gzip compressed.
+func importRootfs(s *store, path, message string) (manifestResponse, error) {
+	if path == "-" {
+		f, err := s.tempFile()
+		if err != nil {
+			return manifestResponse{}, err
+		}
+		defer func() { _ = os.Remove(f.Name()) }()
+
+		_, err = io.Copy(f, os.Stdin)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return manifestResponse{}, err
+		}
+		path = f.Name()
+	}
+
+	layerBlob, diffID, err := s.compressLayer(path)
+	if err != nil {
+		return manifestResponse{}, err
+	}
+
+	now := time.Now().UTC()
+	config := map[string]interface{}{
+		"architecture": runtime.GOARCH,
+		"os":           "linux",
+		"created":      now,
+		"config":       map[string]interface{}{},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []string{diffID},
+		},
+		"history": []map[string]interface{}{{
+			"created":    now,
+			"created_by": "mydocker import",
+			"comment":    message,
+		}},
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return manifestResponse{}, err
+	}
+
+	configDigest, err := s.putBlob(data)
+	if err != nil {
+		return manifestResponse{}, err
+	}
+
+	manifest := manifestResponse{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeDockerManifest,
+		Config:        layer{MediaType: mediaTypeDockerConfig, Size: int64(len(data)), Digest: configDigest},
+		Layers:        []layer{layerBlob},
+	}
+	if manifest.raw, err = json.Marshal(manifest); err != nil {
+		return manifestResponse{}, err
+	}
+
+	if _, err := s.putBlob(manifest.raw); err != nil {
+		return manifestResponse{}, err
+	}
+
+	return manifest, nil
+}
+
+// compressLayer stores the tarball at path as a gzip compressed layer blob,
+// returning it along with the diff ID of its uncompressed content.
+func (s *store) compressLayer(path string) (layer, string, error) {
+	r, err := openLayer(path, layer{})
+	if err != nil {
+		return layer{}, "", err
+	}
+	defer r.Close()
+
+	f, err := s.tempFile()
+	if err != nil {
+		return layer{}, "", err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	compressed := sha256.New()
+	diffID := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(f, compressed)}
+	gz := gzip.NewWriter(counter)
+
+	_, err = io.Copy(io.MultiWriter(gz, diffID), r)
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return layer{}, "", err
+	}
+
+	l := layer{
+		MediaType: mediaTypeDockerLayerGzip,
+		Size:      counter.n,
+		Digest:    "sha256:" + hex.EncodeToString(compressed.Sum(nil)),
+	}
+	if err := s.ingest(f.Name(), l.Digest); err != nil {
+		return layer{}, "", err
+	}
+
+	return l, "sha256:" + hex.EncodeToString(diffID.Sum(nil)), nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
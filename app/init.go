@@ -0,0 +1,670 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// initCommand is the hidden command the container process starts with: it
+// switches to the container root filesystem from within the new namespaces,
+// then executes the container command.
+const initCommand = "init"
+
+// initOptions configure the container process from within its namespaces.
+type initOptions struct {
+	hostname string
+	ipc      string
+	network  string
+
+	// waitFD, when set, is a pipe to read until closed before setting up
+	// the container, once the process is in its cgroup and the network is
+	// configured.
+	waitFD int
+
+	// unshareCgroupns creates the cgroup namespace of the container once
+	// the process is in its cgroup.
+	unshareCgroupns bool
+
+	// egressRate and ingressRate cap the bandwidth of the slirp4netns
+	// interface, in bytes per second.
+	egressRate  int64
+	ingressRate int64
+
+	// ulimits are the resource limits of the command, as
+	// <name>=<soft>[:<hard>] values, and oomScoreAdj adjusts its likelihood
+	// of being killed by the OOM killer.
+	ulimits     []string
+	oomScoreAdj int
+
+	// capabilities, when set, are the comma separated names of the only
+	// capabilities the command keeps.
+	capabilities *string
+
+	// seccomp is the seccomp profile filtering the system calls of the
+	// command, if any.
+	seccomp string
+
+	// processLabel is the SELinux label of the command, and mountLabel the
+	// one of the filesystems mounted for the container, if any.
+	processLabel string
+	mountLabel   string
+
+	// noNewPrivileges keeps the command from gaining privileges on exec.
+	noNewPrivileges bool
+
+	// devices are the host devices created in the container, as
+	// <host path>:<container path> values.
+	devices []string
+
+	// readOnly mounts the root filesystem read-only, with writable tmpfs at
+	// readOnlyTmpfs.
+	readOnly bool
+
+	// tmpfs are the tmpfs mounted in the container, as
+	// <path>[:<options>] values.
+	tmpfs []string
+
+	// volumes are the host paths bind mounted in the container, as
+	// <host path>:<container path>[:ro] values.
+	volumes []string
+
+	// workdir is the working directory of the command, created when
+	// missing.
+	workdir string
+
+	// user, when set, is the <uid>:<gid> the command runs as, and groups
+	// its comma separated supplementary groups.
+	user   string
+	groups string
+}
+
+// Usage: /proc/self/exe init [options] <root dir> <command> <arg1> <arg2> ...
+func initCmd(argv []string) error {
+	var opts initOptions
+	initFlags := flag.NewFlagSet(initCommand, flag.ExitOnError)
+	initFlags.StringVar(&opts.hostname, "hostname", "", "set the hostname of the UTS namespace")
+	initFlags.StringVar(&opts.ipc, "ipc", namespacePrivate, "IPC namespace mode (private, host)")
+	initFlags.StringVar(&opts.network, "network", networkNone, "network mode (none, host, slirp4netns, container:<name or ID>)")
+	initFlags.IntVar(&opts.waitFD, "wait-fd", -1, "file descriptor to read until closed before setting up the container")
+	initFlags.BoolVar(&opts.unshareCgroupns, "unshare-cgroupns", false, "create the cgroup namespace once waited")
+	initFlags.Int64Var(&opts.egressRate, "egress-rate", 0, "maximum rate sent by the container, in bytes per second")
+	initFlags.Var((*stringsFlag)(&opts.ulimits), "ulimit", "set a resource limit of the command, as <name>=<soft>[:<hard>] (repeatable)")
+	initFlags.IntVar(&opts.oomScoreAdj, "oom-score-adj", 0, "adjust the OOM killer score of the command, from -1000 to 1000")
+	initFlags.Int64Var(&opts.ingressRate, "ingress-rate", 0, "maximum rate received by the container, in bytes per second")
+	initFlags.StringVar(&opts.seccomp, "seccomp", "", "seccomp profile filtering the system calls of the command, "+seccompDefault+" or a path, none when unset")
+	initFlags.StringVar(&opts.processLabel, "process-label", "", "SELinux label of the command")
+	initFlags.StringVar(&opts.mountLabel, "mount-label", "", "SELinux label of the filesystems mounted for the container")
+	initFlags.Var((*stringsFlag)(&opts.devices), "device", "create a host device in the container, as <host path>:<container path> (repeatable)")
+	initFlags.BoolVar(&opts.readOnly, "read-only", false, "mount the root filesystem read-only")
+	initFlags.Var((*stringsFlag)(&opts.tmpfs), "tmpfs", "mount a tmpfs, as <path>[:<options>] (repeatable)")
+	initFlags.Var((*stringsFlag)(&opts.volumes), "volume", "bind mount a host path, as <host path>:<container path>[:ro] (repeatable)")
+	initFlags.StringVar(&opts.workdir, "workdir", "", "working directory of the command, created when missing")
+	initFlags.StringVar(&opts.user, "user", "", "run the command as <uid>:<gid>")
+	initFlags.StringVar(&opts.groups, "groups", "", "comma separated supplementary groups of the command")
+	initFlags.BoolVar(&opts.noNewPrivileges, "no-new-privileges", false, "keep the command from gaining privileges on exec")
+	capabilities := initFlags.String("capabilities", "", "comma separated capabilities the command keeps, all are kept when unset")
+	_ = initFlags.Parse(argv)
+	initFlags.Visit(func(f *flag.Flag) {
+		if f.Name == "capabilities" {
+			opts.capabilities = capabilities
+		}
+	})
+
+	// Namespaces created with unshare only apply to the calling thread, which
+	// must then execute the command.
+	runtime.LockOSThread()
+
+	if initFlags.NArg() < 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [options] <root dir> <command> <args>...\n", os.Args[0], initCommand)
+		os.Exit(2)
+	}
+
+	argv = initFlags.Args()
+	if err := initContainer(argv[0], argv[1], argv[2:], opts); err != nil {
+		return fmt.Errorf("container init: %w", err)
+	}
+
+	return nil
+}
+
+// initContainer makes rootDir the root of the mount namespace, and replaces
+// the current process with the command, looked up in the image PATH.
+func initContainer(rootDir, command string, args []string, opts initOptions) error {
+	// Keep mounts made in the container, including the ones made from the
+	// outside while it waits, from propagating to the host.
+	propagation, err := rootPropagation(opts.volumes)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|propagation, ""); err != nil {
+		return fmt.Errorf("failed to set the propagation of mounts: %w", err)
+	}
+
+	if opts.waitFD >= 0 {
+		wait := os.NewFile(uintptr(opts.waitFD), "wait")
+		_, err := ioutil.ReadAll(wait)
+		_ = wait.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The seccomp profile is read from the host filesystem.
+	var profile *seccompProfile
+	if opts.seccomp != "" {
+		p, err := loadSeccompProfile(opts.seccomp)
+		if err != nil {
+			return err
+		}
+		profile = &p
+	}
+
+	if opts.unshareCgroupns {
+		if err := syscall.Unshare(cloneNewCgroup); err != nil {
+			return fmt.Errorf("failed to create the cgroup namespace: %w", err)
+		}
+	}
+
+	if opts.hostname != "" {
+		if err := syscall.Sethostname([]byte(opts.hostname)); err != nil {
+			return fmt.Errorf("failed to set hostname: %w", err)
+		}
+	}
+
+	// Joined network namespaces are already set up.
+	if opts.network == networkNone || opts.network == networkSlirp {
+		if err := loopbackUp(); err != nil {
+			return err
+		}
+	}
+
+	// tc is run from the host root filesystem, before switching to the
+	// container one.
+	if opts.egressRate > 0 || opts.ingressRate > 0 {
+		if err := limitBandwidth(slirpDevice, opts.egressRate, opts.ingressRate); err != nil {
+			return err
+		}
+	}
+
+	if err := pivotRoot(rootDir); err != nil {
+		return err
+	}
+
+	if err := mountSystem(opts.mountLabel); err != nil {
+		return err
+	}
+
+	if err := createDevices(); err != nil {
+		return err
+	}
+
+	for _, d := range opts.devices {
+		i := strings.Index(d, ":")
+		if i < 0 {
+			return fmt.Errorf("invalid device %q", d)
+		}
+		if err := createDevice(d[:i], d[i+1:]); err != nil {
+			return err
+		}
+	}
+
+	if err := mountShm(opts.ipc, opts.mountLabel); err != nil {
+		return err
+	}
+
+	if err := protectPaths(); err != nil {
+		return err
+	}
+
+	if opts.readOnly {
+		for _, m := range readOnlyTmpfs {
+			if err := mountTmpfs(m.target, syscall.MS_NOSUID|syscall.MS_NODEV, labelData(m.data, opts.mountLabel)); err != nil {
+				return err
+			}
+		}
+	}
+
+	mounts, err := userMounts(opts.tmpfs, opts.volumes, opts.mountLabel)
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		if err := m.mount(); err != nil {
+			return err
+		}
+	}
+
+	if err := detachHostRoot(); err != nil {
+		return err
+	}
+
+	// The working directory may be in a mount, and is created before the
+	// root filesystem is made read-only.
+	if opts.workdir != "" {
+		if err := os.MkdirAll(opts.workdir, 0755); err != nil {
+			return fmt.Errorf("failed to create the working directory: %w", err)
+		}
+		if err := syscall.Chdir(opts.workdir); err != nil {
+			return fmt.Errorf("failed to change to the working directory: %w", err)
+		}
+	}
+
+	// The host root mount point is removed from the root filesystem first.
+	if opts.readOnly {
+		if err := remountReadOnly("/"); err != nil {
+			return err
+		}
+	}
+
+	if err := setUlimits(opts.ulimits); err != nil {
+		return err
+	}
+
+	if opts.oomScoreAdj != 0 {
+		if err := ioutil.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(opts.oomScoreAdj)), 0); err != nil {
+			return fmt.Errorf("failed to adjust the OOM score: %w", err)
+		}
+	}
+
+	// The container setup needs all the capabilities, so they are only
+	// limited once done. They apply to the current thread, which executes the
+	// command, as does the seccomp filter, installed first as it requires the
+	// SYS_ADMIN capability.
+	names := capabilities
+	if opts.capabilities != nil {
+		names = nil
+		if *opts.capabilities != "" {
+			names = strings.Split(*opts.capabilities, ",")
+		}
+	}
+	if opts.processLabel != "" {
+		if err := setExecLabel(opts.processLabel); err != nil {
+			return err
+		}
+	}
+	if opts.noNewPrivileges {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+			return fmt.Errorf("failed to set no new privileges: %w", errno)
+		}
+	}
+	if profile != nil {
+		filter, err := profile.compile(names)
+		if err != nil {
+			return err
+		}
+		if err := installSeccomp(filter); err != nil {
+			return err
+		}
+	}
+	if opts.user != "" {
+		var uid, gid int
+		if _, err := fmt.Sscanf(opts.user, "%d:%d", &uid, &gid); err != nil {
+			return fmt.Errorf("invalid user %q", opts.user)
+		}
+		var groups []int
+		if opts.groups != "" {
+			for _, g := range strings.Split(opts.groups, ",") {
+				gid, err := strconv.Atoi(g)
+				if err != nil {
+					return fmt.Errorf("invalid group %q", g)
+				}
+				groups = append(groups, gid)
+			}
+		}
+		if err := switchUser(uid, gid, groups); err != nil {
+			return err
+		}
+	}
+	if opts.capabilities != nil {
+		if err := limitCapabilities(names); err != nil {
+			return err
+		}
+	}
+
+	// The lookup happens in the container root filesystem, with the PATH of
+	// the image.
+	path, err := exec.LookPath(command)
+	if err == nil {
+		err = syscall.Exec(path, append([]string{command}, args...), os.Environ())
+	}
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return &exitError{exitNotFound, fmt.Errorf("%s: not found in the image (PATH=%s)", command, os.Getenv("PATH"))}
+	}
+
+	return &exitError{exitCannotInvoke, fmt.Errorf("%s: cannot be invoked: %w", command, err)}
+}
+
+// prSetNoNewPrivs is the prctl option setting the no_new_privs attribute,
+// missing from the syscall package.
+const prSetNoNewPrivs = 38
+
+// hostRoot is where the host root filesystem is moved to by pivotRoot, until
+// detached.
+const hostRoot = "/.pivot_root"
+
+// pivotRoot makes rootDir the root filesystem of the current mount namespace,
+// moving the previous root to hostRoot. It must then be detached with
+// detachHostRoot, so that the container cannot reach the host filesystem, as
+// it could escape a chroot.
+func pivotRoot(rootDir string) error {
+	// pivot_root requires the new root to be a mount point. The bind mount is
+	// recursive to keep the watched paths mounted.
+	if err := syscall.Mount(rootDir, rootDir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind mount the root filesystem: %w", err)
+	}
+
+	oldRoot := filepath.Join(rootDir, hostRoot)
+	if err := os.MkdirAll(oldRoot, 0700); err != nil {
+		return err
+	}
+
+	if err := syscall.PivotRoot(rootDir, oldRoot); err != nil {
+		return fmt.Errorf("failed to pivot root: %w", err)
+	}
+
+	return syscall.Chdir("/")
+}
+
+// detachHostRoot unmounts the host root filesystem moved by pivotRoot.
+func detachHostRoot() error {
+	if err := syscall.Unmount(hostRoot, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount the host root: %w", err)
+	}
+
+	return os.Remove(hostRoot)
+}
+
+// containerTarget resolves the container path of a mount or created file,
+// following the image symlinks within the container root filesystem. Paths
+// leading to the host root, still attached, are refused.
+func containerTarget(path string) (string, error) {
+	target, err := resolveTarget("/", path)
+	if err != nil {
+		return "", err
+	}
+	if target == hostRoot || strings.HasPrefix(target, hostRoot+"/") {
+		return "", fmt.Errorf("%s: path leads outside the root filesystem", path)
+	}
+
+	return target, nil
+}
+
+// systemMount is a filesystem mounted in every container.
+type systemMount struct {
+	source string
+	target string
+	fstype string
+	flags  uintptr
+	data   string
+
+	// fallbackData is used when the mount fails with data, e.g. because
+	// of options naming ids the user namespace does not map.
+	fallbackData string
+}
+
+// systemMounts are the filesystems mounted in every container, in order.
+var systemMounts = []systemMount{
+	// A new proc instance shows the processes of the container PID
+	// namespace only.
+	{"proc", "/proc", "proc", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, "", ""},
+
+	// sysfs and the cgroup hierarchy are exposed for probing the hardware
+	// and the resource limits, but cannot be changed from the container.
+	{"sysfs", "/sys", "sysfs", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_RDONLY, "", ""},
+	{"cgroup2", "/sys/fs/cgroup", "cgroup2", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_RDONLY, "", ""},
+
+	// /dev only holds the standard devices, and a new devpts instance
+	// isolates the container terminals from the host ones.
+	{"tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID | syscall.MS_STRICTATIME, "mode=755,size=65536k", ""},
+	{"devpts", "/dev/pts", "devpts", syscall.MS_NOSUID | syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620,gid=5", "newinstance,ptmxmode=0666,mode=0620"},
+}
+
+// mountSystem mounts the system filesystems in the container root, which
+// must be the root of the current mount namespace. The memory filesystems
+// get the SELinux label, when set.
+func mountSystem(label string) error {
+	for _, m := range systemMounts {
+		if err := os.MkdirAll(m.target, 0755); err != nil {
+			return err
+		}
+
+		if m.fstype == "tmpfs" || m.fstype == "devpts" {
+			m.data = labelData(m.data, label)
+			m.fallbackData = labelData(m.fallbackData, label)
+		}
+
+		// Without the privileges to mount a new instance, e.g. sysfs in a
+		// user namespace sharing the host network, the host one is used.
+		err := syscall.Mount(m.source, m.target, m.fstype, m.flags, m.data)
+		if errors.Is(err, syscall.EINVAL) && m.fallbackData != "" {
+			err = syscall.Mount(m.source, m.target, m.fstype, m.flags, m.fallbackData)
+		}
+		if errors.Is(err, syscall.EPERM) {
+			err = bindHost(m.target, m.flags)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mount %s: %w", m.target, err)
+		}
+	}
+
+	return nil
+}
+
+// bindHost bind mounts the host path at the same path in the container, with
+// the given mount flags.
+func bindHost(path string, flags uintptr) error {
+	if err := syscall.Mount(filepath.Join(hostRoot, path), path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+
+	// Bind mounts only get their flags once remounted.
+	if flags == 0 {
+		return nil
+	}
+	return syscall.Mount("", path, "", flags|syscall.MS_REMOUNT|syscall.MS_BIND, "")
+}
+
+// maskedPaths are the paths of /proc and /sys hidden from containers, as with
+// Docker: they expose the host kernel memory, timers or hardware.
+var maskedPaths = []string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/interrupts",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/sys/devices/virtual/powercap",
+	"/sys/firmware",
+}
+
+// readonlyPaths are the paths of /proc that containers can read but not
+// write, as they configure the host kernel.
+var readonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// protectPaths hides the masked paths, files behind /dev/null and
+// directories behind an empty read-only tmpfs, and makes the read-only paths
+// read-only, once /proc, /sys and /dev are mounted.
+func protectPaths() error {
+	for _, path := range maskedPaths {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			err = syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_RDONLY, "")
+		} else {
+			err = syscall.Mount("/dev/null", path, "", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mask %s: %w", path, err)
+		}
+	}
+
+	for _, path := range readonlyPaths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+
+		// Remounting keeps the flags of the /proc mount, which cannot be
+		// cleared in a user namespace.
+		err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, "")
+		if err == nil {
+			err = syscall.Mount("", path, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to make %s read-only: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// devices are the character devices created in the container /dev.
+var devices = []struct {
+	name         string
+	major, minor int64
+}{
+	{"null", 1, 3},
+	{"zero", 1, 5},
+	{"full", 1, 7},
+	{"random", 1, 8},
+	{"urandom", 1, 9},
+	{"tty", 5, 0},
+}
+
+// devLinks are the symbolic links created in the container /dev.
+var devLinks = map[string]string{
+	"fd":     "/proc/self/fd",
+	"stdin":  "/proc/self/fd/0",
+	"stdout": "/proc/self/fd/1",
+	"stderr": "/proc/self/fd/2",
+	"ptmx":   "pts/ptmx",
+}
+
+// createDevices creates the standard device nodes and links in the container
+// /dev, once mounted.
+func createDevices() error {
+	for _, d := range devices {
+		path := filepath.Join("/dev", d.name)
+		// The mode given to mknod is subject to the umask.
+		err := syscall.Mknod(path, syscall.S_IFCHR|0666, deviceNumber(d.major, d.minor))
+		if err == nil {
+			err = os.Chmod(path, 0666)
+		}
+
+		// Devices cannot be created in a user namespace: the host ones are
+		// bind mounted instead.
+		if errors.Is(err, syscall.EPERM) {
+			if err = ioutil.WriteFile(path, nil, 0666); err == nil {
+				err = bindHost(path, 0)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", path, err)
+		}
+	}
+
+	for name, target := range devLinks {
+		if err := os.Symlink(target, filepath.Join("/dev", name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// labelData adds the SELinux label option, if set, to the mount data, if not
+// empty.
+func labelData(data, label string) string {
+	if data == "" || label == "" {
+		return data
+	}
+	return data + "," + contextOption(label)
+}
+
+// readOnlyTmpfs are the tmpfs mounted in containers with a read-only root
+// filesystem, where most programs expect to write.
+var readOnlyTmpfs = []struct {
+	target string
+	data   string
+}{
+	{"/tmp", "mode=1777"},
+	{"/run", "mode=755"},
+}
+
+// mountTmpfs mounts a tmpfs at the container path, created if missing, with
+// the mount flags and data.
+func mountTmpfs(path string, flags uintptr, data string) error {
+	target, err := containerTarget(path)
+	if err != nil {
+		return fmt.Errorf("failed to mount a tmpfs: %w", err)
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+
+	if err := syscall.Mount("tmpfs", target, "tmpfs", flags, data); err != nil {
+		return fmt.Errorf("failed to mount a tmpfs at %s: %w", path, err)
+	}
+	return nil
+}
+
+// remountReadOnly makes the mount at path read-only. The other flags of the
+// mount are kept, as those set outside of a user namespace cannot be cleared
+// from within.
+func remountReadOnly(path string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return err
+	}
+
+	flags := uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME)
+	if err := syscall.Mount("", path, "", flags|syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("failed to make %s read-only: %w", path, err)
+	}
+	return nil
+}
+
+// mountShm mounts the container /dev/shm, holding the POSIX shared memory
+// objects: a tmpfs of its own, with the SELinux label if set, or the host one
+// when sharing the host IPC namespace.
+func mountShm(ipc, label string) error {
+	if err := os.MkdirAll("/dev/shm", 0755); err != nil {
+		return err
+	}
+
+	var err error
+	if ipc == namespaceHost {
+		err = syscall.Mount(filepath.Join(hostRoot, "dev", "shm"), "/dev/shm", "", syscall.MS_BIND|syscall.MS_REC, "")
+	} else {
+		err = syscall.Mount("shm", "/dev/shm", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, labelData("mode=1777,size=65536k", label))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mount /dev/shm: %w", err)
+	}
+
+	return nil
+}
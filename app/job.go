@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// jobResult is the JSON manifest written at the end of a job.
+type jobResult struct {
+	ID              string      `json:"id"`
+	Image           string      `json:"image"`
+	Command         []string    `json:"command"`
+	ExitCode        int         `json:"exitCode"`
+	OOMKilled       bool        `json:"oomKilled"`
+	NoNewPrivileges bool        `json:"noNewPrivileges"`
+	Error           string      `json:"error,omitempty"`
+	StartedAt       time.Time   `json:"startedAt"`
+	FinishedAt      time.Time   `json:"finishedAt"`
+	Duration        float64     `json:"durationSeconds"`
+	Stdout          string      `json:"stdout"`
+	Stderr          string      `json:"stderr"`
+	Outputs         []jobOutput `json:"outputs"`
+}
+
+// jobOutput describes a container path copied out of the container.
+type jobOutput struct {
+	Path     string `json:"path"`
+	HostPath string `json:"hostPath,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Usage: your_docker.sh job <command> [options] <args>...
+func jobCmd(argv []string) error {
+	return dispatch("job", []command{
+		{"run", "Run a command in a new container and collect its outputs", jobRunCmd},
+	}, argv)
+}
+
+// Usage: your_docker.sh job run [options] --output-dir <dir> [--output <path>]... <image> [<command> <arg1> <arg2> ...]
+func jobRunCmd(argv []string) error {
+	jobFlags := newFlagSet("job run", "[options] --output-dir <dir> [--output <path>]... <image> [<command> <arg1> <arg2> ...]")
+	opts := addRunFlags(jobFlags)
+	outputDir := jobFlags.String("output-dir", "", "host directory receiving the logs, outputs and result.json of the job")
+	var outputs []string
+	jobFlags.Var((*stringsFlag)(&outputs), "output", "container path to copy into the output directory once the job is done (repeatable)")
+	_ = jobFlags.Parse(argv)
+
+	if jobFlags.NArg() < 1 || *outputDir == "" {
+		jobFlags.Usage()
+		os.Exit(2)
+	}
+
+	for _, output := range outputs {
+		if !filepath.IsAbs(output) {
+			return fmt.Errorf("job output must be an absolute path: %s", output)
+		}
+	}
+
+	if err := os.MkdirAll(*outputDir, 0755); err != nil {
+		return err
+	}
+
+	result, err := runJob(jobFlags.Arg(0), jobFlags.Args()[1:], outputs, *outputDir, opts)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(*outputDir, "result.json"), append(data, '\n'), 0644); err != nil {
+		return err
+	}
+
+	if result.ExitCode != 0 {
+		os.Exit(result.ExitCode)
+	}
+
+	return nil
+}
+
+// runJob runs the command to completion in a new container, recording its
+// logs in outputDir and copying the outputs paths there once it is done.
+func runJob(image string, command, outputs []string, outputDir string, opts *runOptions) (jobResult, error) {
+	result := jobResult{
+		Image:   image,
+		Command: command,
+		Stdout:  filepath.Join(outputDir, "stdout.log"),
+		Stderr:  filepath.Join(outputDir, "stderr.log"),
+		Outputs: []jobOutput{},
+	}
+
+	stdout, err := os.Create(result.Stdout)
+	if err != nil {
+		return result, err
+	}
+	defer func() { _ = stdout.Close() }()
+
+	stderr, err := os.Create(result.Stderr)
+	if err != nil {
+		return result, err
+	}
+	defer func() { _ = stderr.Close() }()
+
+	c, err := createContainer(image, opts)
+	if err != nil {
+		return result, err
+	}
+	defer c.remove()
+	result.ID = c.id
+	result.NoNewPrivileges = c.noNewPrivileges
+
+	if result.Command, err = commandLine(c.entrypoint, c.cmd, command); err != nil {
+		return result, err
+	}
+
+	cmd := c.command(result.Command[0], result.Command[1:])
+	cmd.Stdout = io.MultiWriter(os.Stdout, stdout)
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+
+	result.StartedAt = time.Now().UTC()
+	err = c.run(cmd)
+	result.FinishedAt = time.Now().UTC()
+	result.Duration = result.FinishedAt.Sub(result.StartedAt).Seconds()
+
+	result.OOMKilled = c.oomKilled()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		result.ExitCode = exitRuntimeError
+		result.Error = err.Error()
+	}
+
+	for _, path := range outputs {
+		output := jobOutput{
+			Path:     path,
+			HostPath: filepath.Join(outputDir, "outputs", path),
+		}
+
+		// Outputs are resolved in the container root, so that symlinks
+		// created by the job cannot make us copy host files.
+		src, err := resolvePath(c.rootDir, path)
+		if err == nil {
+			err = copyTree(src, output.HostPath)
+		}
+		if err != nil {
+			output.HostPath = ""
+			output.Error = err.Error()
+		}
+		result.Outputs = append(result.Outputs, output)
+	}
+
+	return result, nil
+}
+
+// copyTree copies the file or directory src to dst. Symbolic links are copied
+// as is, other special files are skipped.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copy(path, target)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// openLayer opens the blob at path of the layer, returning its uncompressed
+// tar stream. Encrypted layers are decrypted first. The compression is
+// detected from the magic bytes of the blob rather than the media type, which
+// registries do not always get right. zstd layers are decompressed by the zstd
+// command, as the standard library lacks it.
+func openLayer(path string, l layer) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = f
+	if isEncrypted(l) {
+		if r, err = decryptLayer(f, l); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		return &layerReader{Reader: gz, closers: []io.Closer{gz, f}}, nil
+
+	case bytes.HasPrefix(magic, zstdMagic):
+		cmd := exec.Command("zstd", "-d", "-c", "-q")
+		cmd.Stdin = br
+		cmd.Stderr = os.Stderr
+
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+
+		if err := cmd.Start(); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("decompressing zstd layer: %w", err)
+		}
+		return &layerReader{Reader: out, cmd: cmd, closers: []io.Closer{out, f}}, nil
+	}
+
+	return &layerReader{Reader: br, closers: []io.Closer{f}}, nil
+}
+
+// layerReader is an uncompressed layer stream. When decompressed by a command,
+// its failure is reported once the stream is exhausted.
+type layerReader struct {
+	io.Reader
+	cmd     *exec.Cmd
+	closers []io.Closer
+}
+
+func (l *layerReader) Read(b []byte) (int, error) {
+	n, err := l.Reader.Read(b)
+	if err == io.EOF && l.cmd != nil {
+		cmd := l.cmd
+		l.cmd = nil
+		if werr := cmd.Wait(); werr != nil {
+			return n, fmt.Errorf("decompressing zstd layer: %w", werr)
+		}
+	}
+
+	return n, err
+}
+
+func (l *layerReader) Close() error {
+	var err error
+	for _, c := range l.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	if l.cmd != nil {
+		_ = l.cmd.Process.Kill()
+		_ = l.cmd.Wait()
+		l.cmd = nil
+	}
+
+	return err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// refNameAnnotation is the annotation naming the manifests of an OCI layout
+// index, usually after their tag.
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// ociLayout is a local OCI image layout directory, whose blobs are stored
+// under blobs/<algorithm>/<hex> and whose index.json lists its images.
+type ociLayout struct {
+	dir string
+}
+
+func (l ociLayout) blobPath(digest string) string {
+	return filepath.Join(l.dir, "blobs", strings.Replace(digest, ":", string(filepath.Separator), 1))
+}
+
+func (l ociLayout) blobSource(digest string) blobSource {
+	return fileSource(l.blobPath(digest))
+}
+
+// readBlob reads the blob, checking its content matches the digest.
+func (l ociLayout) readBlob(digest string) ([]byte, error) {
+	if err := checkDigest(digest); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(l.blobPath(digest))
+	if err != nil {
+		return nil, err
+	}
+
+	if actual := fmt.Sprintf("sha256:%x", sha256.Sum256(data)); actual != digest {
+		return nil, fmt.Errorf("digest mismatch: expected %s, got %s", digest, actual)
+	}
+
+	return data, nil
+}
+
+// index reads the index of the layout, listing its images.
+func (l ociLayout) index() (manifestIndex, error) {
+	data, err := ioutil.ReadFile(filepath.Join(l.dir, "index.json"))
+	if err != nil {
+		return manifestIndex{}, err
+	}
+
+	var index manifestIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return manifestIndex{}, fmt.Errorf("invalid OCI layout index: %w", err)
+	}
+
+	return index, nil
+}
+
+// manifest returns the manifest of the image named tag in the layout index,
+// or of its only image when tag is empty. Multi-platform images resolve to
+// the manifest of the current platform.
+func (l ociLayout) manifest(tag string) (manifestResponse, error) {
+	index, err := l.index()
+	if err != nil {
+		return manifestResponse{}, err
+	}
+
+	// Images are named after their tag, or their full name in archives
+	// written by docker save.
+	var found, named []indexedManifest
+	for _, m := range index.Manifests {
+		if tag == "" || m.Annotations[refNameAnnotation] == tag {
+			found = append(found, m)
+		}
+		if name := m.Annotations[containerdNameAnnotation]; name != "" && sameImage(name, tag) {
+			named = append(named, m)
+		}
+	}
+	if len(named) > 0 {
+		found = named
+	}
+
+	switch {
+	case len(found) == 0:
+		return manifestResponse{}, fmt.Errorf("no image %q in OCI layout %s", tag, l.dir)
+	case len(found) > 1:
+		return manifestResponse{}, fmt.Errorf("OCI layout %s has several images, a tag is required", l.dir)
+	}
+
+	return l.resolve(found[0])
+}
+
+// sameImage reports whether both image names refer to the same image.
+func sameImage(a, b string) bool {
+	refA, err := parseReference(a)
+	if err != nil {
+		return false
+	}
+
+	refB, err := parseReference(b)
+	return err == nil && refA.String() == refB.String()
+}
+
+// resolve reads the manifest of the descriptor, following nested indexes down
+// to the manifest of the current platform.
+func (l ociLayout) resolve(desc indexedManifest) (manifestResponse, error) {
+	raw, err := l.readBlob(desc.Digest)
+	if err != nil {
+		return manifestResponse{}, err
+	}
+
+	if desc.MediaType != mediaTypeOCIIndex && desc.MediaType != mediaTypeDockerManifestList {
+		var manifest manifestResponse
+		if err := json.Unmarshal(raw, &manifest); err != nil {
+			return manifestResponse{}, err
+		}
+		if err := manifest.validate(); err != nil {
+			return manifestResponse{}, err
+		}
+		manifest.raw = raw
+
+		return manifest, nil
+	}
+
+	var index manifestIndex
+	if err := json.Unmarshal(raw, &index); err != nil {
+		return manifestResponse{}, err
+	}
+
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	for _, m := range index.Manifests {
+		if m.Platform.OS+"/"+m.Platform.Architecture == platform {
+			return l.resolve(m)
+		}
+	}
+
+	return manifestResponse{}, fmt.Errorf("no image for %s in %s", platform, desc.Digest)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Usage: your_docker.sh load [-i <file>] [options]
+func loadCmd(argv []string) error {
+	loadFlags := newFlagSet("load", "[-i <file>] [options]")
+	addStoreFlags(loadFlags)
+	input := loadFlags.String("i", "-", "read from the tarball file instead of the standard input")
+	_ = loadFlags.Parse(argv)
+
+	if loadFlags.NArg() != 0 {
+		loadFlags.Usage()
+		os.Exit(2)
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	if err := loadImages(s, *input); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// loadImages imports the images of a docker-archive or oci-archive tarball
+// into the store, and tags them after the names recorded in the archive.
+func loadImages(s *store, path string) error {
+	dir, cleanup, err := unpackArchive(path)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err == nil {
+		entries, err := readArchiveManifest(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			src, err := dockerArchiveSource(dir, entry, "docker archive "+path)
+			if err != nil {
+				return err
+			}
+
+			if err := loadImage(s, src, entry.RepoTags); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	layout := ociLayout{dir: dir}
+	index, err := layout.index()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range index.Manifests {
+		manifest, err := layout.resolve(m)
+		if err != nil {
+			return err
+		}
+
+		// Names are full image references, or tags from which no image
+		// name can be derived.
+		var names []string
+		if name := m.Annotations[containerdNameAnnotation]; name != "" {
+			names = append(names, name)
+		} else if name := m.Annotations[refNameAnnotation]; strings.ContainsAny(name, "/:") {
+			names = append(names, name)
+		}
+
+		src := &localSource{
+			description: "OCI archive " + path,
+			manifest:    manifest,
+			blobSource:  layout.blobSource,
+		}
+		if err := loadImage(s, src, names); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadImage imports the image into the store, tagging it with names.
+func loadImage(s *store, src *localSource, names []string) error {
+	if err := s.importImage(src); err != nil {
+		return fmt.Errorf("%s: %w", src.description, err)
+	}
+
+	if len(names) == 0 {
+		fmt.Printf("Loaded image ID: %s\n", src.manifest.Config.Digest)
+		return nil
+	}
+
+	for _, name := range names {
+		ref, err := parseReference(name)
+		if err != nil {
+			return err
+		}
+
+		if err := s.tagImage(ref, src.manifest.digest()); err != nil {
+			return err
+		}
+		fmt.Printf("Loaded image: %s\n", ref)
+	}
+
+	return nil
+}
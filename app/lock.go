@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// defaultLockFile is the lock file used when none is given.
+const defaultLockFile = "mydocker.lock"
+
+// imageLock pins image tags to the digest of their manifest, so that the
+// exact same images are used on every run.
+type imageLock struct {
+	Images map[string]string `json:"images"`
+}
+
+func readImageLock(path string) (imageLock, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return imageLock{}, err
+	}
+
+	var lock imageLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return imageLock{}, fmt.Errorf("invalid lock file %s: %w", path, err)
+	}
+
+	return lock, nil
+}
+
+func (l imageLock) write(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Usage: your_docker.sh lock <command> [options] <args>...
+func lockCmd(argv []string) error {
+	return dispatch("lock", []command{
+		{"write", "Record the digests of image tags in the lock file", lockWriteCmd},
+		{"verify", "Check that image tags still have their locked digests", lockVerifyCmd},
+	}, argv)
+}
+
+// Usage: your_docker.sh lock write [options] [<image>...]
+func lockWriteCmd(argv []string) error {
+	writeFlags := newFlagSet("lock write", "[options] [<image>...]")
+	addRegistryFlags(writeFlags)
+	path := writeFlags.String("f", defaultLockFile, "lock file")
+	_ = writeFlags.Parse(argv)
+
+	if err := writeLock(*path, writeFlags.Args()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Usage: your_docker.sh lock verify [options]
+func lockVerifyCmd(argv []string) error {
+	verifyFlags := newFlagSet("lock verify", "[options]")
+	addRegistryFlags(verifyFlags)
+	path := verifyFlags.String("f", defaultLockFile, "lock file")
+	_ = verifyFlags.Parse(argv)
+
+	if verifyFlags.NArg() != 0 {
+		verifyFlags.Usage()
+		os.Exit(2)
+	}
+
+	lock, err := readImageLock(*path)
+	if err != nil {
+		return err
+	}
+
+	ok, err := verifyLock(lock)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+// writeLock records the current digest of the image tags in the lock file.
+// Without images, the tags already in the lock file are updated.
+func writeLock(path string, images []string) error {
+	if len(images) == 0 {
+		lock, err := readImageLock(path)
+		if err != nil {
+			return err
+		}
+
+		for image := range lock.Images {
+			images = append(images, image)
+		}
+		sort.Strings(images)
+	}
+
+	lock := imageLock{Images: map[string]string{}}
+	for _, image := range images {
+		ref, err := parseReference(image)
+		if err != nil {
+			return err
+		}
+		if ref.digest != "" {
+			return fmt.Errorf("%s: only tags can be locked", image)
+		}
+
+		digest, err := currentDigest(ref)
+		if err != nil {
+			return err
+		}
+
+		lock.Images[ref.String()] = digest
+		fmt.Printf("%s: %s\n", ref, digest)
+	}
+
+	return lock.write(path)
+}
+
+// verifyLock reports whether the tags of the lock file still point to the
+// locked digests, printing the ones that changed.
+func verifyLock(lock imageLock) (bool, error) {
+	var images []string
+	for image := range lock.Images {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+
+	ok := true
+	for _, image := range images {
+		ref, err := parseReference(image)
+		if err != nil {
+			return false, err
+		}
+
+		digest, err := currentDigest(ref)
+		if err != nil {
+			return false, err
+		}
+
+		if digest != lock.Images[image] {
+			fmt.Printf("%s: changed from %s to %s\n", image, lock.Images[image], digest)
+			ok = false
+			continue
+		}
+		fmt.Printf("%s: OK\n", image)
+	}
+
+	return ok, nil
+}
+
+// currentDigest returns the digest of the manifest the tag points to in the
+// registry.
+func currentDigest(ref reference) (string, error) {
+	_, manifest, err := openRepository(ref)
+	if err != nil {
+		return "", err
+	}
+
+	return manifest.digest(), nil
+}
+
+// lockedImage checks the registry tag of the image still points to the
+// digest recorded in the lock file, and returns the image pinned to it.
+func lockedImage(image, path string) (string, error) {
+	if isLocalSource(image) {
+		return "", fmt.Errorf("%s: only registry images can be locked", image)
+	}
+
+	lock, err := readImageLock(path)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := parseReference(image)
+	if err != nil {
+		return "", err
+	}
+
+	locked, ok := lock.Images[ref.String()]
+	if !ok {
+		return "", fmt.Errorf("%s is not in the lock file %s", ref, path)
+	}
+
+	digest, err := currentDigest(ref)
+	if err != nil {
+		return "", err
+	}
+	if digest != locked {
+		return "", fmt.Errorf("%s changed from %s to %s, refusing to run it", ref, locked, digest)
+	}
+
+	ref.digest = locked
+	return ref.String(), nil
+}
@@ -1,17 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"syscall"
 )
 
 type nullReader struct{}
@@ -44,164 +41,381 @@ func copy(src, dst string) error {
 	return os.Chmod(dst, info.Mode())
 }
 
-type registryTokenSvcResponse struct {
-	Token string `json:"token,omitempty"`
-}
-
-func registryLogin(image string) (string, error) {
-	imageSplit := strings.Split(image, ":")
-	url := fmt.Sprintf("https://auth.docker.io/token?service=registry.docker.io&scope=repository:library/%s:pull", imageSplit[0])
-
-	resp, err := http.DefaultClient.Get(url)
-	if err != nil {
-		return "", err
-	}
-	defer func() { _ = resp.Body.Close() }()
+// stringsFlag is a flag that can be repeated, accumulating its values.
+type stringsFlag []string
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to get docker registry token. Status code: %d", resp.StatusCode)
-	}
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
 
-	var response registryTokenSvcResponse
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return "", err
-	}
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
 
-	return response.Token, nil
+// optionalFlag is a string flag telling an empty value apart from an unset
+// one, whose value is then nil.
+type optionalFlag struct {
+	value *string
 }
 
-type manifestResponse struct {
-	Layers []layer `json:"layers,omitempty"`
+func (f *optionalFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return *f.value
 }
 
-type layer struct {
-	MediaType string `json:"mediaType,omitempty"`
-	Size      int64  `json:"size,omitempty"`
-	Digest    string `json:"digest,omitempty"`
+func (f *optionalFlag) Set(value string) error {
+	f.value = &value
+	return nil
 }
 
-func fetchManifest(token, image string) (manifestResponse, error) {
-	imageSplit := strings.Split(image, ":")
-	tag := "latest"
-	if len(imageSplit) == 2 {
-		tag = imageSplit[1]
+// hostTimezone returns the IANA name of the host timezone, or an empty string
+// if it cannot be determined.
+func hostTimezone() string {
+	if tz := os.Getenv("TZ"); tz != "" {
+		return strings.TrimPrefix(tz, ":")
 	}
-	url := fmt.Sprintf("https://registry.hub.docker.com/v2/library/%s/manifests/%s", imageSplit[0], tag)
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	target, err := os.Readlink("/etc/localtime")
 	if err != nil {
-		return manifestResponse{}, err
+		return ""
 	}
 
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
-	req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.v2+json")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return manifestResponse{}, err
+	i := strings.Index(target, "zoneinfo/")
+	if i < 0 {
+		return ""
 	}
-	defer func() { _ = resp.Body.Close() }()
 
-	if resp.StatusCode != http.StatusOK {
-		return manifestResponse{}, fmt.Errorf("failed to get image manifest. Status code: %d", resp.StatusCode)
-	}
+	return target[i+len("zoneinfo/"):]
+}
 
-	var response manifestResponse
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return manifestResponse{}, err
+// setupTimezone installs the zoneinfo data of the given timezone as the
+// container /etc/localtime. The data is also copied under /usr/share/zoneinfo
+// when missing from the image, so that TZ lookups by name work as well.
+func setupTimezone(rootDir, tz string) error {
+	if filepath.IsAbs(tz) || strings.Contains(tz, "..") {
+		return fmt.Errorf("invalid timezone: %s", tz)
 	}
 
-	return response, nil
-}
-
-func extractLayer(token, image, digest, rootDir string) error {
-	imageSplit := strings.Split(image, ":")
-	url := fmt.Sprintf("https://registry.hub.docker.com/v2/library/%s/blobs/%s", imageSplit[0], digest)
+	src := filepath.Join("/usr/share/zoneinfo", tz)
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("unknown timezone %s: %w", tz, err)
+	}
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	// Both paths are resolved within the root filesystem, the image
+	// directories possibly being symlinks to host ones.
+	zoneinfo, err := resolvePath(rootDir, filepath.Join("/usr/share/zoneinfo", tz))
 	if err != nil {
 		return err
 	}
+	if _, err := os.Lstat(zoneinfo); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(zoneinfo), 0755); err != nil {
+			return err
+		}
+		if err := copy(src, zoneinfo); err != nil {
+			return err
+		}
+	}
 
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
-
-	resp, err := http.DefaultClient.Do(req)
+	localtime, err := resolvePath(rootDir, "/etc/localtime")
 	if err != nil {
 		return err
 	}
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to get image manifest. Status code: %d", resp.StatusCode)
-	}
-
-	outPath := filepath.Join(rootDir, "layer.tar.gz")
-	out, err := os.Create(outPath)
-	defer os.Remove(outPath)
-
-	if _, err := io.Copy(out, resp.Body); err != nil {
+	if err := os.MkdirAll(filepath.Dir(localtime), 0755); err != nil {
 		return err
 	}
 
-	if err := out.Close(); err != nil {
+	// Images usually ship /etc/localtime as an absolute symlink, which must
+	// not be followed as it would resolve on the host.
+	if err := os.Remove(localtime); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
-	cmd := exec.Command("tar", "-xhf", outPath, "-C", rootDir)
-	cmd.Stdin = nullReader{}
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	return copy(src, localtime)
+}
 
-	if err := cmd.Run(); err != nil {
-		return err
-	}
+// addRegistryFlags registers the flags configuring registry access.
+func addRegistryFlags(fs *flag.FlagSet) {
+	fs.IntVar(&registryRetry.maxAttempts, "registry-attempts", registryRetry.maxAttempts, "maximum number of attempts for each registry request")
+	fs.DurationVar(&registryTimeout, "registry-timeout", registryTimeout, "timeout for connecting and waiting on the registry")
+	fs.Var((*stringsFlag)(&insecureRegistries), "insecure-registry", "allow plain HTTP or unverified TLS for the given registry host (repeatable)")
+	fs.StringVar(&registryCertsDir, "registry-certs-dir", registryCertsDir, "directory holding per-registry CA and client certificates")
+	fs.Var((*stringsFlag)(&registryMirrors), "registry-mirror", "pull-through mirror URL tried before Docker Hub (repeatable)")
+	fs.BoolVar(&registryRetry.waitOnRateLimit, "wait-on-rate-limit", false, "wait and retry when rate limited by the registry")
+	fs.BoolVar(&quietPull, "quiet", false, "do not report pull progress")
+	fs.IntVar(&maxConcurrentDownloads, "max-concurrent-downloads", maxConcurrentDownloads, "maximum number of layers downloaded at once")
+}
 
-	return nil
+// runOptions holds the options of the commands running containers.
+type runOptions struct {
+	name     string
+	hostname string
+	timezone string
+	pull     string
+	ipc      string
+	uts      string
+	pid      string
+	cgroupns string
+	network  string
+
+	// env are the -e values setting environment variables of containers,
+	// after the ones of the envFiles.
+	env      []string
+	envFiles []string
+
+	// workdir is the working directory of the container process, and user
+	// the <user>[:<group>] it runs as, the ones of the image when empty.
+	workdir string
+	user    string
+
+	// entrypoint overrides the entrypoint of the image when set, empty to
+	// clear it.
+	entrypoint optionalFlag
+
+	// storageDriver names the storage driver creating the root filesystem
+	// of containers, picked from the kernel features when empty.
+	storageDriver string
+
+	// pooled makes containers use a pre-created root filesystem from the
+	// warm pool of the image, when available.
+	pooled bool
+
+	exposedSockets []string
+	listen         []string
+	publish        []string
+	ulimits        []string
+	oomScoreAdj    int
+
+	// capAdd and capDrop change the default capabilities of containers.
+	capAdd  []string
+	capDrop []string
+
+	// securityOpts are <name>=<value> security options of containers, such
+	// as seccomp=unconfined.
+	securityOpts []string
+
+	// devices are the host devices exposed in containers, and gpus their
+	// GPUs.
+	devices []string
+	gpus    string
+
+	// readOnly mounts the root filesystem of containers read-only, and
+	// tmpfs are mounted in containers, as <path>[:<options>] values.
+	readOnly bool
+	tmpfs    []string
+
+	// volumes are the host paths and named volumes bind mounted in
+	// containers, as <host path or volume name>:<container path>[:<options>]
+	// values, and mounts the --mount values.
+	volumes []string
+	mounts  []string
+
+	// egressRate and ingressRate cap the bandwidth of containers, in bytes
+	// per second.
+	egressRate  bytesFlag
+	ingressRate bytesFlag
+
+	// verifyKey is the public key the image signature is checked against
+	// before running it, when set.
+	verifyKey string
+
+	// lockFile, when set, makes containers refuse to run images whose tag
+	// no longer points to the digest recorded in this lock file.
+	lockFile string
+
+	// resources are the resource limits of containers, and cgroup where
+	// their cgroups are created.
+	resources resources
+	cgroup    cgroupPlacement
 }
 
-// Usage: your_docker.sh run <image> <command> <arg1> <arg2> ...
-func main() {
-	image := os.Args[2]
-	command := os.Args[3]
-	args := os.Args[4:len(os.Args)]
+// addRunFlags registers the flags configuring containers.
+func addRunFlags(fs *flag.FlagSet) *runOptions {
+	opts := &runOptions{}
+	fs.StringVar(&opts.name, "name", "", "assign a name to the container")
+	fs.StringVar(&opts.hostname, "hostname", "", "container hostname, defaults to the short container ID")
+	fs.StringVar(&opts.network, "network", networkNone, "network mode (none, host, slirp4netns, container:<name or ID>), containers only have a loopback interface by default")
+	fs.Var((*stringsFlag)(&opts.publish), "publish", "forward [<host ip>:]<host port>:<container port>[/<tcp|udp>] to the container, with the slirp4netns network (repeatable)")
+	fs.Var(&opts.egressRate, "egress-rate", "maximum rate sent by the container per second, e.g. 1m, with the slirp4netns network")
+	fs.Var(&opts.ingressRate, "ingress-rate", "maximum rate received by the container per second, e.g. 1m, with the slirp4netns network")
+	fs.StringVar(&opts.cgroupns, "cgroupns", namespacePrivate, "cgroup namespace mode (private, host)")
+	fs.StringVar(&opts.ipc, "ipc", namespacePrivate, "IPC namespace mode (private, host)")
+	fs.StringVar(&opts.uts, "uts", namespacePrivate, "UTS namespace mode (private, host), containers use the host hostname in the host one")
+	fs.StringVar(&opts.pid, "pid", namespacePrivate, "PID namespace mode (private, host, container:<name or ID>)")
+	addCgroupFlags(fs, &opts.cgroup)
+	fs.Var((*stringsFlag)(&opts.ulimits), "ulimit", "set a resource limit of the container process, as <name>=<soft>[:<hard>], e.g. nofile=65536:65536 (repeatable)")
+	fs.IntVar(&opts.oomScoreAdj, "oom-score-adj", 0, "adjust the OOM killer score of the container process, from -1000 to 1000")
+	fs.Var((*stringsFlag)(&opts.capAdd), "cap-add", "add a Linux capability to the default ones, e.g. NET_ADMIN, or ALL (repeatable)")
+	fs.Var((*stringsFlag)(&opts.capDrop), "cap-drop", "drop a Linux capability from the default ones, e.g. CHOWN, or ALL (repeatable)")
+	fs.Var((*stringsFlag)(&opts.devices), "device", "expose a host device, as <host path>[:<container path>][:<permissions>], permissions being a combination of r, w and m (repeatable)")
+	fs.BoolVar(&opts.readOnly, "read-only", false, "mount the container root filesystem read-only, with writable tmpfs at /tmp and /run")
+	fs.Var((*stringsFlag)(&opts.volumes), "v", "bind mount a host path or a named volume, as <host path or volume name>:<container path>[:ro|rw] (repeatable)")
+	fs.Var((*stringsFlag)(&opts.volumes), "volume", "same as -v")
+	fs.Var((*stringsFlag)(&opts.mounts), "mount", "mount a host path, a named volume or a tmpfs, as type=bind|volume|tmpfs,source=<host path or volume name>,target=<container path>[,readonly][,tmpfs-size=<size>][,tmpfs-mode=<octal mode>] (repeatable)")
+	fs.Var((*stringsFlag)(&opts.tmpfs), "tmpfs", "mount a tmpfs, as <container path>[:<options>], e.g. /scratch:size=256m,mode=1777 (repeatable)")
+	fs.StringVar(&opts.gpus, "gpus", "", "expose GPUs with the NVIDIA Container Toolkit: all, a number of GPUs, or device=<index or UUID>[,...]")
+	fs.Var((*stringsFlag)(&opts.securityOpts), "security-opt", "set a security option, seccomp=<profile.json> filters the system calls with a Docker seccomp profile, seccomp=unconfined disables the filter, label=disable disables SELinux labeling, no-new-privileges prevents gaining privileges through setuid programs (repeatable)")
+	fs.Var(&opts.resources.memory, "memory", "memory limit, e.g. 512m")
+	fs.Var(&opts.resources.memoryHigh, "memory-high", "memory usage above which the container is throttled and its memory reclaimed")
+	fs.Var(&opts.resources.memorySwap, "memory-swap", "memory and swap limit, or -1 for unlimited swap, defaults to twice the memory limit")
+	fs.IntVar(&opts.resources.memorySwappiness, "memory-swappiness", -1, "tendency to swap the container memory out, from 0 to 100")
+	fs.Float64Var(&opts.resources.cpus, "cpus", 0, "number of CPUs the container may use, e.g. 1.5")
+	fs.Int64Var(&opts.resources.cpuQuota, "cpu-quota", 0, "CPU time the container may use per CPU period, in microseconds")
+	fs.Int64Var(&opts.resources.cpuPeriod, "cpu-period", 0, "CPU period of the CPU quota, in microseconds, defaults to 100000")
+	fs.Int64Var(&opts.resources.cpuShares, "cpu-shares", 0, "relative CPU weight of the container, 1024 by default")
+	fs.StringVar(&opts.resources.cpusetCPUs, "cpuset-cpus", "", "CPUs the container may run on, e.g. 0-3,5")
+	fs.StringVar(&opts.resources.cpusetMems, "cpuset-mems", "", "memory nodes the container may allocate memory on, e.g. 0,1")
+	fs.Var((*stringsFlag)(&opts.resources.deviceReadBps), "device-read-bps", "limit reads from the block device to <device path>:<rate>, e.g. /dev/sda:1mb (repeatable)")
+	fs.Var((*stringsFlag)(&opts.resources.deviceWriteBps), "device-write-bps", "limit writes to the block device to <device path>:<rate>, e.g. /dev/sda:1mb (repeatable)")
+	fs.IntVar(&opts.resources.blkioWeight, "blkio-weight", 0, "relative block I/O weight of the container, from 10 to 1000")
+	fs.Int64Var(&opts.resources.pidsLimit, "pids-limit", 0, "maximum number of processes of the container, unlimited when 0 or less")
+	fs.Var((*stringsFlag)(&opts.env), "e", "set an environment variable of the container process, as <name>=<value>, or <name> to pass the host one through (repeatable)")
+	fs.Var((*stringsFlag)(&opts.env), "env", "same as -e")
+	fs.Var((*stringsFlag)(&opts.envFiles), "env-file", "read environment variables from a file of <name>=<value> or <name> lines, overridden by -e (repeatable)")
+	fs.StringVar(&opts.workdir, "w", "", "working directory of the container process, created when missing, defaults to the one of the image or /")
+	fs.StringVar(&opts.workdir, "workdir", "", "same as -w")
+	fs.Var(&opts.entrypoint, "entrypoint", "override the entrypoint of the image, an empty one clearing it, which also clears the command of the image")
+	fs.StringVar(&opts.user, "u", "", "run the container process as <user>[:<group>], names or numeric ids, defaults to the user of the image or root")
+	fs.StringVar(&opts.user, "user", "", "same as -u")
+	fs.StringVar(&opts.timezone, "timezone", "", "container timezone, defaults to the host timezone")
+	fs.StringVar(&opts.pull, "pull", pullMissing, "pull image before running (always, missing, never)")
+	fs.StringVar(&opts.storageDriver, "storage-driver", "", "storage driver creating the container root filesystem (vfs, overlay2, fuse-overlayfs), defaults to overlay2 when supported, or fuse-overlayfs for rootless containers")
+	fs.StringVar(&opts.lockFile, "lock-file", "", "refuse to run images whose tag changed since recorded in this lock file")
+	fs.StringVar(&opts.verifyKey, "verify-key", "", "refuse to run images without a valid cosign signature made with this PEM public key")
+	fs.Var((*stringsFlag)(&opts.exposedSockets), "expose-socket", "bind mount the host unix socket <host socket>[:<container path>] (repeatable)")
+	fs.Var((*stringsFlag)(&opts.listen), "listen", "pass a socket listening on [unix:|tcp:]<address> to the container process, as with systemd socket activation (repeatable)")
+	addRegistryFlags(fs)
+	addStoreFlags(fs)
+	addDecryptionFlags(fs)
+
+	return opts
+}
 
-	chrootRoot, err := ioutil.TempDir("", "docker")
-	if err != nil {
-		panic(err)
+// Usage: your_docker.sh run [options] <image> [<command> <arg1> <arg2> ...]
+func runCmd(argv []string) error {
+	runFlags := newFlagSet("run", "[options] <image> [<command> <arg1> <arg2> ...]")
+	opts := addRunFlags(runFlags)
+	var watchSpecs []string
+	runFlags.Var((*stringsFlag)(&watchSpecs), "watch", "bind mount <host path>:<container path> and restart the command when it changes (repeatable)")
+	dryRun := runFlags.Bool("dry-run", false, "print what running the container would do, without doing it")
+	_ = runFlags.Parse(argv)
+
+	if runFlags.NArg() < 1 {
+		runFlags.Usage()
+		os.Exit(2)
+	}
+
+	image := runFlags.Arg(0)
+	args := runFlags.Args()[1:]
+
+	var watches []bindMount
+	for _, spec := range watchSpecs {
+		watch, err := parseWatchMount(spec)
+		if err != nil {
+			return err
+		}
+		watches = append(watches, watch)
 	}
-	defer os.RemoveAll(chrootRoot)
 
-	token, err := registryLogin(image)
+	if *dryRun {
+		return printRunPlan(image, args, opts, watches)
+	}
+
+	c, err := createContainer(image, opts)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer c.remove()
 
-	manifest, err := fetchManifest(token, image)
+	command, err := commandLine(c.entrypoint, c.cmd, args)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	for _, layer := range manifest.Layers {
-		if err := extractLayer(token, image, layer.Digest, chrootRoot); err != nil {
-			panic(err)
-		}
+	newCmd := func() *exec.Cmd {
+		cmd := c.command(command[0], command[1:])
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd
 	}
 
-	cmd := exec.Command(command, args...)
-	cmd.Stdin = nullReader{}
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Chroot:     chrootRoot,
-		Cloneflags: syscall.CLONE_NEWPID,
+	if len(watches) > 0 {
+		unmount, err := mountBinds(c.rootDir, watches)
+		if err != nil {
+			return err
+		}
+		defer unmount()
+
+		if err := runWatched(newCmd, c.start, watches); err != nil {
+			return err
+		}
+		return nil
 	}
 
-	if err := cmd.Run(); err != nil {
+	err = c.run(newCmd())
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
 		fmt.Printf("%s\n", err.Error())
+		if c.oomKilled() {
+			fmt.Fprintf(os.Stderr, "container %s was killed by the OOM killer, as it exceeded its memory limit\n", shortID(c.id))
+		}
+
+		// os.Exit does not run the deferred calls.
+		c.remove()
+		os.Exit(exitErr.ExitCode())
+	}
+
+	return err
+}
+
+// commands are the top-level commands of the CLI.
+var commands = []command{
+	{"run", "Run a command in a new container", runCmd},
+	{"job", "Run a batch job and collect its outputs", jobCmd},
+	{"pool", "Manage pools of containers ready to run", poolCmd},
+	{"pull", "Pull an image from a registry", pullCmd},
+	{"push", "Push an image to a registry", pushCmd},
+	{"copy", "Copy an image between registries", copyCmd},
+	{"save", "Save images to a tarball", saveCmd},
+	{"load", "Load images from a tarball", loadCmd},
+	{"import", "Create an image from a root filesystem tarball", importCmd},
+	{"image", "Manage local images", imageCmd},
+	{"manifest", "Inspect image manifests", manifestCmd},
+	{"artifact", "Pull artifacts referring to an image", artifactCmd},
+	{"tags", "List the tags of a repository", tagsCmd},
+	{"search", "Search images in the index", searchCmd},
+	{"sbom", "Generate the software bill of materials of an image", sbomCmd},
+	{"lock", "Pin image tags to their digests", lockCmd},
+	{"stats", "Show the resource usage of containers", statsCmd},
+	{"volume", "Manage volumes", volumeCmd},
+	{"self-update", "Update to the latest release", selfUpdateCmd},
+	{initCommand, "", initCmd},
+}
+
+// Usage: your_docker.sh <command> [options] <args>...
+func main() {
+	if len(os.Args) < 2 {
+		_ = dispatch("", commands, nil)
+	}
 
+	// Non-root users run containers as root of a user namespace of their
+	// own.
+	if os.Getenv(rootlessEnv) == rootlessMapping {
+		if err := waitIDMappings(); err != nil {
+			fatal(err)
+		}
+	} else if os.Getenv(rootlessEnv) == "" && os.Geteuid() != 0 && rootlessCommands[os.Args[1]] {
+		err := runRootless(os.Args[1:])
 		var exitErr *exec.ExitError
-		if ok := errors.As(err, &exitErr); ok {
+		if errors.As(err, &exitErr) {
 			os.Exit(exitErr.ExitCode())
+		} else if err != nil {
+			fatal(err)
 		}
+		return
+	}
+
+	if err := dispatch("", commands, os.Args[1:]); err != nil {
+		fatal(err)
 	}
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// manifestIndex is a multi-platform image, listing the manifest of each
+// platform.
+type manifestIndex struct {
+	SchemaVersion int               `json:"schemaVersion,omitempty"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []indexedManifest `json:"manifests"`
+}
+
+type indexedManifest struct {
+	MediaType    string `json:"mediaType,omitempty"`
+	ArtifactType string `json:"artifactType,omitempty"`
+	Size         int64  `json:"size"`
+	Digest       string `json:"digest"`
+	Platform     struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant,omitempty"`
+	} `json:"platform"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// platform returns the platform of the manifest, as <os>/<arch>[/<variant>].
+func (m indexedManifest) platform() string {
+	p := m.Platform.OS + "/" + m.Platform.Architecture
+	if m.Platform.Variant != "" {
+		p += "/" + m.Platform.Variant
+	}
+
+	return p
+}
+
+// Usage: your_docker.sh manifest <command> [options] <args>...
+func manifestCmd(argv []string) error {
+	return dispatch("manifest", []command{
+		{"inspect", "Show the manifest of an image", manifestInspectCmd},
+	}, argv)
+}
+
+// Usage: your_docker.sh manifest inspect [--raw] [options] <image>
+func manifestInspectCmd(argv []string) error {
+	inspectFlags := newFlagSet("manifest inspect", "[--raw] [options] <image>")
+	addRegistryFlags(inspectFlags)
+	raw := inspectFlags.Bool("raw", false, "print the manifest as served by the registry")
+	referrers := inspectFlags.Bool("referrers", false, "also list the artifacts attached to the image, such as signatures and SBOMs")
+	_ = inspectFlags.Parse(argv)
+
+	if inspectFlags.NArg() != 1 {
+		inspectFlags.Usage()
+		os.Exit(2)
+	}
+
+	ref, err := parseReference(inspectFlags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	r, err := registryLogin(ref)
+	if err != nil {
+		return err
+	}
+
+	data, mediaType, err := r.fetchRawManifest(mediaTypeOCIIndex, mediaTypeDockerManifestList, mediaTypeOCIManifest, mediaTypeDockerManifest)
+	if err != nil {
+		return err
+	}
+
+	if *raw {
+		_, _ = os.Stdout.Write(data)
+		return nil
+	}
+
+	if err := printManifest(ref, data, mediaType); err != nil {
+		return err
+	}
+
+	if *referrers {
+		if err := printReferrers(r, fmt.Sprintf("sha256:%x", sha256.Sum256(data))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// printManifest prints a summary of the manifest or index: the platforms of
+// an index, or the config and layers of a manifest.
+func printManifest(ref reference, data []byte, mediaType string) error {
+	var header struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+	if header.MediaType != "" {
+		mediaType = header.MediaType
+	}
+
+	fmt.Printf("Name:      %s\n", ref)
+	fmt.Printf("MediaType: %s\n", mediaType)
+	fmt.Printf("Digest:    sha256:%x\n", sha256.Sum256(data))
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	if header.Manifests != nil {
+		var index manifestIndex
+		if err := json.Unmarshal(data, &index); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(w, "PLATFORM\tDIGEST\tSIZE\tMEDIA TYPE")
+		for _, m := range index.Manifests {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", m.platform(), m.Digest, formatBytes(m.Size), m.MediaType)
+		}
+
+		return w.Flush()
+	}
+
+	var manifest manifestResponse
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return err
+	}
+
+	total := manifest.Config.Size
+	fmt.Fprintln(w, "TYPE\tDIGEST\tSIZE\tMEDIA TYPE")
+	fmt.Fprintf(w, "config\t%s\t%s\t%s\n", manifest.Config.Digest, formatBytes(manifest.Config.Size), manifest.Config.MediaType)
+	for _, l := range manifest.Layers {
+		fmt.Fprintf(w, "layer\t%s\t%s\t%s\n", l.Digest, formatBytes(l.Size), l.MediaType)
+		total += l.Size
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nTotal size: %s\n", formatBytes(total))
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// registryMirrors lists the pull-through mirrors of Docker Hub, such as
+// https://mirror.gcr.io, tried in order before Docker Hub itself.
+var registryMirrors []string
+
+// openRepository connects to the registry serving the reference and fetches
+// the image manifest. Docker Hub images are looked up in the registry
+// mirrors first, falling back to Docker Hub when a mirror misses or errors.
+func openRepository(ref reference) (*registry, manifestResponse, error) {
+	if ref.registry == dockerHubRegistry {
+		for _, mirror := range registryMirrors {
+			r, manifest, err := openMirror(ref, mirror)
+			if err == nil {
+				return r, manifest, nil
+			}
+
+			fmt.Fprintf(os.Stderr, "registry mirror %s: %s, falling back\n", mirror, err)
+		}
+	}
+
+	r, err := registryLogin(ref)
+	if err != nil {
+		return nil, manifestResponse{}, err
+	}
+
+	manifest, err := r.fetchManifest()
+	if err != nil {
+		return nil, manifestResponse{}, err
+	}
+
+	return r, manifest, nil
+}
+
+func openMirror(ref reference, mirror string) (*registry, manifestResponse, error) {
+	u, err := url.Parse(mirror)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, manifestResponse{}, fmt.Errorf("invalid mirror URL %q", mirror)
+	}
+
+	r, err := connectRegistry(ref, u.Scheme, u.Host, "pull")
+	if err != nil {
+		return nil, manifestResponse{}, err
+	}
+	r.mirror = true
+
+	manifest, err := r.fetchManifest()
+	if err != nil {
+		return nil, manifestResponse{}, err
+	}
+
+	return r, manifest, nil
+}
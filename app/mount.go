@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// mountPropagations are the mount flags of the propagation of bind mounts:
+// whether mounts made under the host path, and under the container path of
+// the bind mounts of a same host path, show in the container, and in others.
+// Mounts never propagate from the container to the host.
+var mountPropagations = map[string]uintptr{
+	"private":  syscall.MS_PRIVATE,
+	"rprivate": syscall.MS_PRIVATE | syscall.MS_REC,
+	"slave":    syscall.MS_SLAVE,
+	"rslave":   syscall.MS_SLAVE | syscall.MS_REC,
+	"shared":   syscall.MS_SHARED,
+	"rshared":  syscall.MS_SHARED | syscall.MS_REC,
+}
+
+// bindMount is a host path, or a named volume, bind mounted in the container.
+// The host path of volumes is only known once they are used. propagation is
+// one of mountPropagations, rprivate when empty, and noCopy keeps empty
+// volumes from being populated from the image.
+type bindMount struct {
+	hostPath      string
+	containerPath string
+	readOnly      bool
+	propagation   string
+	volume        string
+	noCopy        bool
+}
+
+// parseVolume parses a <host path or volume name>:<container path>[:<options>]
+// value, the comma separated options being ro or rw, the default, a
+// propagation of host paths, and nocopy for volumes. Missing host paths are
+// created as directories when the container is created, as with Docker, and
+// missing volumes created when used.
+func parseVolume(spec string) (bindMount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return bindMount{}, fmt.Errorf("invalid volume %q: expected <host path or volume name>:<container path>[:<options>]", spec)
+	}
+
+	m := bindMount{containerPath: parts[1]}
+	switch {
+	case filepath.IsAbs(parts[0]):
+		m.hostPath = filepath.Clean(parts[0])
+	case validName.MatchString(parts[0]):
+		m.volume = parts[0]
+	default:
+		return bindMount{}, fmt.Errorf("invalid volume %q: volume names may only contain [a-zA-Z0-9][a-zA-Z0-9_.-], use an absolute path for host directories", spec)
+	}
+	if !filepath.IsAbs(m.containerPath) || filepath.Clean(m.containerPath) == "/" {
+		return bindMount{}, fmt.Errorf("invalid volume %q: the container path must be absolute, and not /", spec)
+	}
+	m.containerPath = filepath.Clean(m.containerPath)
+
+	if len(parts) == 3 {
+		for _, option := range strings.Split(parts[2], ",") {
+			switch option {
+			case "ro":
+				m.readOnly = true
+			case "rw":
+				m.readOnly = false
+			case "nocopy":
+				m.noCopy = true
+			default:
+				if _, ok := mountPropagations[option]; !ok {
+					return bindMount{}, fmt.Errorf("invalid volume %q: unknown option %q", spec, option)
+				}
+				m.propagation = option
+			}
+		}
+	}
+
+	if err := m.validate(); err != nil {
+		return bindMount{}, fmt.Errorf("invalid volume %q: %w", spec, err)
+	}
+	return m, nil
+}
+
+// validate checks the options of the bind mount apply to its source.
+func (m bindMount) validate() error {
+	if m.volume != "" && m.propagation != "" {
+		return fmt.Errorf("propagation is only supported for host paths")
+	}
+	if m.volume == "" && m.noCopy {
+		return fmt.Errorf("nocopy is only supported for volumes")
+	}
+	return nil
+}
+
+// Mount types of --mount values.
+const (
+	mountTypeBind   = "bind"
+	mountTypeVolume = "volume"
+	mountTypeTmpfs  = "tmpfs"
+)
+
+// mountSpec is a parsed --mount value: a bind mount, of a host path or a
+// volume, or a tmpfs as a --tmpfs value.
+type mountSpec struct {
+	kind  string
+	bind  bindMount
+	tmpfs string
+}
+
+// parseMount parses a --mount value: comma separated <key>=<value> fields, as
+// with Docker. The type is bind, the default, volume or tmpfs, the source the
+// host path of bind mounts, which must exist, or the volume name, and the
+// target the container path. Bind mounts take a bind-propagation, volumes
+// volume-nocopy.
+// Mounts are read-only with readonly or ro, and tmpfs take a tmpfs-size and an
+// octal tmpfs-mode.
+func parseMount(spec string) (mountSpec, error) {
+	m := mountSpec{kind: mountTypeBind}
+	var source, target string
+	var readOnly, noCopy bool
+	var propagation string
+	var size int64
+	var mode uint64
+	for _, field := range strings.Split(spec, ",") {
+		key, value := field, ""
+		hasValue := false
+		if i := strings.Index(field, "="); i >= 0 {
+			key, value, hasValue = field[:i], field[i+1:], true
+		}
+
+		var err error
+		switch strings.ToLower(key) {
+		case "type":
+			m.kind = value
+		case "source", "src":
+			source = value
+		case "target", "destination", "dst":
+			target = value
+		case "readonly", "ro":
+			readOnly = true
+			if hasValue {
+				readOnly, err = strconv.ParseBool(value)
+			}
+		case "bind-propagation":
+			propagation = value
+			if _, ok := mountPropagations[value]; !ok {
+				err = fmt.Errorf("unknown propagation")
+			}
+		case "volume-nocopy":
+			noCopy = true
+			if hasValue {
+				noCopy, err = strconv.ParseBool(value)
+			}
+		case "tmpfs-size":
+			size, err = parseBytes(value)
+		case "tmpfs-mode":
+			mode, err = strconv.ParseUint(value, 8, 32)
+		case "consistency":
+			// Only relevant on macOS, as with Docker.
+		default:
+			return mountSpec{}, fmt.Errorf("invalid mount %q: unknown field %q", spec, key)
+		}
+		if err != nil {
+			return mountSpec{}, fmt.Errorf("invalid mount %q: invalid %s %q", spec, key, value)
+		}
+	}
+
+	if target == "" {
+		return mountSpec{}, fmt.Errorf("invalid mount %q: the target is required", spec)
+	}
+	if (size > 0 || mode > 0) && m.kind != mountTypeTmpfs {
+		return mountSpec{}, fmt.Errorf("invalid mount %q: tmpfs options are only allowed for tmpfs mounts", spec)
+	}
+	if propagation != "" && m.kind != mountTypeBind {
+		return mountSpec{}, fmt.Errorf("invalid mount %q: bind options are only allowed for bind mounts", spec)
+	}
+	if noCopy && m.kind != mountTypeVolume {
+		return mountSpec{}, fmt.Errorf("invalid mount %q: volume options are only allowed for volume mounts", spec)
+	}
+
+	switch m.kind {
+	case mountTypeBind, mountTypeVolume:
+		if source == "" {
+			return mountSpec{}, fmt.Errorf("invalid mount %q: the source is required for %s mounts", spec, m.kind)
+		}
+		if m.kind == mountTypeBind && !filepath.IsAbs(source) {
+			return mountSpec{}, fmt.Errorf("invalid mount %q: the source of bind mounts must be absolute", spec)
+		}
+		if m.kind == mountTypeVolume && filepath.IsAbs(source) {
+			return mountSpec{}, fmt.Errorf("invalid mount %q: the source of volume mounts must be a volume name", spec)
+		}
+		var err error
+		if m.bind, err = parseVolume(source + ":" + target); err != nil {
+			return mountSpec{}, err
+		}
+		if m.kind == mountTypeBind {
+			if _, err := os.Stat(m.bind.hostPath); err != nil {
+				return mountSpec{}, fmt.Errorf("invalid mount %q: the source %s does not exist", spec, m.bind.hostPath)
+			}
+		}
+		m.bind.readOnly, m.bind.propagation, m.bind.noCopy = readOnly, propagation, noCopy
+	case mountTypeTmpfs:
+		if source != "" {
+			return mountSpec{}, fmt.Errorf("invalid mount %q: tmpfs mounts have no source", spec)
+		}
+		var options []string
+		if readOnly {
+			options = append(options, "ro")
+		}
+		if size > 0 {
+			options = append(options, "size="+strconv.FormatInt(size, 10))
+		}
+		if mode > 0 {
+			options = append(options, "mode="+strconv.FormatUint(mode, 8))
+		}
+		m.tmpfs = target + ":" + strings.Join(options, ",")
+		if _, err := parseTmpfs(m.tmpfs); err != nil {
+			return mountSpec{}, err
+		}
+	default:
+		return mountSpec{}, fmt.Errorf("invalid mount %q: unknown type %q, expected %s, %s or %s", spec, m.kind, mountTypeBind, mountTypeVolume, mountTypeTmpfs)
+	}
+
+	return m, nil
+}
+
+// String returns the bind mount of the host path as a volume, parsed by
+// parseVolume.
+func (m bindMount) String() string {
+	var options []string
+	if m.readOnly {
+		options = append(options, "ro")
+	}
+	if m.propagation != "" {
+		options = append(options, m.propagation)
+	}
+
+	if len(options) == 0 {
+		return m.hostPath + ":" + m.containerPath
+	}
+	return m.hostPath + ":" + m.containerPath + ":" + strings.Join(options, ",")
+}
+
+// rootPropagation returns the propagation of the container mounts, given its
+// volumes: mounts are private, unless bind mounts receive the mounts made
+// under their host path, which then propagate to the container as a slave.
+func rootPropagation(volumes []string) (uintptr, error) {
+	for _, spec := range volumes {
+		m, err := parseVolume(spec)
+		if err != nil {
+			return 0, err
+		}
+		if m.propagation != "" && mountPropagations[m.propagation]&syscall.MS_PRIVATE == 0 {
+			return syscall.MS_SLAVE, nil
+		}
+	}
+	return syscall.MS_PRIVATE, nil
+}
+
+// containerMount is a tmpfs or bind mount set up in the container.
+type containerMount struct {
+	target string
+	mount  func() error
+}
+
+// userMounts returns the tmpfs, as --tmpfs values, and the bind mounts, as
+// volumes, of the container, with the SELinux mount label if set. They are
+// sorted by depth of their container path, so that mounts nested in others
+// are mounted last instead of hidden.
+func userMounts(tmpfs, volumes []string, label string) ([]containerMount, error) {
+	var mounts []containerMount
+	for _, spec := range tmpfs {
+		m, err := parseTmpfs(spec)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, containerMount{target: m.target, mount: func() error {
+			return mountTmpfs(m.target, m.flags, labelData(m.data, label))
+		}})
+	}
+	for _, spec := range volumes {
+		m, err := parseVolume(spec)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, containerMount{target: m.containerPath, mount: func() error {
+			return mountVolume(m)
+		}})
+	}
+
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return strings.Count(mounts[i].target, "/") < strings.Count(mounts[j].target, "/")
+	})
+	return mounts, nil
+}
+
+// mountVolume bind mounts the host path, found under the host root until
+// detached, at the container path. The container path is created as the
+// host one, a directory or an empty file, if missing.
+func mountVolume(m bindMount) error {
+	hostPath := filepath.Join(hostRoot, m.hostPath)
+	info, err := os.Stat(hostPath)
+	if err != nil {
+		return fmt.Errorf("failed to mount %s: %w", m.hostPath, err)
+	}
+
+	target, err := containerTarget(m.containerPath)
+	if err != nil {
+		return fmt.Errorf("failed to mount %s: %w", m.hostPath, err)
+	}
+
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+		if _, err = os.Lstat(target); os.IsNotExist(err) {
+			err = ioutil.WriteFile(target, nil, 0644)
+		}
+	}
+	if err == nil {
+		err = syscall.Mount(hostPath, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+	}
+	if err == nil {
+		propagation := m.propagation
+		if propagation == "" {
+			propagation = "rprivate"
+		}
+		err = syscall.Mount("", target, "", mountPropagations[propagation], "")
+	}
+	if err == nil && m.readOnly {
+		err = remountReadOnly(target)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mount %s at %s: %w", m.hostPath, m.containerPath, err)
+	}
+
+	return nil
+}
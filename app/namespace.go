@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// namespaceContainer prefixes the name or ID of the container whose
+// namespace is joined, as in --pid container:<name>.
+const namespaceContainer = "container:"
+
+// sysPidfdOpen is the pidfd_open system call, numbered the same on all
+// architectures, missing from the syscall package.
+const sysPidfdOpen = 434
+
+// namespaceJoin is a namespace of another container, by name or ID, joined by
+// the container process.
+type namespaceJoin struct {
+	container string
+	flag      uintptr
+}
+
+// namespaceJoins returns the namespaces of other containers the options join.
+func namespaceJoins(opts *runOptions) []namespaceJoin {
+	var joins []namespaceJoin
+	if strings.HasPrefix(opts.pid, namespaceContainer) {
+		joins = append(joins, namespaceJoin{container: strings.TrimPrefix(opts.pid, namespaceContainer), flag: syscall.CLONE_NEWPID})
+	}
+	if strings.HasPrefix(opts.network, namespaceContainer) {
+		joins = append(joins, namespaceJoin{container: strings.TrimPrefix(opts.network, namespaceContainer), flag: syscall.CLONE_NEWNET})
+	}
+	return joins
+}
+
+// startInNamespaces starts the command in the namespaces of the processes of
+// the containers, by ID, joined through their pidfd. The namespaces are
+// joined by a thread of its own, which exits once the command started, so
+// that no other process starts in them.
+func startInNamespaces(cmd *exec.Cmd, ids *identities, joins []namespaceJoin) error {
+	if len(joins) == 0 {
+		return cmd.Start()
+	}
+
+	setns, ok := syscallNumbers["setns"]
+	if !ok {
+		return fmt.Errorf("joining the namespaces of containers is not supported on this architecture")
+	}
+
+	var fds []int
+	defer func() {
+		for _, fd := range fds {
+			_ = syscall.Close(fd)
+		}
+	}()
+	for _, j := range joins {
+		pid, err := ids.containerPID(j.container)
+		if err != nil {
+			return err
+		}
+
+		fd, _, errno := syscall.Syscall(sysPidfdOpen, uintptr(pid), 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("failed to open container %s: %w", shortID(j.container), errno)
+		}
+		fds = append(fds, int(fd))
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		// The thread is left locked, so that it exits with the goroutine.
+		runtime.LockOSThread()
+
+		for i, j := range joins {
+			if _, _, errno := syscall.Syscall(uintptr(setns), uintptr(fds[i]), j.flag, 0); errno != 0 {
+				errs <- fmt.Errorf("failed to join the namespaces of container %s: %w", shortID(j.container), errno)
+				return
+			}
+		}
+		errs <- cmd.Start()
+	}()
+
+	return <-errs
+}
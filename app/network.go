@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// networkNone is the network mode of containers in a network namespace of
+// their own, with only a loopback interface.
+const networkNone = "none"
+
+// defaultHosts are the /etc/hosts entries of every container, before the
+// container hostname.
+const defaultHosts = `127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+fe00::0	ip6-localnet
+ff00::0	ip6-mcastprefix
+ff02::1	ip6-allnodes
+ff02::2	ip6-allrouters
+`
+
+// hostResolvConf is the resolver configuration of the host. When it points to
+// the local systemd-resolved stub, the configuration of the upstream servers
+// is used instead, as containers cannot reach the stub.
+func hostResolvConf() ([]byte, error) {
+	data, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Contains(data, []byte("nameserver 127.0.0.53")) {
+		if upstream, err := ioutil.ReadFile("/run/systemd/resolve/resolv.conf"); err == nil {
+			return upstream, nil
+		}
+	}
+
+	return data, nil
+}
+
+// setupNameFiles writes the container /etc/hostname, /etc/hosts and
+// /etc/resolv.conf, so that the container can resolve its own name and the
+// ones of the host network. With slirp4netns, names are resolved by its DNS
+// forwarder, and containers sharing the network of another one use its
+// resolver configuration, read from the root of its process.
+func setupNameFiles(rootDir, hostname, network string, pid int) error {
+	var resolvConf []byte
+	var err error
+	switch {
+	case network == networkSlirp:
+		resolvConf = []byte("nameserver " + slirpDNS + "\n")
+	case strings.HasPrefix(network, namespaceContainer):
+		resolvConf, err = ioutil.ReadFile(fmt.Sprintf("/proc/%d/root/etc/resolv.conf", pid))
+	default:
+		resolvConf, err = hostResolvConf()
+	}
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"/etc/hostname", []byte(hostname + "\n")},
+		{"/etc/hosts", []byte(fmt.Sprintf("%s127.0.1.1\t%s\n", defaultHosts, hostname))},
+		{"/etc/resolv.conf", resolvConf},
+	}
+
+	for _, f := range files {
+		path, err := resolvePath(rootDir, f.name)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		// Images may ship these files as symlinks, e.g. to the host
+		// resolver configuration, which must not be followed.
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err := ioutil.WriteFile(path, f.data, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ifreqFlags is the struct ifreq of the interface flags ioctl requests.
+type ifreqFlags struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// loopbackUp brings the loopback interface of the current network namespace
+// up, as new namespaces have it down.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var req ifreqFlags
+	req.name[0] = 'l'
+	req.name[1] = 'o'
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return fmt.Errorf("failed to get the loopback interface flags: %w", errno)
+	}
+
+	req.flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return fmt.Errorf("failed to bring the loopback interface up: %w", errno)
+	}
+
+	return nil
+}
+
+// limitBandwidth caps the rates in bytes per second at which the network
+// interface of the current network namespace sends and receives, with the tc
+// program of the host. Zero rates are unlimited.
+func limitBandwidth(device string, egress, ingress int64) error {
+	var commands [][]string
+
+	// Sent packets are shaped by a token bucket, and received ones are
+	// dropped above the rate, as they cannot be queued.
+	if egress > 0 {
+		commands = append(commands, []string{"qdisc", "add", "dev", device, "root", "tbf", "rate", rateBps(egress), "burst", burstSize(egress), "latency", "50ms"})
+	}
+	if ingress > 0 {
+		commands = append(commands,
+			[]string{"qdisc", "add", "dev", device, "handle", "ffff:", "ingress"},
+			[]string{"filter", "add", "dev", device, "parent", "ffff:", "protocol", "all", "u32", "match", "u32", "0", "0", "police", "rate", rateBps(ingress), "burst", burstSize(ingress), "drop"},
+		)
+	}
+
+	for _, args := range commands {
+		out, err := exec.Command("tc", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to limit the %s bandwidth: tc %s: %w: %s", device, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	return nil
+}
+
+// rateBps formats a rate in bytes per second for tc.
+func rateBps(rate int64) string {
+	return strconv.FormatInt(rate, 10) + "bps"
+}
+
+// burstSize returns the bucket size of a rate: a tenth of a second of
+// traffic, and at least two packets of the slirp4netns MTU.
+func burstSize(rate int64) string {
+	burst := rate / 10
+	if burst < 2*slirpMTU {
+		burst = 2 * slirpMTU
+	}
+	return strconv.FormatInt(burst, 10)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// overlayOpaqueXattr marks an overlayfs directory as opaque, hiding the
+// content of the same directory in lower layers.
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+// overlayDriver unpacks each layer once in the store, and mounts the root
+// filesystem of containers as an overlay of them, with a writable upper
+// directory of their own.
+type overlayDriver struct{}
+
+func (overlayDriver) unpack(s *store, l layer, dir string) error {
+	return s.unpackLayer(l, overlayWhiteouts)
+}
+
+func (overlayDriver) mount(s *store, manifest manifestResponse, dir, label string) (string, func(), error) {
+	return mountOverlay(s, manifest, dir, label, overlayWhiteouts, func(rootDir, options string) error {
+		return syscall.Mount("overlay", rootDir, "overlay", 0, options)
+	})
+}
+
+// overlayWhiteout converts the whiteout file named base in dir to the
+// overlayfs format: a 0/0 character device hides the lower file, and the
+// opaque attribute hides the lower directory content.
+func overlayWhiteout(dir, base string) error {
+	if base == whiteoutOpaque {
+		return lsetxattr(dir, overlayOpaqueXattr, []byte("y"))
+	}
+
+	return syscall.Mknod(filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), syscall.S_IFCHR, 0)
+}
+
+// layerDir returns the directory the layer is unpacked in with the whiteout
+// format, to be used as an overlay lower directory.
+func (s *store) layerDir(digest string, whiteouts whiteoutFormat) string {
+	dir := "layers"
+	if whiteouts == keepWhiteouts {
+		dir = "fuse-layers"
+	}
+
+	return filepath.Join(s.root, dir, strings.TrimPrefix(digest, "sha256:"))
+}
+
+// unpackLayer unpacks the stored layer in its own directory, with the given
+// whiteout format, unless already done. Layers are unpacked in a temporary
+// directory first, so that a layer directory is always complete.
+func (s *store) unpackLayer(l layer, whiteouts whiteoutFormat) error {
+	dir := s.layerDir(l.Digest, whiteouts)
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	// The root directory of the container gets the mode of the top layer
+	// directory, which may not be in the layer.
+	err = os.Chmod(tmp, 0755)
+	if err == nil {
+		err = extractLayer(s.blobPath(l.Digest), l, tmp, whiteouts)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dir)
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+
+		// Unpacked by another container in the meantime.
+		if _, serr := os.Stat(dir); serr == nil {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// mountOverlay assembles the root filesystem of a container in dir, as an
+// overlay of the image layers unpacked with the whiteout format, with a
+// writable upper directory. The overlay is mounted by calling mount with its
+// options. It returns the root directory, and a function unmounting it and
+// removing dir.
+func mountOverlay(s *store, manifest manifestResponse, dir, label string, whiteouts whiteoutFormat, mount func(rootDir, options string) error) (string, func(), error) {
+	upper := filepath.Join(dir, "upper")
+	work := filepath.Join(dir, "work")
+	rootDir := filepath.Join(dir, "rootfs")
+	for _, d := range []string{upper, work, rootDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// Lower directories are listed from the top layer down. Images without
+	// layers get an empty one, as overlayfs requires one.
+	var lowers []string
+	for i := len(manifest.Layers) - 1; i >= 0; i-- {
+		lowers = append(lowers, s.layerDir(manifest.Layers[i].Digest, whiteouts))
+	}
+	if len(lowers) == 0 {
+		empty := filepath.Join(dir, "empty")
+		if err := os.Mkdir(empty, 0755); err != nil {
+			return "", nil, err
+		}
+		lowers = append(lowers, empty)
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowers, ":"), upper, work)
+	// The layers are shared between containers: the label applies to the
+	// mount, not to their files.
+	if label != "" {
+		options += "," + contextOption(label)
+	}
+	if len(options) >= os.Getpagesize() {
+		return "", nil, fmt.Errorf("too many layers (%d) to mount as an overlay", len(manifest.Layers))
+	}
+
+	if err := mount(rootDir, options); err != nil {
+		return "", nil, fmt.Errorf("failed to mount overlay: %w", err)
+	}
+
+	unmount := func() {
+		if err := syscall.Unmount(rootDir, syscall.MNT_DETACH); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to unmount %s: %s\n", rootDir, err)
+			return
+		}
+		_ = os.RemoveAll(dir)
+	}
+
+	return rootDir, unmount, nil
+}
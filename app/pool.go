@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The warm pool keeps root filesystems of images extracted ahead of time, so
+// that containers can start without waiting for layer extraction. Ready root
+// filesystems live under pool/<manifest digest>/<id>, and are claimed by
+// renaming them, which is atomic.
+
+// Usage: your_docker.sh pool <command> [options] <args>...
+func poolCmd(argv []string) error {
+	return dispatch("pool", []command{
+		{"fill", "Fill the pool of an image", poolFillCmd},
+		{"acquire", "Run a command in a container of the pool", poolAcquireCmd},
+		{"ls", "List the pools", poolLsCmd},
+		{"drain", "Remove the containers of a pool", poolDrainCmd},
+	}, argv)
+}
+
+// Usage: your_docker.sh pool fill [options] --size <n> <image>
+func poolFillCmd(argv []string) error {
+	fillFlags := newFlagSet("pool fill", "[options] --size <n> <image>")
+	addStoreFlags(fillFlags)
+	addRegistryFlags(fillFlags)
+	addDecryptionFlags(fillFlags)
+	size := fillFlags.Int("size", 1, "number of containers to keep ready")
+	pull := fillFlags.String("pull", pullMissing, "pull image before filling the pool (always, missing, never)")
+	_ = fillFlags.Parse(argv)
+
+	if fillFlags.NArg() != 1 || *size < 0 {
+		fillFlags.Usage()
+		os.Exit(2)
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := openImage(s, fillFlags.Arg(0), *pull)
+	if err != nil {
+		return err
+	}
+
+	if err := fillPool(s, manifest, *size); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Usage: your_docker.sh pool acquire [options] <image> [<command> <arg1> <arg2> ...]
+func poolAcquireCmd(argv []string) error {
+	acquireFlags := newFlagSet("pool acquire", "[options] <image> [<command> <arg1> <arg2> ...]")
+	opts := addRunFlags(acquireFlags)
+	_ = acquireFlags.Parse(argv)
+
+	if acquireFlags.NArg() < 1 {
+		acquireFlags.Usage()
+		os.Exit(2)
+	}
+	opts.pooled = true
+
+	c, err := createContainer(acquireFlags.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+
+	command, err := commandLine(c.entrypoint, c.cmd, acquireFlags.Args()[1:])
+	if err != nil {
+		c.remove()
+		return err
+	}
+
+	cmd := c.command(command[0], command[1:])
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = c.run(cmd)
+	c.remove()
+
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+
+		var exitErr *exec.ExitError
+		if ok := errors.As(err, &exitErr); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+	}
+
+	return nil
+}
+
+// Usage: your_docker.sh pool ls [options]
+func poolLsCmd(argv []string) error {
+	lsFlags := newFlagSet("pool ls", "[options]")
+	addStoreFlags(lsFlags)
+	_ = lsFlags.Parse(argv)
+
+	dirs, err := ioutil.ReadDir(filepath.Join(dataRoot, "pool"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	fmt.Printf("%-19s %5s %5s\n", "IMAGE DIGEST", "SIZE", "READY")
+	for _, dir := range dirs {
+		path := filepath.Join(dataRoot, "pool", dir.Name())
+		fmt.Printf("sha256:%-12s %5d %5d\n", shortID(dir.Name()), poolSize(path), len(readyContainers(path)))
+	}
+
+	return nil
+}
+
+// Usage: your_docker.sh pool drain [options] <image>
+func poolDrainCmd(argv []string) error {
+	drainFlags := newFlagSet("pool drain", "[options] <image>")
+	addStoreFlags(drainFlags)
+	_ = drainFlags.Parse(argv)
+
+	if drainFlags.NArg() != 1 {
+		drainFlags.Usage()
+		os.Exit(2)
+	}
+
+	ref, err := parseReference(drainFlags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := s.localImage(ref)
+	if err != nil {
+		return err
+	}
+
+	if err := fillPool(s, manifest, 0); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func poolDir(s *store, manifest manifestResponse) string {
+	return filepath.Join(s.root, "pool", strings.TrimPrefix(manifest.digest(), "sha256:"))
+}
+
+// poolSize returns the number of containers the pool should keep ready.
+func poolSize(dir string) int {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "size"))
+	if err != nil {
+		return 0
+	}
+
+	size, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return size
+}
+
+// readyContainers returns the root filesystems ready to be claimed.
+func readyContainers(dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var ready []string
+	for _, f := range files {
+		if f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+			ready = append(ready, filepath.Join(dir, f.Name()))
+		}
+	}
+
+	return ready
+}
+
+// fillPool extracts root filesystems of the image until size of them are
+// ready, or removes the extra ones, and records size as the pool size.
+func fillPool(s *store, manifest manifestResponse, size int) error {
+	dir := poolDir(s, manifest)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(filepath.Join(dir, ".lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "size"), []byte(strconv.Itoa(size)), 0600); err != nil {
+		return err
+	}
+
+	ready := readyContainers(dir)
+	for _, rootDir := range ready[minInt(size, len(ready)):] {
+		if err := os.RemoveAll(rootDir); err != nil {
+			return err
+		}
+	}
+
+	for i := len(ready); i < size; i++ {
+		tmp, err := ioutil.TempDir(dir, ".tmp-")
+		if err != nil {
+			return err
+		}
+
+		if err := extractImage(s, manifest, tmp); err != nil {
+			_ = os.RemoveAll(tmp)
+			return err
+		}
+
+		id, err := randomIDGenerator{}.generate()
+		if err != nil {
+			_ = os.RemoveAll(tmp)
+			return err
+		}
+
+		if err := os.Rename(tmp, filepath.Join(dir, shortID(id))); err != nil {
+			_ = os.RemoveAll(tmp)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// acquirePooled claims a ready root filesystem of the image, returning an
+// empty path if there is none. The pool is then refilled in the background.
+func acquirePooled(s *store, image string, manifest manifestResponse) string {
+	dir := poolDir(s, manifest)
+
+	for _, rootDir := range readyContainers(dir) {
+		claimed := filepath.Join(dir, ".claimed-"+filepath.Base(rootDir))
+		if err := os.Rename(rootDir, claimed); err != nil {
+			// Claimed by someone else in the meantime.
+			continue
+		}
+
+		refillPool(image, poolSize(dir))
+		return claimed
+	}
+
+	fmt.Fprintf(os.Stderr, "warm pool of %s is empty, creating container\n", image)
+	return ""
+}
+
+// refillPool starts a detached process filling the pool of the image back.
+func refillPool(image string, size int) {
+	args := []string{"pool", "fill", "--quiet", "--pull", pullNever, "--data-root", dataRoot, "--size", strconv.Itoa(size)}
+	for _, key := range decryptionKeys {
+		args = append(args, "--decryption-key", key)
+	}
+
+	cmd := exec.Command("/proc/self/exe", append(args, image)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to refill warm pool: %s\n", err)
+		return
+	}
+	_ = cmd.Process.Release()
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const progressInterval = 100 * time.Millisecond
+
+// quietPull disables the pull progress output.
+var quietPull bool
+
+// progressMu serializes the output of layers downloaded concurrently.
+var progressMu sync.Mutex
+
+// progress reports the pull progress of a layer on stderr. When stderr is a
+// terminal, the layer line is updated in place while downloading, otherwise
+// only status changes are printed.
+type progress struct {
+	id      string
+	total   int64
+	current int64
+	printed time.Time
+	tty     bool
+}
+
+func newProgress(digest string, total int64) *progress {
+	id := digest
+	if i := strings.Index(id, ":"); i >= 0 {
+		id = id[i+1:]
+	}
+	if len(id) > 12 {
+		id = id[:12]
+	}
+
+	p := &progress{id: id, total: total}
+	if info, err := os.Stderr.Stat(); err == nil {
+		p.tty = info.Mode()&os.ModeCharDevice != 0
+	}
+
+	return p
+}
+
+// Write counts downloaded bytes.
+func (p *progress) Write(b []byte) (int, error) {
+	p.current += int64(len(b))
+
+	if p.tty && !quietPull && time.Since(p.printed) >= progressInterval {
+		p.printed = time.Now()
+
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		fmt.Fprintf(os.Stderr, "\r%s: Downloading %s %s/%s\033[K", p.id, p.bar(), formatBytes(p.current), formatBytes(p.total))
+	}
+
+	return len(b), nil
+}
+
+// reset restarts the download count from offset.
+func (p *progress) reset(offset int64) {
+	p.current = offset
+}
+
+// status prints the new status of the layer on its own line.
+func (p *progress) status(status string) {
+	if quietPull {
+		return
+	}
+
+	progressMu.Lock()
+	defer progressMu.Unlock()
+
+	if p.tty {
+		fmt.Fprintf(os.Stderr, "\r%s: %s\033[K\n", p.id, status)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", p.id, status)
+	}
+}
+
+func (p *progress) bar() string {
+	const width = 40
+
+	done := width
+	if p.total > 0 && p.current < p.total {
+		done = int(p.current * width / p.total)
+	}
+
+	return "[" + strings.Repeat("=", done) + ">" + strings.Repeat(" ", width-done) + "]"
+}
+
+// formatBytes formats a size using decimal units, as Docker does.
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// pushChunkSize is the size of the chunks blobs are uploaded in. Blobs
+// smaller than a chunk, or all blobs if zero, are uploaded in a single
+// request.
+var pushChunkSize int64 = 16 << 20
+
+// Usage: your_docker.sh push [options] <image>
+func pushCmd(argv []string) error {
+	pushFlags := newFlagSet("push", "[options] <image>")
+	addStoreFlags(pushFlags)
+	addRegistryFlags(pushFlags)
+	pushFlags.Int64Var(&pushChunkSize, "chunk-size", pushChunkSize, "size of blob upload chunks in bytes, 0 to upload blobs in one request")
+	_ = pushFlags.Parse(argv)
+
+	if pushFlags.NArg() != 1 {
+		pushFlags.Usage()
+		os.Exit(2)
+	}
+
+	ref, err := parseReference(pushFlags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := s.localImage(ref)
+	if err != nil {
+		return err
+	}
+
+	r, err := connectRegistry(ref, "https", ref.apiHost(), "pull,push")
+	if err != nil {
+		return err
+	}
+
+	if err := pushImage(s, r, manifest); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: digest: %s size: %d\n", ref.tag, manifest.digest(), len(manifest.raw))
+
+	return nil
+}
+
+// pushImage uploads the layers, config and manifest of a stored image.
+func pushImage(s *store, r *registry, manifest manifestResponse) error {
+	for _, blob := range append(manifest.Layers, manifest.Config) {
+		p := newProgress(blob.Digest, blob.Size)
+
+		exists, err := r.hasBlob(blob.Digest)
+		if err != nil {
+			return err
+		}
+		if exists {
+			p.status("Layer already exists")
+			continue
+		}
+
+		if err := r.uploadBlob(fileSource(s.blobPath(blob.Digest)), blob.Digest, p); err != nil {
+			return err
+		}
+		p.status("Pushed")
+	}
+
+	return r.putManifest(manifest)
+}
+
+// hasBlob checks whether the repository already holds the blob.
+func (r *registry) hasBlob(digest string) (bool, error) {
+	req, err := r.newRequest(http.MethodHead, "blobs/"+digest)
+	if err != nil {
+		return false, err
+	}
+
+	var exists bool
+	err = registryRetry.do("checking blob "+digest, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+		defer cancel()
+
+		resp, err := r.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return retryable(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		if resp.StatusCode == http.StatusNotFound {
+			exists = false
+			return nil
+		}
+
+		exists = true
+		return checkStatus(resp, "failed to check blob existence")
+	})
+
+	return exists, err
+}
+
+// blobSource opens the content of a blob to upload, and returns its size.
+type blobSource func() (io.ReadCloser, int64, error)
+
+func fileSource(path string) blobSource {
+	return func() (io.ReadCloser, int64, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, 0, err
+		}
+
+		return f, info.Size(), nil
+	}
+}
+
+// uploadBlob uploads the blob with the given digest, either in a single
+// request or in chunks depending on its size.
+func (r *registry) uploadBlob(src blobSource, digest string, p *progress) error {
+	return registryRetry.do("uploading blob "+digest, func() error {
+		location, err := r.startUpload("")
+		if err != nil || location == "" {
+			return err
+		}
+
+		return r.sendBlob(location, src, digest, p)
+	})
+}
+
+// sendBlob sends the content of the blob to the upload session at location.
+func (r *registry) sendBlob(location string, src blobSource, digest string, p *progress) error {
+	in, size, err := src()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	p.reset(0)
+
+	if pushChunkSize <= 0 || size <= pushChunkSize {
+		return r.finishUpload(location, digest, io.TeeReader(in, p), size)
+	}
+
+	buf := make([]byte, pushChunkSize)
+	var offset int64
+	for offset < size {
+		n, err := io.ReadFull(in, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return retryable(err)
+		}
+
+		if location, err = r.uploadChunk(location, buf[:n], offset); err != nil {
+			return err
+		}
+		offset += int64(n)
+		_, _ = p.Write(buf[:n])
+	}
+
+	return r.finishUpload(location, digest, nil, 0)
+}
+
+// startUpload starts a blob upload session, returning its location. When
+// query is not empty, it is added to the request, e.g. to mount the blob from
+// another repository, in which case an empty location is returned if the
+// registry completed the request without needing an upload.
+func (r *registry) startUpload(query string) (string, error) {
+	req, err := r.newRequest(http.MethodPost, "blobs/uploads/")
+	if err != nil {
+		return "", err
+	}
+	req.URL.RawQuery = query
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", retryable(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if query != "" && resp.StatusCode == http.StatusCreated {
+		return "", nil
+	}
+
+	if err := expectStatus(resp, "failed to start blob upload", http.StatusAccepted); err != nil {
+		return "", err
+	}
+
+	return r.resolveLocation(resp)
+}
+
+// uploadChunk uploads a chunk of the blob starting at offset, returning the
+// location of the next request.
+func (r *registry) uploadChunk(location string, chunk []byte, offset int64) (string, error) {
+	req, err := r.newUploadRequest(http.MethodPatch, location, bytes.NewReader(chunk), int64(len(chunk)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(len(chunk))-1))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", retryable(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if err := expectStatus(resp, "failed to upload blob chunk", http.StatusAccepted, http.StatusNoContent); err != nil {
+		return "", err
+	}
+
+	return r.resolveLocation(resp)
+}
+
+// finishUpload completes the upload session, sending the remaining content of
+// the blob if any.
+func (r *registry) finishUpload(location, digest string, body io.Reader, size int64) error {
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("digest", digest)
+	u.RawQuery = query.Encode()
+
+	req, err := r.newUploadRequest(http.MethodPut, u.String(), body, size)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return retryable(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	return expectStatus(resp, "failed to complete blob upload", http.StatusCreated, http.StatusNoContent)
+}
+
+func (r *registry) newUploadRequest(method, location string, body io.Reader, size int64) (*http.Request, error) {
+	req, err := http.NewRequest(method, location, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if r.token != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", r.token))
+	}
+
+	return req, nil
+}
+
+// resolveLocation returns the absolute URL of the Location header of the
+// response, which registries are free to return relative.
+func (r *registry) resolveLocation(resp *http.Response) (string, error) {
+	location, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("invalid upload location: %w", err)
+	}
+
+	return location.String(), nil
+}
+
+// putManifest uploads the manifest under the reference tag.
+func (r *registry) putManifest(manifest manifestResponse) error {
+	req, err := r.newRequest(http.MethodPut, "manifests/"+r.ref.manifestRef())
+	if err != nil {
+		return err
+	}
+
+	mediaType := manifest.MediaType
+	if mediaType == "" {
+		mediaType = mediaTypeDockerManifest
+	}
+	req.Header.Set("Content-Type", mediaType)
+
+	return registryRetry.do("uploading manifest", func() error {
+		req.Body = ioutil.NopCloser(bytes.NewReader(manifest.raw))
+		req.ContentLength = int64(len(manifest.raw))
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return retryable(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		return expectStatus(resp, "failed to upload manifest", http.StatusCreated, http.StatusOK)
+	})
+}
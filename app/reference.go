@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	dockerHubRegistry = "docker.io"
+	dockerHubAPIHost  = "registry-1.docker.io"
+)
+
+// reference identifies an image in a registry, e.g.
+// registry.example.com:5000/team/app:1.0 or ubuntu (docker.io/library/ubuntu:latest).
+type reference struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+// parseReference parses an image reference the way Docker does: the first
+// path component is a registry host only if it looks like one, otherwise
+// the image lives on Docker Hub.
+func parseReference(image string) (reference, error) {
+	ref := reference{registry: dockerHubRegistry}
+
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		ref.digest = name[i+1:]
+		name = name[:i]
+		if !strings.Contains(ref.digest, ":") {
+			return reference{}, fmt.Errorf("invalid image reference %q: bad digest", image)
+		}
+	}
+
+	if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i:], "/") {
+		ref.tag = name[i+1:]
+		name = name[:i]
+	}
+
+	if i := strings.Index(name, "/"); i >= 0 {
+		host := name[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.registry = host
+			name = name[i+1:]
+		}
+	}
+
+	if ref.registry == dockerHubRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+
+	if name == "" || name != strings.ToLower(name) {
+		return reference{}, fmt.Errorf("invalid image reference %q", image)
+	}
+	ref.repository = name
+
+	if ref.tag == "" && ref.digest == "" {
+		ref.tag = "latest"
+	}
+
+	return ref, nil
+}
+
+// apiHost returns the host serving the registry API.
+func (r reference) apiHost() string {
+	if r.registry == dockerHubRegistry {
+		return dockerHubAPIHost
+	}
+
+	return r.registry
+}
+
+// manifestRef returns the digest of the image if pinned, its tag otherwise.
+func (r reference) manifestRef() string {
+	if r.digest != "" {
+		return r.digest
+	}
+
+	return r.tag
+}
+
+func (r reference) String() string {
+	s := r.registry + "/" + r.repository
+	if r.tag != "" {
+		s += ":" + r.tag
+	}
+	if r.digest != "" {
+		s += "@" + r.digest
+	}
+
+	return s
+}
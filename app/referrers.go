@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// titleAnnotation names the file of an artifact layer.
+const titleAnnotation = "org.opencontainers.image.title"
+
+// referrers returns the artifacts attached to the manifest digest, of the
+// given type when not empty. Registries without the referrers API are queried
+// through the sha256-<hex> fallback tag.
+func (r *registry) referrers(digest, artifactType string) ([]indexedManifest, error) {
+	path := "referrers/" + digest
+	if artifactType != "" {
+		path += "?" + url.Values{"artifactType": {artifactType}}.Encode()
+	}
+
+	req, err := r.newRequest(http.MethodGet, path)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", mediaTypeOCIIndex)
+
+	var data []byte
+	supported := true
+	err = registryRetry.do("listing referrers", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+		defer cancel()
+
+		resp, err := r.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return retryable(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		if resp.StatusCode == http.StatusNotFound {
+			supported = false
+			return nil
+		}
+
+		if err := checkStatus(resp, "failed to list referrers"); err != nil {
+			return err
+		}
+
+		if data, err = ioutil.ReadAll(resp.Body); err != nil {
+			return retryable(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !supported {
+		fallback := *r
+		fallback.ref.tag = strings.Replace(digest, ":", "-", 1)
+		fallback.ref.digest = ""
+
+		if data, _, err = fallback.fetchRawManifest(mediaTypeOCIIndex); err != nil {
+			// No artifact was ever attached.
+			return nil, nil
+		}
+	}
+
+	var index manifestIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid referrers index: %w", err)
+	}
+
+	// Registries may ignore the artifact type filter.
+	var found []indexedManifest
+	for _, m := range index.Manifests {
+		if artifactType == "" || m.ArtifactType == artifactType {
+			found = append(found, m)
+		}
+	}
+
+	return found, nil
+}
+
+// printReferrers prints the artifacts attached to the manifest digest.
+func printReferrers(r *registry, digest string) error {
+	referrers, err := r.referrers(digest, "")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	if len(referrers) == 0 {
+		fmt.Println("No referrers")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REFERRER\tARTIFACT TYPE\tSIZE")
+	for _, m := range referrers {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", m.Digest, m.ArtifactType, formatBytes(m.Size))
+	}
+
+	return w.Flush()
+}
+
+// Usage: your_docker.sh artifact <command> [options] <args>...
+func artifactCmd(argv []string) error {
+	return dispatch("artifact", []command{
+		{"pull", "Pull the artifacts attached to an image", artifactPullCmd},
+	}, argv)
+}
+
+// Usage: your_docker.sh artifact pull [options] <image> [<artifact digest>]
+func artifactPullCmd(argv []string) error {
+	pullFlags := newFlagSet("artifact pull", "[options] <image> [<artifact digest>]")
+	addRegistryFlags(pullFlags)
+	artifactType := pullFlags.String("type", "", "only pull the attached artifacts of this type")
+	outputDir := pullFlags.String("o", ".", "directory receiving the artifact files")
+	_ = pullFlags.Parse(argv)
+
+	if pullFlags.NArg() < 1 || pullFlags.NArg() > 2 {
+		pullFlags.Usage()
+		os.Exit(2)
+	}
+
+	ref, err := parseReference(pullFlags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	r, err := registryLogin(ref)
+	if err != nil {
+		return err
+	}
+
+	var digests []string
+	if pullFlags.NArg() == 2 {
+		digests = append(digests, pullFlags.Arg(1))
+	} else {
+		data, _, err := r.fetchRawManifest(mediaTypeOCIIndex, mediaTypeDockerManifestList, mediaTypeOCIManifest, mediaTypeDockerManifest)
+		if err != nil {
+			return err
+		}
+
+		referrers, err := r.referrers(manifestResponse{raw: data}.digest(), *artifactType)
+		if err != nil {
+			return err
+		}
+		for _, m := range referrers {
+			digests = append(digests, m.Digest)
+		}
+	}
+
+	if len(digests) == 0 {
+		fmt.Fprintf(os.Stderr, "no artifact attached to %s\n", ref)
+		os.Exit(1)
+	}
+
+	for _, digest := range digests {
+		if err := pullArtifact(r, digest, *outputDir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pullArtifact downloads the layers of the artifact manifest into dir, named
+// after their title annotation, or their digest.
+func pullArtifact(r *registry, digest, dir string) error {
+	pinned := *r
+	pinned.ref.digest = digest
+
+	data, _, err := pinned.fetchRawManifest(mediaTypeOCIManifest, mediaTypeDockerManifest)
+	if err != nil {
+		return err
+	}
+
+	var artifact manifestResponse
+	if err := json.Unmarshal(data, &artifact); err != nil {
+		return err
+	}
+	if err := artifact.validate(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, l := range artifact.Layers {
+		name := filepath.Base(filepath.Clean("/" + l.Annotations[titleAnnotation]))
+		if name == "/" {
+			name = strings.Replace(l.Digest, ":", "-", 1)
+		}
+		path := filepath.Join(dir, name)
+
+		if err := r.downloadBlob(l.Digest, path, newProgress(l.Digest, l.Size)); err != nil {
+			return err
+		}
+
+		if actual, err := hashFile(path); err != nil {
+			return err
+		} else if actual != l.Digest {
+			_ = os.Remove(path)
+			return fmt.Errorf("digest mismatch: expected %s, got %s", l.Digest, actual)
+		}
+
+		fmt.Printf("%s: %s\n", digest, path)
+	}
+
+	return nil
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// registryTimeout bounds connection establishment and waiting for response
+// headers, as well as whole metadata requests (token, manifest). Blob bodies
+// are not bounded, as large layers can legitimately take a long time.
+var registryTimeout = 30 * time.Second
+
+// maxConcurrentDownloads is the number of layers pulled at once.
+var maxConcurrentDownloads = 3
+
+// upstreamMu guards the lazy connection to the upstream registry of mirrors.
+var upstreamMu sync.Mutex
+
+// insecureRegistries lists the registry hosts that may be reached over plain
+// HTTP, or over HTTPS without verifying their certificate.
+var insecureRegistries []string
+
+// registryCertsDir holds per-registry TLS configuration, using the same
+// layout as Docker: <dir>/<host>/*.crt are additional CA certificates and
+// <dir>/<host>/<name>.cert with <name>.key are client certificates.
+var registryCertsDir = "/etc/docker/certs.d"
+
+// httpClients caches one client per host. Their transports keep connections
+// alive so that successive blob fetches to the same registry reuse them.
+var (
+	httpClientsMu sync.Mutex
+	httpClients   = map[string]*http.Client{}
+)
+
+func newHTTPClient(tlsConfig *tls.Config) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   registryTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSClientConfig:       tlsConfig,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   registryTimeout,
+			ResponseHeaderTimeout: registryTimeout,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+}
+
+// clientFor returns the HTTP client to use for the given host.
+func clientFor(host string) (*http.Client, error) {
+	httpClientsMu.Lock()
+	defer httpClientsMu.Unlock()
+
+	if client, ok := httpClients[host]; ok {
+		return client, nil
+	}
+
+	tlsConfig, err := tlsConfigFor(host)
+	if err != nil {
+		return nil, err
+	}
+
+	client := newHTTPClient(tlsConfig)
+	httpClients[host] = client
+
+	return client, nil
+}
+
+func isInsecureRegistry(host string) bool {
+	for _, insecure := range insecureRegistries {
+		if insecure == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tlsConfigFor builds the TLS configuration of the given host from the
+// registry certificates directory.
+func tlsConfigFor(host string) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: isInsecureRegistry(host),
+	}
+
+	dir := filepath.Join(registryCertsDir, host)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+
+		switch filepath.Ext(f.Name()) {
+		case ".crt":
+			if config.RootCAs == nil {
+				pool, err := x509.SystemCertPool()
+				if err != nil {
+					pool = x509.NewCertPool()
+				}
+				config.RootCAs = pool
+			}
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			if !config.RootCAs.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificate found in %s", path)
+			}
+		case ".cert":
+			keyPath := strings.TrimSuffix(path, ".cert") + ".key"
+			cert, err := tls.LoadX509KeyPair(path, keyPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate %s: %w", path, err)
+			}
+			config.Certificates = append(config.Certificates, cert)
+		}
+	}
+
+	return config, nil
+}
+
+// registry is a client for the repository of an image reference.
+type registry struct {
+	ref    reference
+	host   string
+	base   string
+	client *http.Client
+	token  string
+
+	// actions are the repository actions requested when authenticating,
+	// e.g. "pull" or "pull,push".
+	actions string
+
+	// mirror is set when host is a pull-through mirror of the reference
+	// registry, upstream being then the lazily connected reference registry.
+	mirror   bool
+	upstream *registry
+}
+
+type registryTokenSvcResponse struct {
+	Token       string `json:"token,omitempty"`
+	AccessToken string `json:"access_token,omitempty"`
+}
+
+// registryLogin connects to the registry of the given reference and, if
+// the registry requires it, gets a token allowing to pull the repository.
+func registryLogin(ref reference) (*registry, error) {
+	return connectRegistry(ref, "https", ref.apiHost(), "pull")
+}
+
+// connectRegistry connects to the registry API served at the given scheme
+// and host, and authenticates for the given actions on the repository of the
+// reference.
+func connectRegistry(ref reference, scheme, host, actions string) (*registry, error) {
+	client, err := clientFor(host)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &registry{
+		ref:     ref,
+		host:    host,
+		base:    scheme + "://" + host,
+		client:  client,
+		actions: actions,
+	}
+
+	challenge, err := r.ping()
+	if err != nil {
+		return nil, err
+	}
+
+	if challenge == "" {
+		return r, nil
+	}
+
+	return r, r.authenticate(challenge)
+}
+
+// ping checks the registry API is reachable, falling back to plain HTTP for
+// insecure registries. It returns the authentication challenge of the
+// registry, if any.
+func (r *registry) ping() (string, error) {
+	var challenge string
+	err := registryRetry.do("pinging registry "+r.host, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+		defer cancel()
+
+		resp, err := r.get(ctx, r.base+"/v2/")
+		if err != nil && isInsecureRegistry(r.host) && strings.HasPrefix(r.base, "https://") {
+			r.base = "http://" + r.host
+			resp, err = r.get(ctx, r.base+"/v2/")
+		}
+		if err != nil {
+			return retryable(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		if resp.StatusCode == http.StatusUnauthorized {
+			challenge = resp.Header.Get("Www-Authenticate")
+			return nil
+		}
+
+		return checkStatus(resp, "failed to reach registry API")
+	})
+
+	return challenge, err
+}
+
+func (r *registry) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.client.Do(req.WithContext(ctx))
+}
+
+// parseChallenge parses a WWW-Authenticate header value such as
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io".
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+
+	i := strings.Index(challenge, " ")
+	if i < 0 {
+		return strings.ToLower(challenge), params
+	}
+	scheme, rest := strings.ToLower(challenge[:i]), challenge[i+1:]
+
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if end := strings.Index(rest, ","); end >= 0 {
+			value, rest = rest[:end], rest[end:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+	}
+
+	return scheme, params
+}
+
+// authenticate gets a bearer token from the authorization service described
+// by the challenge.
+func (r *registry) authenticate(challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	if scheme != "bearer" {
+		return fmt.Errorf("unsupported registry authentication scheme: %s", scheme)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return fmt.Errorf("invalid registry authentication realm: %q", params["realm"])
+	}
+
+	query := realm.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:%s", r.ref.repository, r.actions))
+	realm.RawQuery = query.Encode()
+
+	client, err := clientFor(realm.Host)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	var response registryTokenSvcResponse
+	err = registryRetry.do("docker registry login", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+		defer cancel()
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return retryable(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		if err := checkStatus(resp, "failed to get docker registry token"); err != nil {
+			return err
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return retryable(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.token = response.Token
+	if r.token == "" {
+		r.token = response.AccessToken
+	}
+
+	return nil
+}
+
+// newRequest creates an authenticated request to the repository API.
+func (r *registry) newRequest(method, path string) (*http.Request, error) {
+	url := fmt.Sprintf("%s/v2/%s/%s", r.base, r.ref.repository, path)
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.token != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", r.token))
+	}
+
+	return req, nil
+}
+
+// checkStatus returns an error if the response status is not 200 OK. Server
+// errors are considered transient.
+func checkStatus(resp *http.Response, msg string) error {
+	return expectStatus(resp, msg, http.StatusOK)
+}
+
+// expectStatus returns an error if the response status is not one of the
+// expected ones. Server errors are considered transient.
+func expectStatus(resp *http.Response, msg string, expected ...int) error {
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return rateLimitError{retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	err := fmt.Errorf("%s. Status code: %d", msg, resp.StatusCode)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return retryable(err)
+	}
+
+	return err
+}
+
+// Manifest media types.
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+type manifestResponse struct {
+	SchemaVersion int     `json:"schemaVersion,omitempty"`
+	MediaType     string  `json:"mediaType,omitempty"`
+	Config        layer   `json:"config,omitempty"`
+	Layers        []layer `json:"layers,omitempty"`
+
+	// raw is the manifest as served by the registry, whose hash is the
+	// manifest digest.
+	raw []byte
+}
+
+// digest returns the digest of the manifest.
+func (m manifestResponse) digest() string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(m.raw))
+}
+
+// validate checks the digests of the config and layers, which name blobs on
+// disk.
+func (m manifestResponse) validate() error {
+	for _, l := range append([]layer{m.Config}, m.Layers...) {
+		if err := checkDigest(l.Digest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validDigest matches the digests of blobs, the only ones supported.
+var validDigest = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// checkDigest checks the digest is a valid sha256 one, before it is used in
+// a path.
+func checkDigest(digest string) error {
+	if !validDigest.MatchString(digest) {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+
+	return nil
+}
+
+type layer struct {
+	MediaType   string            `json:"mediaType,omitempty"`
+	Size        int64             `json:"size,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func (r *registry) fetchManifest() (manifestResponse, error) {
+	raw, _, err := r.fetchRawManifest(mediaTypeDockerManifest)
+	if err != nil {
+		return manifestResponse{}, err
+	}
+
+	var response manifestResponse
+	if err := json.Unmarshal(raw, &response); err != nil {
+		return manifestResponse{}, err
+	}
+	if err := response.validate(); err != nil {
+		return manifestResponse{}, err
+	}
+	response.raw = raw
+
+	return response, nil
+}
+
+// fetchRawManifest fetches the manifest of the image in one of the accepted
+// media types, returning it as served along with its media type.
+//
+// Manifests are cached on disk. Digest references are served from the cache,
+// and tags are revalidated with If-None-Match, or with a HEAD request when
+// the registry sent no ETag, so unchanged manifests are not downloaded again.
+func (r *registry) fetchRawManifest(accept ...string) ([]byte, string, error) {
+	cached, ok := r.cachedManifest(accept)
+	if ok && r.ref.digest != "" && cached.digest() == r.ref.digest {
+		return cached.Raw, cached.MediaType, nil
+	}
+	if ok && cached.ETag == "" {
+		if digest, err := r.headManifest(accept); err == nil && digest == cached.digest() {
+			return cached.Raw, cached.MediaType, nil
+		}
+	}
+
+	req, err := r.newRequest(http.MethodGet, "manifests/"+r.ref.manifestRef())
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, mediaType := range accept {
+		req.Header.Add("Accept", mediaType)
+	}
+	if ok && cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	var raw []byte
+	var mediaType, etag string
+	notModified := false
+	err = registryRetry.do("fetching image manifest", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+		defer cancel()
+
+		resp, err := r.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return retryable(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		if resp.StatusCode == http.StatusNotModified && ok {
+			notModified = true
+			return nil
+		}
+
+		if err := checkStatus(resp, "failed to get image manifest"); err != nil {
+			return err
+		}
+
+		if raw, err = ioutil.ReadAll(resp.Body); err != nil {
+			return retryable(err)
+		}
+		mediaType = resp.Header.Get("Content-Type")
+		etag = resp.Header.Get("ETag")
+
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if notModified {
+		return cached.Raw, cached.MediaType, nil
+	}
+
+	if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(raw)); r.ref.digest != "" && digest != r.ref.digest {
+		return nil, "", fmt.Errorf("manifest digest mismatch: expected %s, got %s", r.ref.digest, digest)
+	}
+
+	r.cacheManifest(accept, cachedManifest{ETag: etag, MediaType: mediaType, Raw: raw})
+
+	return raw, mediaType, nil
+}
+
+func (r *registry) downloadBlob(digest, outPath string, p *progress) error {
+	err := r.fetchBlob(digest, outPath, p)
+	if err == nil || !r.mirror {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "registry mirror %s: %s, falling back to %s\n", r.host, err, r.ref.registry)
+
+	// Layers are downloaded concurrently, connect upstream only once.
+	upstreamMu.Lock()
+	var loginErr error
+	if r.upstream == nil {
+		r.upstream, loginErr = registryLogin(r.ref)
+	}
+	upstream := r.upstream
+	upstreamMu.Unlock()
+	if loginErr != nil {
+		return loginErr
+	}
+
+	// The upstream registry downloads the blob from the first byte again.
+	if p != nil {
+		p.reset(0)
+	}
+
+	return upstream.fetchBlob(digest, outPath, p)
+}
+
+func (r *registry) fetchBlob(digest, outPath string, p *progress) error {
+	req, err := r.newRequest(http.MethodGet, "blobs/"+digest)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = out.Close() }()
+
+	var w io.Writer = out
+	if p != nil {
+		w = io.MultiWriter(out, p)
+	}
+
+	// Number of bytes already written to outPath. When an attempt fails in
+	// the middle of the transfer, the next one asks for the remaining bytes
+	// only.
+	var offset int64
+
+	// restart discards the partial file so that the transfer starts from the
+	// first byte.
+	restart := func() error {
+		if err := out.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := out.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		offset = 0
+		if p != nil {
+			p.reset(0)
+		}
+		return nil
+	}
+
+	err = registryRetry.do(fmt.Sprintf("downloading blob %s", digest), func() error {
+		req.Header.Del("Range")
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return retryable(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		switch {
+		case resp.StatusCode == http.StatusOK && offset > 0:
+			// Range requests are not supported, start over.
+			if err := restart(); err != nil {
+				return err
+			}
+		case resp.StatusCode == http.StatusPartialContent && offset > 0:
+			// Only append the body when it continues the partial file,
+			// otherwise start over with a full request.
+			var start int64
+			contentRange := resp.Header.Get("Content-Range")
+			if _, err := fmt.Sscanf(contentRange, "bytes %d-", &start); err != nil || start != offset {
+				rangeErr := fmt.Errorf("unexpected content range %q for offset %d", contentRange, offset)
+				if err := restart(); err != nil {
+					return err
+				}
+				return retryable(rangeErr)
+			}
+		default:
+			if err := checkStatus(resp, "failed to get image blob"); err != nil {
+				return err
+			}
+		}
+
+		n, err := io.Copy(w, resp.Body)
+		offset += n
+		if err != nil {
+			return retryable(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// fetchURL fetches the content at the URL, outside of any registry API.
+func fetchURL(u string) ([]byte, error) {
+	var data []byte
+	err := registryRetry.do("fetching "+u, func() error {
+		resp, err := newHTTPClient(nil).Get(u)
+		if err != nil {
+			return retryable(err)
+		}
+		defer resp.Body.Close()
+
+		if err := checkStatus(resp, "failed to fetch "+u); err != nil {
+			return err
+		}
+
+		if data, err = ioutil.ReadAll(resp.Body); err != nil {
+			return retryable(err)
+		}
+
+		return nil
+	})
+
+	return data, err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// retryPolicy describes how failed registry requests are retried.
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+
+	// waitOnRateLimit makes rate limited requests wait for the delay
+	// advertised by the registry and try again, instead of failing.
+	waitOnRateLimit bool
+}
+
+var registryRetry = retryPolicy{
+	maxAttempts: 5,
+	baseDelay:   500 * time.Millisecond,
+	maxDelay:    30 * time.Second,
+}
+
+// retryableError marks an error as transient, i.e. worth retrying.
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string { return e.err.Error() }
+func (e retryableError) Unwrap() error { return e.err }
+
+func retryable(err error) error {
+	return retryableError{err: err}
+}
+
+// rateLimitError is returned when the registry answers 429 Too Many Requests.
+type rateLimitError struct {
+	// retryAfter is the delay advertised by the Retry-After header, if any.
+	retryAfter time.Duration
+}
+
+func (e rateLimitError) Error() string {
+	if e.retryAfter > 0 {
+		return fmt.Sprintf("rate limited by the registry, retry after %s", e.retryAfter)
+	}
+
+	return "rate limited by the registry"
+}
+
+// parseRetryAfter parses a Retry-After header value, which is either a number
+// of seconds or an HTTP date. It returns zero if the value is missing or
+// invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay.Round(time.Second)
+		}
+	}
+
+	return 0
+}
+
+// backoff returns the delay to wait before the given attempt (starting at 1),
+// using exponential backoff with full jitter.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.maxDelay
+	if shift := uint(attempt - 1); shift < 32 {
+		if d := p.baseDelay << shift; d > 0 && d < p.maxDelay {
+			delay = d
+		}
+	}
+
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// do calls fn until it succeeds, returns a non retryable error, or the maximum
+// number of attempts is reached.
+func (p retryPolicy) do(what string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		var delay time.Duration
+		var retryErr retryableError
+		var rateErr rateLimitError
+		switch {
+		case errors.As(err, &rateErr):
+			if !p.waitOnRateLimit {
+				return fmt.Errorf("%s: %w (use --wait-on-rate-limit to wait and retry)", what, err)
+			}
+			delay = rateErr.retryAfter
+			if delay == 0 {
+				delay = p.backoff(attempt)
+			}
+		case errors.As(err, &retryErr):
+			err = retryErr.err
+			delay = p.backoff(attempt)
+		default:
+			return err
+		}
+
+		if attempt >= p.maxAttempts {
+			return fmt.Errorf("%s: giving up after %d attempts: %w", what, attempt, err)
+		}
+
+		fmt.Fprintf(os.Stderr, "%s failed (%s), retrying in %s\n", what, err, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
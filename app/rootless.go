@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// rootlessEnv is set when the runtime runs again in a user namespace for a
+// non-root user: to rootlessMapping until the ids of the namespace are
+// mapped, and to rootlessMapped then.
+const (
+	rootlessEnv     = "MYDOCKER_ROOTLESS"
+	rootlessMapping = "mapping"
+	rootlessMapped  = "mapped"
+)
+
+// rootlessCommands are the commands that run again in a user namespace for
+// non-root users, as they create namespaces and mount filesystems.
+var rootlessCommands = map[string]bool{
+	"run":  true,
+	"job":  true,
+	"pool": true,
+
+	// Volumes hold files of the subordinate ids.
+	"volume": true,
+}
+
+// rootless reports whether the runtime runs for a non-root user.
+func rootless() bool {
+	return os.Geteuid() != 0 || os.Getenv(rootlessEnv) != ""
+}
+
+// defaultDataRoot returns the default image store directory: a system one
+// for root, and one in the home directory of other users.
+func defaultDataRoot() string {
+	if !rootless() {
+		return "/var/lib/mydocker"
+	}
+
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "mydocker")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+
+	return filepath.Join(home, ".local", "share", "mydocker")
+}
+
+// runRootless runs the command again in new user and mount namespaces, where
+// the current user is root. The other users of the namespace are mapped to
+// the subordinate ids of the current user, listed in /etc/subuid and
+// /etc/subgid.
+func runRootless(args []string) error {
+	cmd := exec.Command("/proc/self/exe", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), rootlessEnv+"="+rootlessMapping)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		Pdeathsig:  syscall.SIGKILL,
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to create a user namespace: %w", err)
+	}
+
+	if err := writeIDMappings(cmd.Process.Pid); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+
+	return cmd.Wait()
+}
+
+// waitIDMappings waits for the runtime to map the ids of the user namespace
+// the current process was created in, then executes it again: the process
+// lost its capabilities in the namespace when executed as an unmapped user.
+func waitIDMappings() error {
+	for {
+		data, err := ioutil.ReadFile("/proc/self/uid_map")
+		if err != nil {
+			return err
+		} else if len(data) > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, rootlessEnv+"=") {
+			env = append(env, e)
+		}
+	}
+
+	return syscall.Exec("/proc/self/exe", os.Args, append(env, rootlessEnv+"="+rootlessMapped))
+}
+
+// writeIDMappings maps the current user to root in the user namespace of the
+// process, and its subordinate ids to the following ones. newuidmap and
+// newgidmap are required to map subordinate ids; without them, only root is
+// mapped.
+func writeIDMappings(pid int) error {
+	u, err := user.Current()
+	if err != nil {
+		return err
+	}
+
+	subuids, err := subordinateIDs("/etc/subuid", u.Username, u.Uid)
+	if err != nil {
+		return err
+	}
+	subgids, err := subordinateIDs("/etc/subgid", u.Username, u.Uid)
+	if err != nil {
+		return err
+	}
+
+	_, uidErr := exec.LookPath("newuidmap")
+	_, gidErr := exec.LookPath("newgidmap")
+	if len(subuids) > 0 && len(subgids) > 0 && uidErr == nil && gidErr == nil {
+		if err := runIDMap("newuidmap", pid, u.Uid, subuids); err != nil {
+			return err
+		}
+		return runIDMap("newgidmap", pid, u.Gid, subgids)
+	}
+
+	fmt.Fprintf(os.Stderr, "no subordinate ids for %s, or newuidmap and newgidmap missing: only root is mapped in containers\n", u.Username)
+
+	proc := filepath.Join("/proc", strconv.Itoa(pid))
+	if err := ioutil.WriteFile(filepath.Join(proc, "uid_map"), []byte(fmt.Sprintf("0 %s 1\n", u.Uid)), 0); err != nil {
+		return fmt.Errorf("failed to map the user id: %w", err)
+	}
+
+	// Unprivileged processes can only map their group once setgroups is
+	// denied.
+	if err := ioutil.WriteFile(filepath.Join(proc, "setgroups"), []byte("deny"), 0); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(proc, "gid_map"), []byte(fmt.Sprintf("0 %s 1\n", u.Gid)), 0); err != nil {
+		return fmt.Errorf("failed to map the group id: %w", err)
+	}
+
+	return nil
+}
+
+// idRange is a range of subordinate ids.
+type idRange struct {
+	start string
+	count int
+}
+
+// subordinateIDs returns the subordinate id ranges of the user, listed by
+// name or id in the file.
+func subordinateIDs(path, name, id string) ([]idRange, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ranges []idRange
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || (fields[0] != name && fields[0] != id) {
+			continue
+		}
+
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q", path, scanner.Text())
+		}
+		ranges = append(ranges, idRange{start: fields[1], count: count})
+	}
+
+	return ranges, scanner.Err()
+}
+
+// runIDMap maps id to root in the user namespace of the process, and the
+// subordinate ranges to the following ids, with the setuid newuidmap or
+// newgidmap program.
+func runIDMap(program string, pid int, id string, ranges []idRange) error {
+	args := []string{strconv.Itoa(pid), "0", id, "1"}
+	next := 1
+	for _, r := range ranges {
+		args = append(args, strconv.Itoa(next), r.start, strconv.Itoa(r.count))
+		next += r.count
+	}
+
+	out, err := exec.Command(program, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", program, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
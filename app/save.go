@@ -0,0 +1,210 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// containerdNameAnnotation is the annotation holding the full image name of
+// the manifests of an index, as written by docker save.
+const containerdNameAnnotation = "io.containerd.image.name"
+
+// Usage: your_docker.sh save [-o <file>] [options] <image>...
+func saveCmd(argv []string) error {
+	saveFlags := newFlagSet("save", "[-o <file>] [options] <image>...")
+	addStoreFlags(saveFlags)
+	output := saveFlags.String("o", "", "write to the file instead of the standard output")
+	_ = saveFlags.Parse(argv)
+
+	if saveFlags.NArg() < 1 {
+		saveFlags.Usage()
+		os.Exit(2)
+	}
+
+	var refs []reference
+	for _, image := range saveFlags.Args() {
+		ref, err := parseReference(image)
+		if err != nil {
+			return err
+		}
+		refs = append(refs, ref)
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	} else if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprintln(os.Stderr, "refusing to write the archive to a terminal, use -o")
+		os.Exit(2)
+	}
+
+	if err := saveImages(s, refs, out); err != nil {
+		if *output != "" {
+			_ = os.Remove(*output)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// saveImages writes the stored images as a tarball in the format of docker
+// save: an OCI layout holding the blobs, along with the manifest.json listing
+// the config and layers of each image, so that it loads as a docker-archive
+// or as an oci-archive.
+func saveImages(s *store, refs []reference, out io.Writer) error {
+	tw := tar.NewWriter(out)
+
+	var index manifestIndex
+	index.SchemaVersion = 2
+	index.MediaType = mediaTypeOCIIndex
+	entries := []archiveManifest{}
+	written := map[string]bool{}
+
+	if err := writeTarDir(tw, "blobs/"); err != nil {
+		return err
+	}
+	if err := writeTarDir(tw, "blobs/sha256/"); err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		manifest, err := s.localImage(ref)
+		if err != nil {
+			return err
+		}
+
+		entry := archiveManifest{
+			Config:   saveBlobPath(manifest.Config.Digest),
+			RepoTags: []string{ref.String()},
+		}
+		if ref.tag == "" {
+			entry.RepoTags = nil
+		}
+
+		for _, blob := range append([]layer{{Digest: manifest.digest()}, manifest.Config}, manifest.Layers...) {
+			if written[blob.Digest] {
+				continue
+			}
+			if err := writeTarFile(tw, saveBlobPath(blob.Digest), s.blobPath(blob.Digest)); err != nil {
+				return err
+			}
+			written[blob.Digest] = true
+		}
+
+		for _, l := range manifest.Layers {
+			entry.Layers = append(entry.Layers, saveBlobPath(l.Digest))
+		}
+		entries = append(entries, entry)
+
+		desc := indexedManifest{
+			MediaType: manifest.MediaType,
+			Size:      int64(len(manifest.raw)),
+			Digest:    manifest.digest(),
+			Annotations: map[string]string{
+				containerdNameAnnotation: ref.String(),
+				refNameAnnotation:        ref.tag,
+			},
+		}
+		if desc.MediaType == "" {
+			desc.MediaType = mediaTypeDockerManifest
+		}
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	files := []struct {
+		name  string
+		value interface{}
+	}{
+		{"manifest.json", entries},
+		{"index.json", index},
+		{"oci-layout", map[string]string{"imageLayoutVersion": "1.0.0"}},
+	}
+	for _, file := range files {
+		data, err := json.Marshal(file.value)
+		if err != nil {
+			return err
+		}
+		if err := writeTarData(tw, file.name, data); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func saveBlobPath(digest string) string {
+	return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+}
+
+func writeTarDir(tw *tar.Writer, name string) error {
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name,
+		Mode:     0755,
+		ModTime:  time.Unix(0, 0),
+	})
+}
+
+func writeTarData(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Unix(0, 0),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(data)
+	return err
+}
+
+func writeTarFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     info.Size(),
+		ModTime:  time.Unix(0, 0),
+	})
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(tw, f)
+	if err == nil && n != info.Size() {
+		err = errors.New("blob changed while saving it: " + path)
+	}
+
+	return err
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SBOM document formats.
+const (
+	sbomCycloneDX = "cyclonedx"
+	sbomSPDX      = "spdx"
+)
+
+// osPackage is a package installed by the image distribution package manager.
+type osPackage struct {
+	// kind is the package URL type: apk, deb or rpm.
+	kind    string
+	name    string
+	version string
+	arch    string
+	license string
+}
+
+// purl returns the package URL of the package, qualified with the
+// distribution it was installed from.
+func (p osPackage) purl(distro string) string {
+	purl := fmt.Sprintf("pkg:%s/%s/%s@%s", p.kind, url.PathEscape(distro), url.PathEscape(p.name), url.PathEscape(p.version))
+	if p.arch != "" {
+		purl += "?arch=" + url.QueryEscape(p.arch)
+	}
+	return purl
+}
+
+// Usage: your_docker.sh sbom [options] <image>
+func sbomCmd(argv []string) error {
+	sbomFlags := newFlagSet("sbom", "[options] <image>")
+	addStoreFlags(sbomFlags)
+	addRegistryFlags(sbomFlags)
+	addDecryptionFlags(sbomFlags)
+	format := sbomFlags.String("format", sbomCycloneDX, "document format (cyclonedx, spdx)")
+	pull := sbomFlags.String("pull", pullMissing, "pull image before listing its packages (always, missing, never)")
+	output := sbomFlags.String("o", "", "write the document to this file instead of the standard output")
+	_ = sbomFlags.Parse(argv)
+
+	if sbomFlags.NArg() != 1 {
+		sbomFlags.Usage()
+		os.Exit(2)
+	}
+
+	if *format != sbomCycloneDX && *format != sbomSPDX {
+		fmt.Fprintf(os.Stderr, "unknown SBOM format: %s\n", *format)
+		os.Exit(2)
+	}
+
+	image := sbomFlags.Arg(0)
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := openImage(s, image, *pull)
+	if err != nil {
+		return err
+	}
+
+	rootDir, err := ioutil.TempDir("", "sbom")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(rootDir) }()
+
+	if err := extractImage(s, manifest, rootDir); err != nil {
+		return err
+	}
+
+	distro := osRelease(rootDir)
+	packages, err := findPackages(rootDir)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		w = f
+	}
+
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+
+	var document interface{}
+	if *format == sbomSPDX {
+		document = spdxDocument(id, image, manifest.digest(), distro, packages)
+	} else {
+		document = cycloneDXDocument(id, image, manifest.digest(), distro, packages)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(document); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// osRelease returns the distribution ID of the root filesystem, from its
+// os-release file, or an empty string if unknown.
+func osRelease(rootDir string) string {
+	for _, name := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		path, err := resolveTarget(rootDir, name)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "ID=") {
+				return strings.Trim(strings.TrimPrefix(line, "ID="), `"'`)
+			}
+		}
+	}
+
+	return ""
+}
+
+// findPackages lists the packages recorded in the apk, dpkg and rpm databases
+// of the root filesystem. Their paths are resolved within the root filesystem,
+// so that image symlinks do not lead to host files.
+func findPackages(rootDir string) ([]osPackage, error) {
+	var packages []osPackage
+
+	path, err := resolveTarget(rootDir, "/lib/apk/db/installed")
+	if err != nil {
+		return nil, err
+	}
+	apk, err := apkPackages(path)
+	if err != nil {
+		return nil, err
+	}
+	packages = append(packages, apk...)
+
+	// Distroless images record each package in its own file under status.d.
+	names := []string{"/var/lib/dpkg/status"}
+	statusDir, err := resolveTarget(rootDir, "/var/lib/dpkg/status.d")
+	if err != nil {
+		return nil, err
+	}
+	if entries, err := ioutil.ReadDir(statusDir); err == nil {
+		for _, e := range entries {
+			names = append(names, "/var/lib/dpkg/status.d/"+e.Name())
+		}
+	}
+	for _, name := range names {
+		path, err := resolveTarget(rootDir, name)
+		if err != nil {
+			return nil, err
+		}
+		deb, err := dpkgPackages(path)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, deb...)
+	}
+
+	rpm, err := rpmPackages(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	packages = append(packages, rpm...)
+
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].kind != packages[j].kind {
+			return packages[i].kind < packages[j].kind
+		}
+		return packages[i].name < packages[j].name
+	})
+
+	return packages, nil
+}
+
+// readStanzas reads the blank line separated stanzas of "<key><sep><value>"
+// lines of the file, as used by the apk and dpkg databases. Continuation lines
+// are ignored. A missing file has no stanzas.
+func readStanzas(path, sep string, fn func(map[string]string)) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stanza := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(stanza) > 0 {
+				fn(stanza)
+			}
+			stanza = map[string]string{}
+			continue
+		}
+
+		if i := strings.Index(line, sep); i > 0 && line[0] != ' ' && line[0] != '\t' {
+			stanza[line[:i]] = strings.TrimSpace(line[i+len(sep):])
+		}
+	}
+	if len(stanza) > 0 {
+		fn(stanza)
+	}
+
+	return scanner.Err()
+}
+
+// apkPackages lists the packages of the apk installed database.
+func apkPackages(path string) ([]osPackage, error) {
+	var packages []osPackage
+	err := readStanzas(path, ":", func(stanza map[string]string) {
+		if stanza["P"] != "" {
+			packages = append(packages, osPackage{kind: "apk", name: stanza["P"], version: stanza["V"], arch: stanza["A"], license: stanza["L"]})
+		}
+	})
+
+	return packages, err
+}
+
+// dpkgPackages lists the installed packages of the dpkg status file.
+func dpkgPackages(path string) ([]osPackage, error) {
+	var packages []osPackage
+	err := readStanzas(path, ": ", func(stanza map[string]string) {
+		if stanza["Package"] == "" {
+			return
+		}
+		if status, ok := stanza["Status"]; ok && !strings.HasSuffix(status, " installed") {
+			return
+		}
+
+		packages = append(packages, osPackage{kind: "deb", name: stanza["Package"], version: stanza["Version"], arch: stanza["Architecture"]})
+	})
+
+	return packages, err
+}
+
+// rpmPackages lists the packages of the rpm database of the root filesystem.
+// The database formats are only readable by rpm itself, which must be
+// installed on the host when the image has one.
+func rpmPackages(rootDir string) ([]osPackage, error) {
+	var dbPath string
+	for _, name := range []string{"/usr/lib/sysimage/rpm", "/var/lib/rpm"} {
+		path, err := resolveTarget(rootDir, name)
+		if err != nil {
+			return nil, err
+		}
+		if entries, err := ioutil.ReadDir(path); err == nil && len(entries) > 0 {
+			dbPath = path
+			break
+		}
+	}
+	if dbPath == "" {
+		return nil, nil
+	}
+
+	out, err := exec.Command("rpm", "--dbpath", dbPath, "-qa", "--queryformat", `%{NAME}\t%{EPOCH}\t%{VERSION}-%{RELEASE}\t%{ARCH}\t%{LICENSE}\n`).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the rpm database: %w", err)
+	}
+
+	var packages []osPackage
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 5 {
+			continue
+		}
+
+		p := osPackage{kind: "rpm", name: fields[0], version: fields[2], arch: fields[3], license: fields[4]}
+		if fields[1] != "(none)" {
+			p.version = fields[1] + ":" + p.version
+		}
+		if p.arch == "(none)" {
+			p.arch = ""
+		}
+		packages = append(packages, p)
+	}
+
+	return packages, nil
+}
+
+// cycloneDXDocument returns the CycloneDX 1.4 JSON document listing the
+// packages of the image, with the UUID id as serial number.
+func cycloneDXDocument(id, image, digest, distro string, packages []osPackage) map[string]interface{} {
+	components := []map[string]interface{}{}
+	for _, p := range packages {
+		purl := p.purl(distro)
+		component := map[string]interface{}{
+			"type":    "library",
+			"bom-ref": purl,
+			"name":    p.name,
+			"version": p.version,
+			"purl":    purl,
+		}
+		if p.license != "" {
+			component["licenses"] = []map[string]interface{}{{"expression": p.license}}
+		}
+		components = append(components, component)
+	}
+
+	return map[string]interface{}{
+		"bomFormat":    "CycloneDX",
+		"specVersion":  "1.4",
+		"serialNumber": "urn:uuid:" + id,
+		"version":      1,
+		"metadata": map[string]interface{}{
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+			"tools":     []map[string]string{{"name": "mydocker", "version": version}},
+			"component": map[string]string{
+				"type":    "container",
+				"bom-ref": digest,
+				"name":    image,
+				"version": digest,
+			},
+		},
+		"components": components,
+	}
+}
+
+// spdxDocument returns the SPDX 2.3 JSON document listing the packages of the
+// image, the UUID id making its namespace unique.
+func spdxDocument(id, image, digest, distro string, packages []osPackage) map[string]interface{} {
+	const imageID = "SPDXRef-Image"
+
+	spdxPackages := []map[string]interface{}{{
+		"name":                  image,
+		"SPDXID":                imageID,
+		"versionInfo":           digest,
+		"downloadLocation":      "NOASSERTION",
+		"primaryPackagePurpose": "CONTAINER",
+	}}
+	relationships := []map[string]string{{
+		"spdxElementId":      "SPDXRef-DOCUMENT",
+		"relationshipType":   "DESCRIBES",
+		"relatedSpdxElement": imageID,
+	}}
+
+	for i, p := range packages {
+		license := p.license
+		if license == "" {
+			license = "NOASSERTION"
+		}
+
+		id := fmt.Sprintf("SPDXRef-Package-%d", i+1)
+		spdxPackages = append(spdxPackages, map[string]interface{}{
+			"name":             p.name,
+			"SPDXID":           id,
+			"versionInfo":      p.version,
+			"downloadLocation": "NOASSERTION",
+			"licenseConcluded": "NOASSERTION",
+			"licenseDeclared":  license,
+			"externalRefs": []map[string]string{{
+				"referenceCategory": "PACKAGE-MANAGER",
+				"referenceType":     "purl",
+				"referenceLocator":  p.purl(distro),
+			}},
+		})
+		relationships = append(relationships, map[string]string{
+			"spdxElementId":      imageID,
+			"relationshipType":   "CONTAINS",
+			"relatedSpdxElement": id,
+		})
+	}
+
+	return map[string]interface{}{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              image,
+		"documentNamespace": "https://mydocker.invalid/sbom/" + id,
+		"creationInfo": map[string]interface{}{
+			"created":  time.Now().UTC().Format(time.RFC3339),
+			"creators": []string{"Tool: mydocker-" + version},
+		},
+		"packages":      spdxPackages,
+		"relationships": relationships,
+	}
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// searchIndex is the Docker Hub search API.
+var searchIndex = "https://index.docker.io"
+
+// searchResult is a repository matching a search.
+type searchResult struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	StarCount   int    `json:"star_count"`
+	IsOfficial  bool   `json:"is_official"`
+	IsAutomated bool   `json:"is_automated"`
+}
+
+// Usage: your_docker.sh search [options] <term>
+func searchCmd(argv []string) error {
+	searchFlags := newFlagSet("search", "[options] <term>")
+	addRegistryFlags(searchFlags)
+	limit := searchFlags.Int("limit", 25, "maximum number of results")
+	noTrunc := searchFlags.Bool("no-trunc", false, "do not truncate descriptions")
+	searchFlags.StringVar(&searchIndex, "index", searchIndex, "URL of the search index")
+	_ = searchFlags.Parse(argv)
+
+	if searchFlags.NArg() != 1 {
+		searchFlags.Usage()
+		os.Exit(2)
+	}
+
+	results, err := search(searchFlags.Arg(0), *limit)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDESCRIPTION\tSTARS\tOFFICIAL\tAUTOMATED")
+	for _, r := range results {
+		description := strings.Join(strings.Fields(r.Description), " ")
+		if runes := []rune(description); !*noTrunc && len(runes) > 45 {
+			description = string(runes[:44]) + "…"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", r.Name, description, r.StarCount, flagMark(r.IsOfficial), flagMark(r.IsAutomated))
+	}
+	_ = w.Flush()
+
+	return nil
+}
+
+// search returns the Docker Hub repositories matching the term.
+func search(term string, limit int) ([]searchResult, error) {
+	query := url.Values{}
+	query.Set("q", term)
+	query.Set("n", fmt.Sprint(limit))
+
+	data, err := fetchURL(strings.TrimSuffix(searchIndex, "/") + "/v1/search?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Results []searchResult `json:"results"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("invalid search response: %w", err)
+	}
+
+	if len(response.Results) > limit {
+		response.Results = response.Results[:limit]
+	}
+
+	return response.Results, nil
+}
+
+func flagMark(set bool) string {
+	if set {
+		return "[OK]"
+	}
+
+	return ""
+}
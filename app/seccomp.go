@@ -0,0 +1,561 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// seccompDefault is the seccomp profile of containers, and seccompUnconfined
+// disables their seccomp filter. Other profiles are given by path.
+const (
+	seccompDefault    = "default"
+	seccompUnconfined = "unconfined"
+)
+
+// Seccomp actions, as named in Docker profiles.
+const (
+	actAllow       = "SCMP_ACT_ALLOW"
+	actErrno       = "SCMP_ACT_ERRNO"
+	actKill        = "SCMP_ACT_KILL"
+	actKillThread  = "SCMP_ACT_KILL_THREAD"
+	actKillProcess = "SCMP_ACT_KILL_PROCESS"
+	actTrap        = "SCMP_ACT_TRAP"
+	actLog         = "SCMP_ACT_LOG"
+	actTrace       = "SCMP_ACT_TRACE"
+)
+
+// Argument comparisons, as named in Docker profiles.
+const (
+	cmpNotEqual     = "SCMP_CMP_NE"
+	cmpLess         = "SCMP_CMP_LT"
+	cmpLessEqual    = "SCMP_CMP_LE"
+	cmpEqual        = "SCMP_CMP_EQ"
+	cmpGreaterEqual = "SCMP_CMP_GE"
+	cmpGreater      = "SCMP_CMP_GT"
+	cmpMaskedEqual  = "SCMP_CMP_MASKED_EQ"
+)
+
+// seccompProfile filters the system calls of the container process: the
+// first rule matching a system call gives its action, else the default
+// action applies.
+type seccompProfile struct {
+	defaultAction string
+	defaultErrno  int
+	syscalls      []seccompRule
+}
+
+// seccompRule applies an action to the named system calls, when their
+// arguments match. Rules can be restricted to containers holding, or not,
+// some capabilities.
+type seccompRule struct {
+	names  []string
+	action string
+	// errno is returned by the system calls with the errno action, EPERM
+	// when unset.
+	errno int
+	args  []seccompArg
+
+	includesCaps []string
+	excludesCaps []string
+
+	// includesArches and excludesArches restrict the rule to some of the
+	// architectures of the process, by their profile names.
+	includesArches []string
+	excludesArches []string
+
+	// minKernel, when set, restricts the rule to kernels of at least this
+	// <major>.<minor> version, e.g. once a system call stopped being unsafe.
+	minKernel string
+}
+
+// seccompArg compares the argument at index with value. The masked equality
+// compares the argument masked with value to valueTwo.
+type seccompArg struct {
+	index    uint
+	value    uint64
+	valueTwo uint64
+	op       string
+}
+
+// namespaceFlags are the clone flags creating namespaces.
+const namespaceFlags = syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUSER |
+	syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | cloneNewCgroup
+
+// defaultSeccompProfile is the seccomp profile of containers, as with Docker:
+// it blocks the system calls which are not namespaced, such as changing the
+// time or loading kernel modules, or which have been used to escape
+// containers, such as mounting filesystems or creating namespaces. Most are
+// allowed again with the capability they require.
+//
+// ptrace is allowed: tracing processes of other users requires the
+// SYS_PTRACE capability, which is not a default one.
+var defaultSeccompProfile = seccompProfile{
+	defaultAction: actAllow,
+	syscalls: []seccompRule{
+		{names: []string{"acct"}, action: actErrno, excludesCaps: []string{"SYS_PACCT"}},
+		{names: []string{"add_key", "keyctl", "request_key"}, action: actErrno},
+		{names: []string{"clock_adjtime", "clock_settime", "settimeofday", "stime"}, action: actErrno, excludesCaps: []string{"SYS_TIME"}},
+		{names: []string{"create_module", "delete_module", "finit_module", "get_kernel_syms", "init_module", "query_module"}, action: actErrno, excludesCaps: []string{"SYS_MODULE"}},
+		{names: []string{"get_mempolicy", "mbind", "move_pages", "set_mempolicy"}, action: actErrno, excludesCaps: []string{"SYS_NICE"}},
+		{names: []string{"ioperm", "iopl"}, action: actErrno, excludesCaps: []string{"SYS_RAWIO"}},
+		{names: []string{"kcmp", "process_vm_readv", "process_vm_writev"}, action: actErrno, excludesCaps: []string{"SYS_PTRACE"}},
+		{names: []string{"kexec_file_load", "kexec_load", "reboot"}, action: actErrno, excludesCaps: []string{"SYS_BOOT"}},
+		{names: []string{"open_by_handle_at"}, action: actErrno, excludesCaps: []string{"DAC_READ_SEARCH"}},
+		{names: []string{"syslog"}, action: actErrno, excludesCaps: []string{"SYSLOG"}},
+		{names: []string{"nfsservctl", "_sysctl", "sysfs", "uselib", "userfaultfd", "ustat", "vm86", "vm86old"}, action: actErrno},
+		{
+			names: []string{
+				"bpf", "fanotify_init", "fsconfig", "fsmount", "fsopen", "fspick", "lookup_dcookie", "mount", "mount_setattr",
+				"move_mount", "name_to_handle_at", "open_tree", "perf_event_open", "pivot_root", "quotactl", "setns",
+				"swapoff", "swapon", "umount", "umount2", "unshare", "vhangup",
+			},
+			action:       actErrno,
+			excludesCaps: []string{"SYS_ADMIN"},
+		},
+
+		// Creating namespaces with clone requires SYS_ADMIN too, and clone3,
+		// whose flags cannot be filtered, fails as unsupported so that the C
+		// libraries fall back to clone.
+		{names: []string{"clone"}, action: actAllow, args: []seccompArg{{index: 0, value: namespaceFlags, valueTwo: 0, op: cmpMaskedEqual}}, excludesCaps: []string{"SYS_ADMIN"}},
+		{names: []string{"clone"}, action: actErrno, excludesCaps: []string{"SYS_ADMIN"}},
+		{names: []string{"clone3"}, action: actErrno, errno: int(syscall.ENOSYS), excludesCaps: []string{"SYS_ADMIN"}},
+	},
+}
+
+// Seccomp constants missing from the syscall package.
+const (
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetKillThread  = 0x00000000
+	seccompRetTrap        = 0x00030000
+	seccompRetErrno       = 0x00050000
+	seccompRetTrace       = 0x7ff00000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+
+	// The offsets of the fields of struct seccomp_data, the input of the
+	// filters.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+)
+
+// seccompReturn returns the filter return value of an action.
+func seccompReturn(action string, errno int) (uint32, error) {
+	switch action {
+	case actAllow:
+		return seccompRetAllow, nil
+	case actErrno:
+		if errno == 0 {
+			errno = int(syscall.EPERM)
+		}
+		return seccompRetErrno | uint32(errno)&0xffff, nil
+	case actKill, actKillThread:
+		return seccompRetKillThread, nil
+	case actKillProcess:
+		return seccompRetKillProcess, nil
+	case actTrap:
+		return seccompRetTrap, nil
+	case actLog:
+		return seccompRetLog, nil
+	case actTrace:
+		return seccompRetTrace | uint32(errno)&0xffff, nil
+	default:
+		return 0, fmt.Errorf("unsupported seccomp action %q", action)
+	}
+}
+
+// applies tells whether the rule applies to a process holding the
+// capabilities, on the running kernel.
+func (r seccompRule) applies(caps map[int]bool, kernel [2]int) bool {
+	if r.minKernel != "" {
+		min, err := parseKernelVersion(r.minKernel)
+		if err != nil || kernel[0] < min[0] || kernel[0] == min[0] && kernel[1] < min[1] {
+			return false
+		}
+	}
+	for _, name := range r.includesCaps {
+		if n, err := capabilityNumber(name); err != nil || !caps[n] {
+			return false
+		}
+	}
+	for _, name := range r.excludesCaps {
+		if n, err := capabilityNumber(name); err == nil && caps[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// compile compiles the profile into a BPF program filtering the system calls
+// of a process holding the named capabilities. The system calls of each
+// architecture the process may use, the native and compat ones, are checked
+// in a section of their own, those of other architectures killing it. System
+// calls unknown to an architecture are skipped.
+func (p seccompProfile) compile(capabilities []string) ([]syscall.SockFilter, error) {
+	if auditArch == 0 {
+		return nil, fmt.Errorf("seccomp filters are not supported on this architecture")
+	}
+
+	caps := map[int]bool{}
+	for _, name := range capabilities {
+		n, err := capabilityNumber(name)
+		if err != nil {
+			return nil, err
+		}
+		caps[n] = true
+	}
+	kernel, err := kernelVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	// The x32 system calls share the section of the x86-64 ones, their
+	// numbers being distinct.
+	native := syscallArchs[runtime.GOARCH]
+	var audits []uint32
+	archs := map[uint32][]syscallArch{}
+	for _, arch := range append([]syscallArch{native}, native.compat...) {
+		if archs[arch.auditArch] == nil {
+			audits = append(audits, arch.auditArch)
+		}
+		archs[arch.auditArch] = append(archs[arch.auditArch], arch)
+	}
+
+	sections := make([][]syscall.SockFilter, len(audits))
+	for i := range sections {
+		sections[i] = []syscall.SockFilter{bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataNr)}
+	}
+	for _, r := range p.syscalls {
+		if !r.applies(caps, kernel) {
+			continue
+		}
+
+		ret, err := seccompReturn(r.action, r.errno)
+		if err != nil {
+			return nil, err
+		}
+		checks, err := compileArgs(r.args)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, audit := range audits {
+			for _, arch := range archs[audit] {
+				if !archIncluded(arch.seccompArch, r.includesArches, r.excludesArches) {
+					continue
+				}
+				for _, name := range r.names {
+					if nr, ok := arch.numbers[name]; ok {
+						sections[i] = append(sections[i], syscallBlock(uint32(nr), checks, ret)...)
+					}
+				}
+			}
+		}
+	}
+
+	ret, err := seccompReturn(p.defaultAction, p.defaultErrno)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sections are too far apart for conditional jumps, limited to 255
+	// instructions, so the architecture checks jump to them unconditionally.
+	prog := []syscall.SockFilter{bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataArch)}
+	start := 1 + 2*len(audits) + 1
+	for i, audit := range audits {
+		prog = append(prog,
+			bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, audit, 0, 1),
+			bpfStmt(syscall.BPF_JMP|syscall.BPF_JA, uint32(start-len(prog)-2)),
+		)
+		start += len(sections[i]) + 1
+	}
+	prog = append(prog, bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProcess))
+	for _, section := range sections {
+		prog = append(prog, section...)
+		prog = append(prog, bpfStmt(syscall.BPF_RET|syscall.BPF_K, ret))
+	}
+
+	return prog, nil
+}
+
+// Jump targets of the argument checks, resolved by syscallBlock: the next
+// check, or the end of the block when the arguments do not match.
+const (
+	jumpNext = 0xfe
+	jumpFail = 0xff
+)
+
+// syscallBlock returns the instructions returning ret for the system call
+// number nr, once its arguments checked. The accumulator holds the system
+// call number before and after the block.
+func syscallBlock(nr uint32, checks [][]syscall.SockFilter, ret uint32) []syscall.SockFilter {
+	n := 1
+	for _, c := range checks {
+		n += len(c)
+	}
+
+	if len(checks) == 0 {
+		return []syscall.SockFilter{
+			bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, nr, 0, 1),
+			bpfStmt(syscall.BPF_RET|syscall.BPF_K, ret),
+		}
+	}
+
+	// The checks load the arguments, so the system call number is loaded
+	// again, after the return, when they fail.
+	block := []syscall.SockFilter{bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, nr, 0, uint8(n))}
+	for _, c := range checks {
+		start := len(block)
+		for i, ins := range c {
+			at := start + i
+			next := start + len(c)
+			ins.Jt = resolveJump(ins.Jt, at, next, n+1)
+			ins.Jf = resolveJump(ins.Jf, at, next, n+1)
+			block = append(block, ins)
+		}
+	}
+	return append(block,
+		bpfStmt(syscall.BPF_RET|syscall.BPF_K, ret),
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataNr),
+	)
+}
+
+// resolveJump returns the offset of the jump target from the instruction at
+// index at, given the index of the next check and of the failure one.
+func resolveJump(target uint8, at, next, fail int) uint8 {
+	switch target {
+	case jumpNext:
+		return uint8(next - at - 1)
+	case jumpFail:
+		return uint8(fail - at - 1)
+	}
+	return target
+}
+
+// compileArgs returns the instructions of each argument comparison, with
+// symbolic jump targets. Arguments are 64-bit, compared by halves, high first.
+func compileArgs(args []seccompArg) ([][]syscall.SockFilter, error) {
+	var checks [][]syscall.SockFilter
+	for _, a := range args {
+		if a.index > 5 {
+			return nil, fmt.Errorf("invalid seccomp argument index %d", a.index)
+		}
+
+		offset := uint32(seccompDataArgs + 8*a.index)
+		loadHigh := bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, offset+4)
+		loadLow := bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, offset)
+		high, low := uint32(a.value>>32), uint32(a.value)
+		jeq := uint16(syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K)
+		jgt := uint16(syscall.BPF_JMP | syscall.BPF_JGT | syscall.BPF_K)
+		jge := uint16(syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K)
+
+		var c []syscall.SockFilter
+		switch a.op {
+		case cmpEqual:
+			c = []syscall.SockFilter{loadHigh, bpfJump(jeq, high, 0, jumpFail), loadLow, bpfJump(jeq, low, jumpNext, jumpFail)}
+		case cmpNotEqual:
+			c = []syscall.SockFilter{loadHigh, bpfJump(jeq, high, 0, jumpNext), loadLow, bpfJump(jeq, low, jumpFail, jumpNext)}
+		case cmpGreater:
+			c = []syscall.SockFilter{loadHigh, bpfJump(jgt, high, jumpNext, 0), bpfJump(jeq, high, 0, jumpFail), loadLow, bpfJump(jgt, low, jumpNext, jumpFail)}
+		case cmpGreaterEqual:
+			c = []syscall.SockFilter{loadHigh, bpfJump(jgt, high, jumpNext, 0), bpfJump(jeq, high, 0, jumpFail), loadLow, bpfJump(jge, low, jumpNext, jumpFail)}
+		case cmpLess:
+			c = []syscall.SockFilter{loadHigh, bpfJump(jge, high, 0, jumpNext), bpfJump(jeq, high, 0, jumpFail), loadLow, bpfJump(jge, low, jumpFail, jumpNext)}
+		case cmpLessEqual:
+			c = []syscall.SockFilter{loadHigh, bpfJump(jge, high, 0, jumpNext), bpfJump(jeq, high, 0, jumpFail), loadLow, bpfJump(jgt, low, jumpFail, jumpNext)}
+		case cmpMaskedEqual:
+			and := uint16(syscall.BPF_ALU | syscall.BPF_AND | syscall.BPF_K)
+			c = []syscall.SockFilter{
+				loadHigh, bpfStmt(and, high), bpfJump(jeq, uint32(a.valueTwo>>32), 0, jumpFail),
+				loadLow, bpfStmt(and, low), bpfJump(jeq, uint32(a.valueTwo), jumpNext, jumpFail),
+			}
+		default:
+			return nil, fmt.Errorf("unsupported seccomp comparison %q", a.op)
+		}
+		checks = append(checks, c)
+	}
+
+	return checks, nil
+}
+
+func bpfStmt(code uint16, k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// installSeccomp installs the filter on the current thread, and the commands
+// it executes. It requires the SYS_ADMIN capability, or no new privileges.
+func installSeccomp(filter []syscall.SockFilter) error {
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("failed to install the seccomp filter: %w", errno)
+	}
+	return nil
+}
+
+// seccompProfileJSON is a seccomp profile in the Docker format.
+type seccompProfileJSON struct {
+	DefaultAction   string   `json:"defaultAction"`
+	DefaultErrnoRet *int     `json:"defaultErrnoRet"`
+	Architectures   []string `json:"architectures"`
+	Syscalls        []struct {
+		Name     string   `json:"name"`
+		Names    []string `json:"names"`
+		Action   string   `json:"action"`
+		ErrnoRet *int     `json:"errnoRet"`
+		Args     []struct {
+			Index    uint   `json:"index"`
+			Value    uint64 `json:"value"`
+			ValueTwo uint64 `json:"valueTwo"`
+			Op       string `json:"op"`
+		} `json:"args"`
+		Includes seccompFilterJSON `json:"includes"`
+		Excludes seccompFilterJSON `json:"excludes"`
+	} `json:"syscalls"`
+}
+
+// seccompFilterJSON restricts a rule of a Docker seccomp profile to some
+// architectures, capabilities or kernels.
+type seccompFilterJSON struct {
+	Arches    []string `json:"arches"`
+	Caps      []string `json:"caps"`
+	MinKernel string   `json:"minKernel"`
+}
+
+// loadSeccompProfile loads the seccomp profile of a container: the default
+// one, or the one at path in the Docker format.
+func loadSeccompProfile(path string) (seccompProfile, error) {
+	if path == seccompDefault {
+		return defaultSeccompProfile, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return seccompProfile{}, fmt.Errorf("failed to read the seccomp profile: %w", err)
+	}
+
+	var p seccompProfileJSON
+	if err := json.Unmarshal(data, &p); err != nil {
+		return seccompProfile{}, fmt.Errorf("invalid seccomp profile %s: %w", path, err)
+	}
+
+	if p.DefaultAction == "" {
+		return seccompProfile{}, fmt.Errorf("invalid seccomp profile %s: missing defaultAction", path)
+	}
+	profile := seccompProfile{defaultAction: p.DefaultAction}
+	if p.DefaultErrnoRet != nil {
+		profile.defaultErrno = *p.DefaultErrnoRet
+	}
+
+	// The architectures of the process are filtered whatever the ones the
+	// profile lists, but their names must be valid.
+	for _, arch := range p.Architectures {
+		if !strings.HasPrefix(arch, "SCMP_ARCH_") {
+			return seccompProfile{}, fmt.Errorf("invalid seccomp profile %s: unknown architecture %q", path, arch)
+		}
+	}
+
+	for _, s := range p.Syscalls {
+		if s.Includes.MinKernel != "" {
+			if _, err := parseKernelVersion(s.Includes.MinKernel); err != nil {
+				return seccompProfile{}, fmt.Errorf("invalid seccomp profile %s: %w", path, err)
+			}
+		}
+
+		r := seccompRule{
+			names:          s.Names,
+			action:         s.Action,
+			includesCaps:   s.Includes.Caps,
+			excludesCaps:   s.Excludes.Caps,
+			includesArches: s.Includes.Arches,
+			excludesArches: s.Excludes.Arches,
+			minKernel:      s.Includes.MinKernel,
+		}
+		if s.Name != "" {
+			r.names = append(r.names, s.Name)
+		}
+		if len(r.names) == 0 {
+			return seccompProfile{}, fmt.Errorf("invalid seccomp profile %s: rule without system call names", path)
+		}
+		if s.ErrnoRet != nil {
+			r.errno = *s.ErrnoRet
+		}
+		for _, a := range s.Args {
+			r.args = append(r.args, seccompArg{index: a.Index, value: a.Value, valueTwo: a.ValueTwo, op: a.Op})
+		}
+		profile.syscalls = append(profile.syscalls, r)
+	}
+
+	return profile, nil
+}
+
+// archIncluded tells whether the architecture is included by a rule
+// restricted to, or excluding, some architectures.
+func archIncluded(arch string, includes, excludes []string) bool {
+	for _, a := range excludes {
+		if a == arch {
+			return false
+		}
+	}
+	if len(includes) == 0 {
+		return true
+	}
+	for _, a := range includes {
+		if a == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// kernelVersion returns the major and minor version of the running kernel.
+func kernelVersion() ([2]int, error) {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return [2]int{}, err
+	}
+
+	var release []byte
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	return parseKernelVersion(string(release))
+}
+
+// parseKernelVersion parses the <major>.<minor> prefix of a kernel version,
+// such as 5.15.0-91-generic.
+func parseKernelVersion(version string) ([2]int, error) {
+	fields := strings.SplitN(version, ".", 3)
+	if len(fields) < 2 {
+		return [2]int{}, fmt.Errorf("invalid kernel version %q", version)
+	}
+
+	var v [2]int
+	for i := range v {
+		digits := fields[i]
+		if end := strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }); end >= 0 {
+			digits = digits[:end]
+		}
+		n, err := strconv.Atoi(digits)
+		if err != nil {
+			return [2]int{}, fmt.Errorf("invalid kernel version %q", version)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
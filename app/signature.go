@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+// cosignSignatureAnnotation is the layer annotation holding the signature of
+// a cosign signature payload.
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+// signaturePayload is the cosign simple signing payload, naming the signed
+// manifest digest.
+type signaturePayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// verifySignature checks the image has a cosign signature of its manifest
+// digest made with the public key at keyPath. Signatures are stored by cosign
+// in the image repository, under the sha256-<hex>.sig tag.
+func verifySignature(image string, manifest manifestResponse, keyPath string) error {
+	if isLocalSource(image) {
+		return fmt.Errorf("signature verification is only supported for registry images")
+	}
+
+	key, err := readPublicKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	ref, err := parseReference(image)
+	if err != nil {
+		return err
+	}
+	ref.tag = strings.Replace(manifest.digest(), ":", "-", 1) + ".sig"
+	ref.digest = ""
+
+	r, err := registryLogin(ref)
+	if err != nil {
+		return err
+	}
+
+	raw, _, err := r.fetchRawManifest(mediaTypeOCIManifest, mediaTypeDockerManifest)
+	if err != nil {
+		return fmt.Errorf("no signature found for %s: %w", image, err)
+	}
+
+	var signatures struct {
+		Layers []struct {
+			Digest      string            `json:"digest"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(raw, &signatures); err != nil {
+		return err
+	}
+
+	for _, l := range signatures.Layers {
+		signature, err := base64.StdEncoding.DecodeString(l.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(signature) == 0 {
+			continue
+		}
+
+		payload, err := r.readBlob(l.Digest)
+		if err != nil {
+			return err
+		}
+
+		if err := verifyPayload(key, payload, signature, manifest.digest()); err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no valid signature found for %s", image)
+}
+
+// verifyPayload checks the signature of the payload, and that it signs the
+// manifest digest.
+func verifyPayload(key crypto.PublicKey, payload, signature []byte, digest string) error {
+	hash := sha256.Sum256(payload)
+
+	var valid bool
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		var sig struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+			return err
+		}
+		valid = ecdsa.Verify(key, hash[:], sig.R, sig.S)
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, payload, signature)
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+
+	var p signaturePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+
+	if p.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("signature is for %s", p.Critical.Image.DockerManifestDigest)
+	}
+
+	return nil
+}
+
+// readPublicKey reads a PEM encoded public key, as written by cosign
+// generate-key-pair.
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM encoded public key", path)
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// readBlob reads the blob from the registry, checking its content matches the
+// digest.
+func (r *registry) readBlob(digest string) ([]byte, error) {
+	body, _, err := r.blobSource(digest)()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if actual := fmt.Sprintf("sha256:%x", sha256.Sum256(data)); actual != digest {
+		return nil, fmt.Errorf("digest mismatch: expected %s, got %s", digest, actual)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// networkSlirp is the network mode of containers reaching the host network
+// through slirp4netns, a user-mode network stack which works rootless.
+const networkSlirp = "slirp4netns"
+
+// slirpDNS is the address of the DNS forwarder of slirp4netns.
+const slirpDNS = "10.0.2.3"
+
+// slirpDevice is the network interface slirp4netns creates in containers,
+// and slirpMTU its MTU.
+const (
+	slirpDevice = "tap0"
+	slirpMTU    = 65520
+)
+
+// portMapping is a host port forwarded to a container port.
+type portMapping struct {
+	proto         string
+	hostIP        string
+	hostPort      int
+	containerPort int
+}
+
+// parsePublish parses a --publish value of the form
+// [<host ip>:]<host port>:<container port>[/<tcp|udp>].
+func parsePublish(spec string) (portMapping, error) {
+	p := portMapping{proto: "tcp", hostIP: "0.0.0.0"}
+
+	ports := spec
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		ports, p.proto = spec[:i], spec[i+1:]
+	}
+	if p.proto != "tcp" && p.proto != "udp" {
+		return portMapping{}, fmt.Errorf("invalid published port %q, expected tcp or udp", spec)
+	}
+
+	parts := strings.Split(ports, ":")
+	if len(parts) == 3 {
+		p.hostIP, parts = parts[0], parts[1:]
+	}
+	if len(parts) != 2 {
+		return portMapping{}, fmt.Errorf("invalid published port %q, expected [<host ip>:]<host port>:<container port>[/<tcp|udp>]", spec)
+	}
+
+	var err error
+	if p.hostPort, err = strconv.Atoi(parts[0]); err != nil {
+		return portMapping{}, fmt.Errorf("invalid published port %q: %w", spec, err)
+	}
+	if p.containerPort, err = strconv.Atoi(parts[1]); err != nil {
+		return portMapping{}, fmt.Errorf("invalid published port %q: %w", spec, err)
+	}
+
+	return p, nil
+}
+
+// startSlirp connects the network namespace of the process to the host
+// network with slirp4netns, and forwards the published ports to it. It
+// returns a function stopping slirp4netns.
+func startSlirp(pid int, ports []portMapping) (func(), error) {
+	dir, err := ioutil.TempDir("", "slirp")
+	if err != nil {
+		return nil, err
+	}
+	apiSocket := filepath.Join(dir, "api.sock")
+
+	// slirp4netns writes to the ready pipe once the network is configured,
+	// and exits when the exit pipe is closed.
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+
+	exitR, exitW, err := os.Pipe()
+	if err != nil {
+		_ = readyW.Close()
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("slirp4netns", "--configure", "--mtu="+strconv.Itoa(slirpMTU), "--disable-host-loopback", "--api-socket", apiSocket, "--ready-fd=3", "--exit-fd=4", strconv.Itoa(pid), slirpDevice)
+	cmd.Stderr = &stderr
+	cmd.ExtraFiles = []*os.File{readyW, exitR}
+
+	err = cmd.Start()
+	_ = readyW.Close()
+	_ = exitR.Close()
+	if err != nil {
+		_ = exitW.Close()
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+
+	stop := func() {
+		_ = exitW.Close()
+		_ = cmd.Wait()
+		_ = os.RemoveAll(dir)
+	}
+
+	if _, err := readyR.Read(make([]byte, 1)); err != nil {
+		stop()
+		return nil, fmt.Errorf("slirp4netns failed: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	for _, p := range ports {
+		if err := slirpForward(apiSocket, p); err != nil {
+			stop()
+			return nil, err
+		}
+	}
+
+	return stop, nil
+}
+
+// slirpForward forwards the host port to the container, through the API
+// socket of slirp4netns.
+func slirpForward(apiSocket string, p portMapping) error {
+	conn, err := net.Dial("unix", apiSocket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	req := map[string]interface{}{
+		"execute": "add_hostfwd",
+		"arguments": map[string]interface{}{
+			"proto":      p.proto,
+			"host_addr":  p.hostIP,
+			"host_port":  p.hostPort,
+			"guest_port": p.containerPort,
+		},
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	if err := conn.(*net.UnixConn).CloseWrite(); err != nil {
+		return err
+	}
+
+	var resp struct {
+		Error *struct {
+			Desc string `json:"desc"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("failed to publish port %d: %w", p.hostPort, err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("failed to publish port %d: %s", p.hostPort, resp.Error.Desc)
+	}
+
+	return nil
+}
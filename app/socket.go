@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation.
+const listenFDsStart = 3
+
+// parseExposedSocket parses an --expose-socket value of the form
+// <host socket>[:<container path>], the socket being mounted at the same path
+// in the container by default.
+func parseExposedSocket(spec string) (bindMount, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+
+	if parts[0] == "" || !filepath.IsAbs(parts[1]) {
+		return bindMount{}, fmt.Errorf("invalid socket specification %q, expected <host socket>[:<absolute container path>]", spec)
+	}
+
+	hostPath, err := filepath.Abs(parts[0])
+	if err != nil {
+		return bindMount{}, err
+	}
+
+	info, err := os.Stat(hostPath)
+	if err != nil {
+		return bindMount{}, err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return bindMount{}, fmt.Errorf("%s is not a unix socket", hostPath)
+	}
+
+	return bindMount{hostPath: hostPath, containerPath: filepath.Clean(parts[1])}, nil
+}
+
+// listener is a listening socket passed to the container process.
+type listener struct {
+	name string
+	file *os.File
+
+	// ln is the listener opened by openListener, closed along with file.
+	ln net.Listener
+}
+
+func (l listener) close() {
+	_ = l.file.Close()
+	if l.ln != nil {
+		_ = l.ln.Close()
+	}
+}
+
+// inheritedListeners returns the listening sockets passed to this process by
+// socket activation, following the LISTEN_FDS convention of systemd.
+func inheritedListeners() []listener {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]listener, n)
+	for i := range listeners {
+		listeners[i].name = "unknown"
+		if i < len(names) && names[i] != "" {
+			listeners[i].name = names[i]
+		}
+		listeners[i].file = os.NewFile(uintptr(listenFDsStart+i), listeners[i].name)
+	}
+
+	return listeners
+}
+
+// openListener opens the listening socket described by a --listen value of
+// the form [<network>:]<address>, the network defaulting to unix.
+func openListener(spec string) (listener, error) {
+	network, address := "unix", spec
+	if parts := strings.SplitN(spec, ":", 2); len(parts) == 2 {
+		switch parts[0] {
+		case "unix", "tcp", "tcp4", "tcp6":
+			network, address = parts[0], parts[1]
+		}
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return listener{}, err
+	}
+
+	// The listener is kept open until the container is removed, so that
+	// unix socket files are only unlinked then.
+	var f *os.File
+	switch ln := l.(type) {
+	case *net.UnixListener:
+		f, err = ln.File()
+	case *net.TCPListener:
+		f, err = ln.File()
+	}
+	if err != nil {
+		_ = l.Close()
+		return listener{}, err
+	}
+
+	return listener{name: listenerName(l.Addr()), file: f, ln: l}, nil
+}
+
+// listenerName names the listener in LISTEN_FDNAMES, whose names are colon
+// separated: unix sockets are named after their file, TCP sockets after their
+// port.
+func listenerName(addr net.Addr) string {
+	if addr, ok := addr.(*net.TCPAddr); ok {
+		return fmt.Sprintf("tcp-%d", addr.Port)
+	}
+
+	return filepath.Base(addr.String())
+}
+
+// listenEnv returns the environment variables announcing the listeners to the
+// container process. As it runs in a new PID namespace, its PID is always 1.
+func listenEnv(listeners []listener) []string {
+	names := make([]string, len(listeners))
+	for i, l := range listeners {
+		names[i] = l.name
+	}
+
+	return []string{
+		"LISTEN_PID=1",
+		fmt.Sprintf("LISTEN_FDS=%d", len(listeners)),
+		"LISTEN_FDNAMES=" + strings.Join(names, ":"),
+	}
+}
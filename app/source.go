@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// localSource is an image read from the local filesystem rather than pulled
+// from a registry.
+type localSource struct {
+	// description describes where the image is read from.
+	description string
+	manifest    manifestResponse
+
+	// blobSource returns the blobs of the image.
+	blobSource func(digest string) blobSource
+
+	// cleanup, when set, removes the files the image was unpacked to.
+	cleanup func()
+}
+
+// close releases the files of the source.
+func (src *localSource) close() {
+	if src.cleanup != nil {
+		src.cleanup()
+	}
+}
+
+// openLocalSource opens the image when it names a local source, as
+// oci:<layout directory>[:<tag>], oci-archive:<tarball>[:<tag>] or
+// docker-archive:<tarball>[:<image>]. It returns nil for registry images.
+func openLocalSource(image string) (*localSource, error) {
+	if !isLocalSource(image) {
+		return nil, nil
+	}
+
+	i := strings.Index(image, ":")
+
+	path, name := splitSourcePath(image[i+1:])
+	switch image[:i] {
+	case "oci":
+		return openLayoutSource(ociLayout{dir: path}, name, "OCI layout "+path)
+	case "oci-archive":
+		return openArchive(path, name, false)
+	case "docker-archive":
+		return openArchive(path, name, true)
+	}
+
+	return nil, nil
+}
+
+// isLocalSource reports whether the image names a local source rather than a
+// registry image.
+func isLocalSource(image string) bool {
+	for _, transport := range []string{"oci:", "oci-archive:", "docker-archive:"} {
+		if strings.HasPrefix(image, transport) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// openLayoutSource opens the image named name in the OCI layout.
+func openLayoutSource(layout ociLayout, name, description string) (*localSource, error) {
+	manifest, err := layout.manifest(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &localSource{
+		description: description,
+		manifest:    manifest,
+		blobSource:  layout.blobSource,
+	}, nil
+}
+
+// splitSourcePath splits <path>[:<name>], the path ending at the first colon
+// for which it exists, as names may contain colons too.
+func splitSourcePath(spec string) (string, string) {
+	for i, c := range spec {
+		if c != ':' {
+			continue
+		}
+
+		if _, err := os.Stat(spec[:i]); err == nil {
+			return spec[:i], spec[i+1:]
+		}
+	}
+
+	return spec, ""
+}
+
+// openImage returns the manifest of the image, copying it into the store from
+// its local source, or pulling it according to the pull policy.
+func openImage(s *store, image, policy string) (manifestResponse, error) {
+	src, err := openLocalSource(image)
+	if err != nil {
+		return manifestResponse{}, err
+	}
+
+	if src != nil {
+		defer src.close()
+
+		if err := s.importImage(src); err != nil {
+			return manifestResponse{}, fmt.Errorf("%s: %w", src.description, err)
+		}
+		return src.manifest, nil
+	}
+
+	ref, err := parseReference(image)
+	if err != nil {
+		return manifestResponse{}, err
+	}
+
+	return ensureImage(s, ref, policy)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+// Usage: your_docker.sh stats [options] [<container>...]
+//
+// Prints the resource usage of the running containers with resource limits,
+// or of the given ones.
+func statsCmd(argv []string) error {
+	statsFlags := newFlagSet("stats", "[options] [<container>...]")
+	addStoreFlags(statsFlags)
+	var placement cgroupPlacement
+	addCgroupFlags(statsFlags, &placement)
+	_ = statsFlags.Parse(argv)
+
+	ids, err := openIdentities()
+	if err != nil {
+		return err
+	}
+
+	var containers []string
+	for _, arg := range statsFlags.Args() {
+		id, err := ids.lookup(arg)
+		if err != nil {
+			return err
+		}
+		containers = append(containers, id)
+	}
+
+	if len(containers) == 0 {
+		if containers, err = cgroupIDs(placement); err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 3, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER ID\tNAME\tMEM USAGE / LIMIT\tPIDS / LIMIT")
+	for _, id := range containers {
+		cg, ok := openCgroup(id, placement)
+		if !ok {
+			return fmt.Errorf("container %s has no resource limits", shortID(id))
+		}
+
+		name := ids.nameOf(id)
+		if name == "" {
+			name = "--"
+		}
+
+		var usage, limit string
+		if unifiedHierarchy() {
+			usage, limit = cgroupStat(cg, "memory", "memory.current", formatBytes), cgroupStat(cg, "memory", "memory.max", formatBytes)
+		} else {
+			usage, limit = cgroupStat(cg, "memory", "memory.usage_in_bytes", formatBytes), cgroupStat(cg, "memory", "memory.limit_in_bytes", formatBytes)
+		}
+		pids := fmt.Sprintf("%s / %s", cgroupStat(cg, "pids", "pids.current", formatCount), cgroupStat(cg, "pids", "pids.max", formatCount))
+		fmt.Fprintf(w, "%s\t%s\t%s / %s\t%s\n", shortID(id), name, usage, limit, pids)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// v1Unlimited is the lowest value of cgroup v1 limits meaning unlimited, as
+// they are set to the largest multiple of the page size.
+const v1Unlimited = 1 << 62
+
+// cgroupStat returns the value of the cgroup interface file, formatted with
+// format, "unlimited" for unlimited limits, or "--" when the controller of
+// the file is not enabled.
+func cgroupStat(cg *cgroup, controller, name string, format func(int64) string) string {
+	value, err := cg.read(controller, name)
+	if err != nil {
+		return "--"
+	}
+
+	if value == "max" {
+		return "unlimited"
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return "--"
+	} else if n >= v1Unlimited {
+		return "unlimited"
+	}
+
+	return format(n)
+}
+
+// formatCount formats a number of processes.
+func formatCount(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
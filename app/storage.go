@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// storageDriver assembles the root filesystem of containers from the layers
+// of their image.
+type storageDriver interface {
+	// unpack prepares the stored layer for the root filesystem created in
+	// dir. Layers are unpacked in order, from the bottom one.
+	unpack(s *store, l layer, dir string) error
+
+	// mount returns the root filesystem created in dir once all the image
+	// layers are unpacked, and a function releasing it, if removing dir is
+	// not enough. Its files get the SELinux label, when set.
+	mount(s *store, manifest manifestResponse, dir, label string) (string, func(), error)
+}
+
+// storageDrivers are the storage drivers, by name.
+var storageDrivers = map[string]storageDriver{
+	"vfs":            vfsDriver{},
+	"overlay2":       overlayDriver{},
+	"fuse-overlayfs": fuseOverlayDriver{},
+}
+
+// openStorageDriver returns the named storage driver. Without a name,
+// overlay2 is used when the kernel supports overlayfs, and vfs otherwise.
+// Rootless containers use fuse-overlayfs when installed instead of overlay2,
+// as overlay2 layers hold whiteouts and attributes only root can create.
+func openStorageDriver(name string) (string, storageDriver, error) {
+	if name == "" {
+		name = defaultStorageDriver()
+	}
+
+	driver, ok := storageDrivers[name]
+	if !ok {
+		var names []string
+		for name := range storageDrivers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", nil, fmt.Errorf("unknown storage driver %s, expected one of %s", name, strings.Join(names, ", "))
+	}
+
+	return name, driver, nil
+}
+
+func defaultStorageDriver() string {
+	if !rootless() {
+		if kernelFilesystem("overlay") {
+			return "overlay2"
+		}
+		return "vfs"
+	}
+
+	if _, err := exec.LookPath("fuse-overlayfs"); err == nil && kernelFilesystem("fuse") {
+		return "fuse-overlayfs"
+	}
+	return "vfs"
+}
+
+// kernelFilesystem reports whether the kernel supports the filesystem type.
+func kernelFilesystem(fstype string) bool {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == fstype {
+			return true
+		}
+	}
+
+	return false
+}
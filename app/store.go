@@ -0,0 +1,400 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// dataRoot is the directory holding the local image store.
+var dataRoot = defaultDataRoot()
+
+// store is the local image store. Manifests, configs and layers are stored
+// as content addressed blobs under blobs/sha256, and images.json maps image
+// references to the digest of their manifest. Layers are unpacked under
+// layers, to be mounted as the lower directories of container overlays.
+type store struct {
+	root string
+}
+
+// imageConfig is the subset of the image configuration used by the runtime.
+type imageConfig struct {
+	Architecture string `json:"architecture,omitempty"`
+	OS           string `json:"os,omitempty"`
+	Config       struct {
+		User       string   `json:"User,omitempty"`
+		Env        []string `json:"Env,omitempty"`
+		Entrypoint []string `json:"Entrypoint,omitempty"`
+		Cmd        []string `json:"Cmd,omitempty"`
+		WorkingDir string   `json:"WorkingDir,omitempty"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type,omitempty"`
+		DiffIDs []string `json:"diff_ids,omitempty"`
+	} `json:"rootfs"`
+}
+
+func openStore() (*store, error) {
+	s := &store{root: dataRoot}
+	if err := os.MkdirAll(filepath.Join(s.root, "blobs", "sha256"), 0700); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *store) blobPath(digest string) string {
+	return filepath.Join(s.root, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+func (s *store) hasBlob(digest string) bool {
+	_, err := os.Stat(s.blobPath(digest))
+	return err == nil
+}
+
+func (s *store) readBlob(digest string) ([]byte, error) {
+	return ioutil.ReadFile(s.blobPath(digest))
+}
+
+// tempFile creates a temporary file in the store, to be ingested as a blob.
+func (s *store) tempFile() (*os.File, error) {
+	return ioutil.TempFile(filepath.Join(s.root, "blobs"), "tmp-")
+}
+
+// ingest moves the temporary file at path into the store, after checking its
+// content matches the digest.
+func (s *store) ingest(path, digest string) error {
+	actual, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+
+	if actual != digest {
+		_ = os.Remove(path)
+		return fmt.Errorf("digest mismatch: expected %s, got %s", digest, actual)
+	}
+
+	return os.Rename(path, s.blobPath(digest))
+}
+
+// putBlob stores data as a blob, returning its digest.
+func (s *store) putBlob(data []byte) (string, error) {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	if s.hasBlob(digest) {
+		return digest, nil
+	}
+
+	f, err := s.tempFile()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+
+	return digest, os.Rename(f.Name(), s.blobPath(digest))
+}
+
+// fetchBlob downloads the blob from the registry, unless already stored.
+func (s *store) fetchBlob(r *registry, digest string, p *progress) error {
+	if s.hasBlob(digest) {
+		return nil
+	}
+
+	f, err := s.tempFile()
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+
+	if err := r.downloadBlob(digest, f.Name(), p); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return s.ingest(f.Name(), digest)
+}
+
+// copyBlob copies the blob from the source, unless already stored.
+func (s *store) copyBlob(src blobSource, digest string) error {
+	if s.hasBlob(digest) {
+		return nil
+	}
+
+	r, _, err := src()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := s.tempFile()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return s.ingest(f.Name(), digest)
+}
+
+// importImage copies the manifest, config and layers of an image from its
+// local source into the store.
+func (s *store) importImage(src *localSource) error {
+	if _, err := s.putBlob(src.manifest.raw); err != nil {
+		return err
+	}
+
+	for _, blob := range append([]layer{src.manifest.Config}, src.manifest.Layers...) {
+		if err := s.copyBlob(src.blobSource(blob.Digest), blob.Digest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *store) manifest(digest string) (manifestResponse, error) {
+	raw, err := s.readBlob(digest)
+	if err != nil {
+		return manifestResponse{}, err
+	}
+
+	var manifest manifestResponse
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return manifestResponse{}, err
+	}
+	if err := manifest.validate(); err != nil {
+		return manifestResponse{}, err
+	}
+	manifest.raw = raw
+
+	return manifest, nil
+}
+
+func (s *store) config(digest string) (imageConfig, error) {
+	raw, err := s.readBlob(digest)
+	if err != nil {
+		return imageConfig{}, err
+	}
+
+	var config imageConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return imageConfig{}, err
+	}
+
+	return config, nil
+}
+
+// lock takes an exclusive lock on the image index until the returned
+// function is called.
+func (s *store) lock() (func(), error) {
+	return lockFile(filepath.Join(s.root, "images.lock"))
+}
+
+// lockFile takes an exclusive lock on the given file, creating it if needed,
+// until the returned function is called.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return func() { _ = f.Close() }, nil
+}
+
+// images returns the image index, mapping references to manifest digests.
+func (s *store) images() (map[string]string, error) {
+	images := map[string]string{}
+
+	data, err := ioutil.ReadFile(filepath.Join(s.root, "images.json"))
+	if os.IsNotExist(err) {
+		return images, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &images); err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// tagImage records that the reference points to the given manifest.
+func (s *store) tagImage(ref reference, manifestDigest string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	images, err := s.images()
+	if err != nil {
+		return err
+	}
+	images[ref.String()] = manifestDigest
+
+	data, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.root, "images.json")
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// localImage returns the manifest of the stored image, checking all its blobs
+// are present.
+func (s *store) localImage(ref reference) (manifestResponse, error) {
+	images, err := s.images()
+	if err != nil {
+		return manifestResponse{}, err
+	}
+
+	digest, ok := images[ref.String()]
+	if !ok {
+		return manifestResponse{}, fmt.Errorf("no such image: %s", ref)
+	}
+
+	manifest, err := s.manifest(digest)
+	if err != nil {
+		return manifestResponse{}, err
+	}
+
+	for _, blob := range append([]layer{manifest.Config}, manifest.Layers...) {
+		if !s.hasBlob(blob.Digest) {
+			return manifestResponse{}, fmt.Errorf("missing blob %s", blob.Digest)
+		}
+	}
+
+	return manifest, nil
+}
+
+// pullImage fetches the manifest, config and layers of the image into the
+// store, and tags it. Layers already stored, e.g. shared with the previous
+// version of the image, are reused rather than downloaded again.
+//
+// Layers are downloaded concurrently. When unpack is not nil, it is called
+// with each layer in order, as soon as it and the layers below it are stored,
+// so that unpacking overlaps with the remaining downloads.
+func (s *store) pullImage(r *registry, manifest manifestResponse, unpack func(layer) error) error {
+	if images, err := s.images(); err == nil {
+		if previous, ok := images[r.ref.String()]; ok && previous != manifest.digest() && !quietPull {
+			fmt.Fprintf(os.Stderr, "Updating %s from %s to %s\n", r.ref, shortID(strings.TrimPrefix(previous, "sha256:")), shortID(strings.TrimPrefix(manifest.digest(), "sha256:")))
+		}
+	}
+
+	if _, err := s.putBlob(manifest.raw); err != nil {
+		return err
+	}
+
+	if err := s.fetchBlob(r, manifest.Config.Digest, nil); err != nil {
+		return err
+	}
+
+	type download struct {
+		done chan struct{}
+		err  error
+	}
+
+	reused := 0
+	slots := make(chan struct{}, maxConcurrentDownloads)
+	downloads := map[string]*download{}
+	for _, l := range manifest.Layers {
+		if _, ok := downloads[l.Digest]; ok {
+			continue
+		}
+
+		d := &download{done: make(chan struct{})}
+		downloads[l.Digest] = d
+
+		p := newProgress(l.Digest, l.Size)
+		if s.hasBlob(l.Digest) {
+			reused++
+			p.status("Already exists")
+			close(d.done)
+			continue
+		}
+
+		go func(digest string) {
+			defer close(d.done)
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			if d.err = s.fetchBlob(r, digest, p); d.err == nil {
+				p.status("Download complete")
+			}
+		}(l.Digest)
+	}
+
+	// All downloads are waited for, even after a failure, so that none is
+	// left writing to the store.
+	var err error
+	for _, l := range manifest.Layers {
+		d := downloads[l.Digest]
+		<-d.done
+
+		if err == nil {
+			err = d.err
+		}
+		if err == nil && unpack != nil {
+			err = unpack(l)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if !quietPull {
+		fmt.Fprintf(os.Stderr, "%d of %d layers reused\n", reused, len(downloads))
+	}
+
+	return s.tagImage(r.ref, manifest.digest())
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
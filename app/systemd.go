@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scopePrefix prefixes the names of the systemd scopes of containers.
+const scopePrefix = "mydocker-"
+
+// scopeName returns the name of the systemd scope of the container.
+func scopeName(id string) string {
+	return scopePrefix + id + ".scope"
+}
+
+// slice returns the systemd slice of containers: the parent one, or the
+// system slice, or the user one for rootless containers.
+func (p cgroupPlacement) slice() string {
+	if p.parent != "" {
+		return p.parent
+	} else if rootless() {
+		return "user.slice"
+	}
+	return "system.slice"
+}
+
+// slicePath returns the path of the cgroup of the systemd slice in the cgroup
+// hierarchies: slices are nested in the slices named after the dash separated
+// prefixes of their name, as a-b.slice in a.slice.
+func slicePath(slice string) (string, error) {
+	if slice == "-.slice" {
+		return "/", nil
+	}
+
+	name := strings.TrimSuffix(slice, ".slice")
+	if name == slice || name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid systemd slice %q, expected a name such as system.slice", slice)
+	}
+
+	path, prefix := "/", ""
+	for _, part := range strings.Split(name, "-") {
+		if part == "" {
+			return "", fmt.Errorf("invalid systemd slice %q, expected a name such as system.slice", slice)
+		}
+		prefix += part
+		path = filepath.Join(path, prefix+".slice")
+		prefix += "-"
+	}
+
+	return path, nil
+}
+
+// callSystemd calls a method of the systemd manager through its D-Bus API,
+// with busctl. Rootless containers use the manager of the user.
+func callSystemd(method, signature string, args ...string) error {
+	busArgs := []string{"call", "--quiet", "org.freedesktop.systemd1", "/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager", method, signature}
+	if rootless() {
+		busArgs = append([]string{"--user"}, busArgs...)
+	}
+
+	out, err := exec.Command("busctl", append(busArgs, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", method, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// startScope starts the systemd scope of the container with the process,
+// delegating its cgroup to the runtime, then sets the resource limits in it.
+// The scope of a previous container process is stopped first.
+func (cg *cgroup) startScope(pid int) error {
+	if len(cg.dirs) > 0 {
+		cg.kill()
+		cg.stopScope()
+	}
+
+	err := callSystemd("StartTransientUnit", "ssa(sv)a(sa(sv))", cg.scope, "fail", "3",
+		"PIDs", "au", "1", strconv.Itoa(pid),
+		"Slice", "s", cg.slice,
+		"Delegate", "b", "true",
+		"0")
+	if err != nil {
+		return fmt.Errorf("failed to start the %s systemd scope: %w", cg.scope, err)
+	}
+
+	// The scope is started asynchronously: its cgroups are known once the
+	// process was moved into them.
+	for i := 0; i < 100; i++ {
+		if cg.dirs, err = scopeDirs(pid, cg.scope); err != nil || len(cg.dirs) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		return err
+	} else if len(cg.dirs) == 0 {
+		return fmt.Errorf("timed out waiting for the %s systemd scope", cg.scope)
+	}
+
+	return cg.write(cg.files)
+}
+
+// stopScope stops the systemd scope of the container, and waits for its
+// cgroups to be removed.
+func (cg *cgroup) stopScope() {
+	_ = callSystemd("StopUnit", "ss", cg.scope, "replace")
+
+	for _, dir := range cg.dirs {
+		for i := 0; i < 100; i++ {
+			if _, err := os.Stat(dir); os.IsNotExist(err) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// scopeDirs returns the cgroup directories of the process by controller, as
+// cgroup dirs, when they are the ones of the scope.
+func scopeDirs(pid int, scope string) (map[string]string, error) {
+	mounts, err := cgroupMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Lines are formatted as <hierarchy id>:<controllers>:<path>, cgroup v2
+	// having no controllers.
+	dirs := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 || filepath.Base(fields[2]) != scope {
+			continue
+		}
+
+		for _, controller := range strings.Split(fields[1], ",") {
+			if mount, ok := mounts[controller]; ok {
+				dirs[controller] = filepath.Join(mount, fields[2])
+			}
+		}
+	}
+
+	return dirs, scanner.Err()
+}
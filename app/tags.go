@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+)
+
+// linkNext matches the next page of a paginated registry response, as
+// advertised by its Link header.
+var linkNext = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// Usage: your_docker.sh tags [options] <repository>
+func tagsCmd(argv []string) error {
+	tagsFlags := newFlagSet("tags", "[options] <repository>")
+	addRegistryFlags(tagsFlags)
+	pageSize := tagsFlags.Int("page-size", 100, "number of tags requested per page")
+	_ = tagsFlags.Parse(argv)
+
+	if tagsFlags.NArg() != 1 {
+		tagsFlags.Usage()
+		os.Exit(2)
+	}
+
+	ref, err := parseReference(tagsFlags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	r, err := registryLogin(ref)
+	if err != nil {
+		return err
+	}
+
+	err = r.listTags(*pageSize, func(tag string) {
+		fmt.Println(tag)
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// listTags calls fn with every tag of the repository, following the pages of
+// the tag list.
+func (r *registry) listTags(pageSize int, fn func(tag string)) error {
+	req, err := r.newRequest(http.MethodGet, fmt.Sprintf("tags/list?n=%d", pageSize))
+	if err != nil {
+		return err
+	}
+	next := req.URL
+
+	for next != nil {
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+
+		current := next
+		next = nil
+		err := registryRetry.do("listing tags", func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+			defer cancel()
+
+			req, err := http.NewRequest(http.MethodGet, current.String(), nil)
+			if err != nil {
+				return err
+			}
+			if r.token != "" {
+				req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", r.token))
+			}
+
+			resp, err := r.client.Do(req.WithContext(ctx))
+			if err != nil {
+				return retryable(err)
+			}
+			defer func() { _ = resp.Body.Close() }()
+
+			if err := checkStatus(resp, "failed to list tags"); err != nil {
+				return err
+			}
+
+			data, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return retryable(err)
+			}
+
+			if err := json.Unmarshal(data, &page); err != nil {
+				return err
+			}
+
+			if m := linkNext.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+				link, err := url.Parse(m[1])
+				if err != nil {
+					return fmt.Errorf("invalid Link header: %w", err)
+				}
+				next = current.ResolveReference(link)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, tag := range page.Tags {
+			fn(tag)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// tmpfsMount is a tmpfs mounted in the container.
+type tmpfsMount struct {
+	target string
+	flags  uintptr
+	data   string
+}
+
+// tmpfsFlags are the mount options of tmpfs mounts setting mount flags, and
+// whether they set or clear them.
+var tmpfsFlags = map[string]struct {
+	flag  uintptr
+	clear bool
+}{
+	"ro":          {syscall.MS_RDONLY, false},
+	"rw":          {syscall.MS_RDONLY, true},
+	"noexec":      {syscall.MS_NOEXEC, false},
+	"exec":        {syscall.MS_NOEXEC, true},
+	"nosuid":      {syscall.MS_NOSUID, false},
+	"suid":        {syscall.MS_NOSUID, true},
+	"nodev":       {syscall.MS_NODEV, false},
+	"dev":         {syscall.MS_NODEV, true},
+	"sync":        {syscall.MS_SYNCHRONOUS, false},
+	"async":       {syscall.MS_SYNCHRONOUS, true},
+	"dirsync":     {syscall.MS_DIRSYNC, false},
+	"noatime":     {syscall.MS_NOATIME, false},
+	"atime":       {syscall.MS_NOATIME, true},
+	"nodiratime":  {syscall.MS_NODIRATIME, false},
+	"diratime":    {syscall.MS_NODIRATIME, true},
+	"relatime":    {syscall.MS_RELATIME, false},
+	"norelatime":  {syscall.MS_RELATIME, true},
+	"strictatime": {syscall.MS_STRICTATIME, false},
+}
+
+// tmpfsOptions are the mount options of tmpfs passed as mount data.
+var tmpfsOptions = map[string]bool{
+	"size":      true,
+	"nr_blocks": true,
+	"nr_inodes": true,
+	"mode":      true,
+	"uid":       true,
+	"gid":       true,
+	"huge":      true,
+	"mpol":      true,
+}
+
+// parseTmpfs parses a <container path>[:<options>] value, the options being
+// comma separated mount flags, such as ro or exec, and tmpfs options, such as
+// size=256m or mode=1777. As with Docker, tmpfs are noexec, nosuid and nodev
+// by default.
+func parseTmpfs(spec string) (tmpfsMount, error) {
+	target, options := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		target, options = spec[:i], spec[i+1:]
+	}
+
+	if !filepath.IsAbs(target) || filepath.Clean(target) == "/" {
+		return tmpfsMount{}, fmt.Errorf("invalid tmpfs %q: the path must be absolute, and not /", spec)
+	}
+
+	m := tmpfsMount{target: filepath.Clean(target), flags: syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV}
+	var data []string
+	for _, option := range strings.Split(options, ",") {
+		if option == "" {
+			continue
+		}
+
+		if f, ok := tmpfsFlags[option]; ok {
+			if f.clear {
+				m.flags &^= f.flag
+			} else {
+				m.flags |= f.flag
+			}
+			continue
+		}
+
+		name := option
+		if i := strings.Index(option, "="); i >= 0 {
+			name = option[:i]
+		}
+		if !tmpfsOptions[name] || name == option {
+			return tmpfsMount{}, fmt.Errorf("invalid tmpfs %q: unknown option %q", spec, option)
+		}
+		data = append(data, option)
+	}
+	m.data = strings.Join(data, ",")
+
+	return m, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// rlimits are the resource limits settable with --ulimit, by name. The
+// syscall package misses most of them.
+var rlimits = map[string]int{
+	"as":         syscall.RLIMIT_AS,
+	"core":       syscall.RLIMIT_CORE,
+	"cpu":        syscall.RLIMIT_CPU,
+	"data":       syscall.RLIMIT_DATA,
+	"fsize":      syscall.RLIMIT_FSIZE,
+	"locks":      10,
+	"memlock":    8,
+	"msgqueue":   12,
+	"nice":       13,
+	"nofile":     syscall.RLIMIT_NOFILE,
+	"nproc":      6,
+	"rss":        5,
+	"rtprio":     14,
+	"rttime":     15,
+	"sigpending": 11,
+	"stack":      syscall.RLIMIT_STACK,
+}
+
+// ulimit is a resource limit of the container process.
+type ulimit struct {
+	resource int
+	limit    syscall.Rlimit
+}
+
+// parseUlimit parses a --ulimit value of the form <name>=<soft>[:<hard>], the
+// hard limit defaulting to the soft one, and -1 being unlimited.
+func parseUlimit(spec string) (ulimit, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return ulimit{}, fmt.Errorf("invalid ulimit %q, expected <name>=<soft>[:<hard>]", spec)
+	}
+
+	resource, ok := rlimits[parts[0]]
+	if !ok {
+		var names []string
+		for name := range rlimits {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return ulimit{}, fmt.Errorf("invalid ulimit %q, expected one of %s", parts[0], strings.Join(names, ", "))
+	}
+
+	values := strings.SplitN(parts[1], ":", 2)
+	soft, err := parseRlimit(values[0])
+	if err != nil {
+		return ulimit{}, fmt.Errorf("invalid ulimit %q: %w", spec, err)
+	}
+	hard := soft
+	if len(values) == 2 {
+		if hard, err = parseRlimit(values[1]); err != nil {
+			return ulimit{}, fmt.Errorf("invalid ulimit %q: %w", spec, err)
+		}
+	}
+	if soft > hard {
+		return ulimit{}, fmt.Errorf("invalid ulimit %q: the soft limit must not exceed the hard one", spec)
+	}
+
+	return ulimit{resource: resource, limit: syscall.Rlimit{Cur: soft, Max: hard}}, nil
+}
+
+// parseRlimit parses a limit, -1 being unlimited.
+func parseRlimit(value string) (uint64, error) {
+	if value == "-1" || value == "unlimited" {
+		return math.MaxUint64, nil
+	}
+
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// setUlimits sets the resource limits of the current process, inherited by
+// the command it executes.
+func setUlimits(specs []string) error {
+	for _, spec := range specs {
+		u, err := parseUlimit(spec)
+		if err != nil {
+			return err
+		}
+		if err := syscall.Setrlimit(u.resource, &u.limit); err != nil {
+			return fmt.Errorf("failed to set ulimit %s: %w", spec, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// version, releaseURL and releasePublicKey are set at build time with
+// -ldflags "-X main.version=...".
+var (
+	version          = "dev"
+	releaseURL       = ""
+	releasePublicKey = ""
+)
+
+// release describes the latest release, as served by the release endpoint.
+// Binaries are keyed by <os>/<arch>.
+type release struct {
+	Version  string                   `json:"version"`
+	Binaries map[string]releaseBinary `json:"binaries"`
+}
+
+// releaseBinary is a release binary, with its SHA-256 hash and the base64
+// Ed25519 signature of its content.
+type releaseBinary struct {
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+// Usage: your_docker.sh self-update [--check] [options]
+func selfUpdateCmd(argv []string) error {
+	updateFlags := newFlagSet("self-update", "[--check] [options]")
+	endpoint := updateFlags.String("release-url", releaseURL, "URL of the JSON document describing the latest release")
+	publicKey := updateFlags.String("public-key", releasePublicKey, "base64 Ed25519 public key the release binaries are signed with")
+	check := updateFlags.Bool("check", false, "only report whether an update is available")
+	_ = updateFlags.Parse(argv)
+
+	if *endpoint == "" || *publicKey == "" {
+		fmt.Fprintln(os.Stderr, "self-update: --release-url and --public-key are required by this build")
+		os.Exit(2)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(*publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key %q", *publicKey)
+	}
+
+	latest, base, err := fetchRelease(*endpoint)
+	if err != nil {
+		return err
+	}
+
+	if latest.Version == version {
+		fmt.Printf("Already up to date (%s)\n", version)
+		return nil
+	}
+
+	if *check {
+		fmt.Printf("Update available: %s -> %s\n", version, latest.Version)
+		return nil
+	}
+
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	binary, ok := latest.Binaries[platform]
+	if !ok {
+		return fmt.Errorf("release %s has no binary for %s", latest.Version, platform)
+	}
+
+	if err := selfUpdate(base, binary, ed25519.PublicKey(key)); err != nil {
+		return err
+	}
+
+	fmt.Printf("Updated from %s to %s\n", version, latest.Version)
+
+	return nil
+}
+
+// fetchRelease fetches the release document, returning it along with its URL,
+// against which binary URLs are resolved.
+func fetchRelease(endpoint string) (release, *url.URL, error) {
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return release{}, nil, err
+	}
+
+	data, err := fetchURL(base.String())
+	if err != nil {
+		return release{}, nil, err
+	}
+
+	var latest release
+	if err := json.Unmarshal(data, &latest); err != nil {
+		return release{}, nil, fmt.Errorf("invalid release document: %w", err)
+	}
+
+	if latest.Version == "" {
+		return release{}, nil, errors.New("invalid release document: missing version")
+	}
+
+	return latest, base, nil
+}
+
+// selfUpdate downloads the binary and checks its hash and signature, before
+// atomically replacing the running executable with it.
+func selfUpdate(base *url.URL, binary releaseBinary, key ed25519.PublicKey) error {
+	ref, err := url.Parse(binary.URL)
+	if err != nil {
+		return err
+	}
+
+	data, err := fetchURL(base.ResolveReference(ref).String())
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != binary.SHA256 {
+		return fmt.Errorf("binary hash mismatch: expected %s, got %x", binary.SHA256, sum)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(binary.Signature)
+	if err != nil || !ed25519.Verify(key, data, signature) {
+		return errors.New("invalid binary signature")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+
+	// The new binary is written next to the executable, so that renaming
+	// it over the executable is atomic.
+	f, err := ioutil.TempFile(filepath.Dir(exe), "."+filepath.Base(exe)+".new-")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0755)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), exe)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+
+	return err
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// containerUser is the user the container process runs as, with its primary
+// and supplementary groups, and its home directory.
+type containerUser struct {
+	uid, gid int
+	groups   []int
+	home     string
+}
+
+// resolveUser resolves a <user>[:<group>] value, names or numeric ids,
+// against the /etc/passwd and /etc/group files of the root filesystem. As with
+// Docker, numeric ids missing from the files are used as is, with the root
+// group and / as home, and the supplementary groups are the ones listing the
+// user as a member.
+func resolveUser(rootDir, spec string) (containerUser, error) {
+	userName, groupName := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		userName, groupName = spec[:i], spec[i+1:]
+	}
+	if userName == "" {
+		return containerUser{}, fmt.Errorf("invalid user %q, expected <user>[:<group>]", spec)
+	}
+
+	passwd, err := readContainerEntries(rootDir, "/etc/passwd", 7)
+	if err != nil {
+		return containerUser{}, err
+	}
+	groups, err := readContainerEntries(rootDir, "/etc/group", 4)
+	if err != nil {
+		return containerUser{}, err
+	}
+
+	u := containerUser{home: "/"}
+	uid, numeric := parseID(userName)
+	found := false
+	for _, e := range passwd {
+		if e[0] == userName || (numeric && e[2] == userName) {
+			if u.uid, err = strconv.Atoi(e[2]); err != nil {
+				return containerUser{}, fmt.Errorf("invalid uid of user %s in /etc/passwd", e[0])
+			}
+			if u.gid, err = strconv.Atoi(e[3]); err != nil {
+				return containerUser{}, fmt.Errorf("invalid gid of user %s in /etc/passwd", e[0])
+			}
+			if e[5] != "" {
+				u.home = e[5]
+			}
+			userName, found = e[0], true
+			break
+		}
+	}
+	if !found && !numeric {
+		return containerUser{}, fmt.Errorf("unable to find user %s: no matching entries in /etc/passwd", userName)
+	}
+	if !found {
+		u.uid = uid
+	}
+
+	if groupName != "" {
+		gid, numeric := parseID(groupName)
+		found := false
+		for _, e := range groups {
+			if e[0] == groupName || (numeric && e[2] == groupName) {
+				if u.gid, err = strconv.Atoi(e[2]); err != nil {
+					return containerUser{}, fmt.Errorf("invalid gid of group %s in /etc/group", e[0])
+				}
+				found = true
+				break
+			}
+		}
+		if !found && !numeric {
+			return containerUser{}, fmt.Errorf("unable to find group %s: no matching entries in /etc/group", groupName)
+		}
+		if !found {
+			u.gid = gid
+		}
+	}
+
+	for _, e := range groups {
+		for _, member := range strings.Split(e[3], ",") {
+			if found && member == userName {
+				if gid, err := strconv.Atoi(e[2]); err == nil {
+					u.groups = append(u.groups, gid)
+				}
+				break
+			}
+		}
+	}
+
+	return u, nil
+}
+
+// parseID parses a numeric user or group id.
+func parseID(s string) (int, bool) {
+	id, err := strconv.ParseUint(s, 10, 31)
+	return int(id), err == nil
+}
+
+// readContainerEntries returns the entries of a colon separated file of the
+// root filesystem, such as /etc/passwd, skipping the ones without the number
+// of fields. A missing file has no entries.
+func readContainerEntries(rootDir, name string, fields int) ([][]string, error) {
+	// Symlinks are followed within the root filesystem.
+	path, err := resolvePath(rootDir, name)
+	for links := 0; err == nil; links++ {
+		info, statErr := os.Lstat(path)
+		if statErr != nil || info.Mode()&os.ModeSymlink == 0 {
+			break
+		}
+		if links == 40 {
+			return nil, fmt.Errorf("%s: too many levels of symlinks", name)
+		}
+
+		target, linkErr := os.Readlink(path)
+		if linkErr != nil {
+			return nil, linkErr
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(name), target)
+		}
+		name = target
+		path, err = resolvePath(rootDir, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries [][]string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if e := strings.Split(line, ":"); len(e) == fields {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, nil
+}
+
+// prSetKeepCaps is the prctl option keeping the permitted capabilities when
+// switching from root to another user.
+const prSetKeepCaps = 8
+
+// switchUser sets the user and groups of the current thread, which executes
+// the command. Its capabilities are kept until then, limitCapabilities
+// needing them, while executing the command as another user than root drops
+// them.
+func switchUser(uid, gid int, groups []int) error {
+	setgroups, ok := syscallNumbers["setgroups"]
+	if !ok {
+		return fmt.Errorf("running as another user is not supported on this architecture")
+	}
+
+	gids := make([]uint32, len(groups)+1)
+	for i, g := range groups {
+		gids[i] = uint32(g)
+	}
+	_, _, errno := syscall.RawSyscall(uintptr(setgroups), uintptr(len(groups)), uintptr(unsafe.Pointer(&gids[0])), 0)
+	// User namespaces of rootless containers may deny setgroups, leaving
+	// the groups of the mapping.
+	if errno != 0 && !(errors.Is(errno, syscall.EPERM) && len(groups) == 0) {
+		return fmt.Errorf("failed to set the supplementary groups: %w", errno)
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetKeepCaps, 1, 0); errno != 0 {
+		return fmt.Errorf("failed to keep capabilities: %w", errno)
+	}
+	// Ids missing from the mapping of the user namespace are invalid.
+	if _, _, errno := syscall.RawSyscall(uintptr(syscallNumbers["setgid"]), uintptr(gid), 0, 0); errno == syscall.EINVAL {
+		return fmt.Errorf("group %d is not mapped in the user namespace", gid)
+	} else if errno != 0 {
+		return fmt.Errorf("failed to set the group %d: %w", gid, errno)
+	}
+	if _, _, errno := syscall.RawSyscall(uintptr(syscallNumbers["setuid"]), uintptr(uid), 0, 0); errno == syscall.EINVAL {
+		return fmt.Errorf("user %d is not mapped in the user namespace", uid)
+	} else if errno != 0 {
+		return fmt.Errorf("failed to set the user %d: %w", uid, errno)
+	}
+
+	// The effective capabilities are cleared when switching from root.
+	var data [capabilityDataWords]capData
+	header := capHeader{version: linuxCapabilityV3}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("failed to get capabilities: %w", errno)
+	}
+	for i := range data {
+		data[i].effective = data[i].permitted
+	}
+	header = capHeader{version: linuxCapabilityV3}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("failed to set capabilities: %w", errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// vfsDriver copies every layer into the root filesystem of each container.
+// It works on any filesystem, at the cost of a copy of the image. Layers are
+// unpacked once in the store as for overlay2, and their files are cloned on
+// filesystems supporting reflinks, such as btrfs and xfs.
+type vfsDriver struct{}
+
+func (vfsDriver) unpack(s *store, l layer, dir string) error {
+	// Layers unpacked in the store must keep their file ownership and
+	// whiteout devices, which unprivileged users cannot create: they
+	// extract the layers instead.
+	if !initialUserNamespace() {
+		return extractLayer(s.blobPath(l.Digest), l, dir, applyWhiteouts)
+	}
+
+	if err := s.unpackLayer(l, overlayWhiteouts); err != nil {
+		return err
+	}
+
+	return copyLayer(s.layerDir(l.Digest, overlayWhiteouts), dir)
+}
+
+func (vfsDriver) mount(s *store, manifest manifestResponse, dir, label string) (string, func(), error) {
+	if label != "" {
+		if err := relabel(dir, label); err != nil {
+			return "", nil, err
+		}
+	}
+	return dir, nil, nil
+}
+
+// initialUserNamespace reports whether the process runs in the initial user
+// namespace, mapping all user ids, as opposed to a rootless one.
+func initialUserNamespace() bool {
+	data, err := ioutil.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+
+	return strings.Join(strings.Fields(string(data)), " ") == "0 0 4294967295"
+}
+
+// ficlone is the ioctl request making a file share the data of another one,
+// missing from the syscall package.
+const ficlone = 0x40049409
+
+// copyLayer applies the layer unpacked in src to the root filesystem in dst,
+// as overlayfs would merge them: whiteout devices remove the lower file,
+// opaque directories hide the lower content, and directories replace lower
+// files and symlinks, so that nothing is written outside of dst.
+func copyLayer(src, dst string) error {
+	// Files hard linked together in the layer stay so, and directory times
+	// are set once their content is copied.
+	links := map[uint64]string{}
+	var dirs []string
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		st := info.Sys().(*syscall.Stat_t)
+
+		if info.IsDir() {
+			if rel != "." {
+				if err := copyDir(path, target); err != nil {
+					return err
+				}
+			}
+			dirs = append(dirs, rel)
+			return nil
+		}
+
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0 {
+			return nil
+		}
+
+		if st.Nlink > 1 {
+			if first, ok := links[st.Ino]; ok {
+				return os.Link(first, target)
+			}
+			links[st.Ino] = target
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			err = os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			err = cloneFile(path, target)
+		default:
+			err = syscall.Mknod(target, st.Mode, int(st.Rdev))
+		}
+		if err != nil {
+			return err
+		}
+
+		return copyMetadata(path, target, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Lstat(filepath.Join(src, dirs[i]))
+		if err != nil {
+			return err
+		}
+		if err := copyMetadata(filepath.Join(src, dirs[i]), filepath.Join(dst, dirs[i]), info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyDir creates the directory of the layer in the root filesystem, keeping
+// the lower directory there, unless the layer one is opaque.
+func copyDir(path, target string) error {
+	info, err := os.Lstat(target)
+	if err == nil && info.IsDir() && !opaqueDir(path) {
+		return nil
+	}
+
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+
+	return os.Mkdir(target, 0700)
+}
+
+// opaqueDir reports whether the unpacked layer directory hides the content
+// of lower layers.
+func opaqueDir(path string) bool {
+	value := make([]byte, 1)
+	n, err := syscall.Getxattr(path, overlayOpaqueXattr, value)
+	return err == nil && n == 1 && value[0] == 'y'
+}
+
+// cloneFile copies the regular file at src to dst, sharing its data when the
+// filesystem supports it.
+func cloneFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = out.Close() }()
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	if errno == 0 {
+		return out.Close()
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// copyMetadata copies the ownership, mode, extended attributes and times of
+// the file at src to dst. Ownership is kept when possible, as for extracted
+// layers.
+func copyMetadata(src, dst string, info os.FileInfo) error {
+	st := info.Sys().(*syscall.Stat_t)
+
+	if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil && !errors.Is(err, syscall.EPERM) && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		if err := os.Chmod(dst, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+
+		if err := copyXattrs(src, dst); err != nil {
+			return err
+		}
+	}
+
+	return lutimes(dst, time.Unix(st.Atim.Unix()), time.Unix(st.Mtim.Unix()))
+}
+
+// copyXattrs copies the extended attributes of the file at src to dst, but
+// the overlayfs ones.
+func copyXattrs(src, dst string) error {
+	size, err := syscall.Listxattr(src, nil)
+	if errors.Is(err, syscall.ENOTSUP) || size == 0 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	names := make([]byte, size)
+	if size, err = syscall.Listxattr(src, names); err != nil {
+		return err
+	}
+
+	for _, name := range splitXattrNames(names[:size]) {
+		if strings.HasPrefix(name, "trusted.overlay.") {
+			continue
+		}
+
+		size, err := syscall.Getxattr(src, name, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, size)
+		if size, err = syscall.Getxattr(src, name, value); err != nil {
+			return err
+		}
+
+		if err := lsetxattr(dst, name, value[:size]); err != nil && !errors.Is(err, syscall.ENOTSUP) && !errors.Is(err, syscall.EPERM) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitXattrNames splits the NUL terminated names returned by listxattr.
+func splitXattrNames(names []byte) []string {
+	var split []string
+	start := 0
+	for i, c := range names {
+		if c == 0 {
+			if i > start {
+				split = append(split, string(names[start:i]))
+			}
+			start = i + 1
+		}
+	}
+
+	return split
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// volumeDriver is the driver of volumes, stored as directories of the data
+// root, as with the Docker local driver.
+const volumeDriver = "local"
+
+// volume is a named volume, as inspected by Docker. Volumes are stored under
+// volumes/<name> in the data root: the mounted directory is _data, and the
+// volume.json file holds the volume metadata.
+type volume struct {
+	Name       string            `json:"Name"`
+	Driver     string            `json:"Driver"`
+	Mountpoint string            `json:"Mountpoint"`
+	CreatedAt  time.Time         `json:"CreatedAt"`
+	Labels     map[string]string `json:"Labels"`
+	Scope      string            `json:"Scope"`
+}
+
+// errNoSuchVolume is returned for missing volumes.
+var errNoSuchVolume = errors.New("no such volume")
+
+func (s *store) volumeDir(name string) string {
+	return filepath.Join(s.root, "volumes", name)
+}
+
+// lockVolumes takes an exclusive lock on the volumes until the returned
+// function is called.
+func (s *store) lockVolumes() (func(), error) {
+	if err := os.MkdirAll(filepath.Join(s.root, "volumes"), 0700); err != nil {
+		return nil, err
+	}
+	return lockFile(filepath.Join(s.root, "volumes", "volumes.lock"))
+}
+
+// createVolume creates the named volume with the labels, or returns it if it
+// already exists.
+func (s *store) createVolume(name string, labels map[string]string) (volume, error) {
+	if !validName.MatchString(name) {
+		return volume{}, fmt.Errorf("invalid volume name %q: only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+
+	unlock, err := s.lockVolumes()
+	if err != nil {
+		return volume{}, err
+	}
+	defer unlock()
+
+	return s.createVolumeLocked(name, labels)
+}
+
+// createVolumeLocked creates the volume, the volumes being locked.
+func (s *store) createVolumeLocked(name string, labels map[string]string) (volume, error) {
+	v, err := s.volume(name)
+	if !errors.Is(err, errNoSuchVolume) {
+		return v, err
+	}
+
+	dir := s.volumeDir(name)
+	v = volume{
+		Name:       name,
+		Driver:     volumeDriver,
+		Mountpoint: filepath.Join(dir, "_data"),
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+		Labels:     labels,
+		Scope:      "local",
+	}
+	if v.Labels == nil {
+		v.Labels = map[string]string{}
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return volume{}, err
+	}
+
+	// The metadata is written last, so that partially created volumes are
+	// created again.
+	if err := os.MkdirAll(v.Mountpoint, 0755); err != nil {
+		return volume{}, err
+	}
+	path := filepath.Join(dir, "volume.json")
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return volume{}, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return volume{}, err
+	}
+
+	return v, nil
+}
+
+// volume returns the named volume.
+func (s *store) volume(name string) (volume, error) {
+	var v volume
+	data, err := ioutil.ReadFile(filepath.Join(s.volumeDir(name), "volume.json"))
+	if os.IsNotExist(err) {
+		return volume{}, fmt.Errorf("%w: %s", errNoSuchVolume, name)
+	} else if err != nil {
+		return volume{}, err
+	}
+
+	if err := json.Unmarshal(data, &v); err != nil {
+		return volume{}, fmt.Errorf("invalid volume %s: %w", name, err)
+	}
+
+	return v, nil
+}
+
+// volumes returns the volumes, sorted by name.
+func (s *store) volumes() ([]volume, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(s.root, "volumes"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var volumes []volume
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		v, err := s.volume(dir.Name())
+		if errors.Is(err, errNoSuchVolume) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, v)
+	}
+
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+// useVolume returns the named volume, created if missing, and keeps it from
+// being removed, by a shared lock, until the returned function is called.
+func (s *store) useVolume(name string) (volume, func(), error) {
+	if !validName.MatchString(name) {
+		return volume{}, nil, fmt.Errorf("invalid volume name %q: only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed, use an absolute path for host directories", name)
+	}
+
+	unlock, err := s.lockVolumes()
+	if err != nil {
+		return volume{}, nil, err
+	}
+	defer unlock()
+
+	v, err := s.createVolumeLocked(name, nil)
+	if err != nil {
+		return volume{}, nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.volumeDir(name), "volume.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return volume{}, nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		_ = f.Close()
+		return volume{}, nil, err
+	}
+
+	return v, func() { _ = f.Close() }, nil
+}
+
+// populateVolume copies the content of the image directory at source to the
+// volume, if empty, with ownership, modes and times. Nothing is copied when
+// source is not a directory, e.g. missing or a symlink.
+func (s *store) populateVolume(v volume, source string) error {
+	info, err := os.Lstat(source)
+	if err != nil || !info.IsDir() {
+		return nil
+	}
+
+	unlock, err := s.lockVolumes()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := ioutil.ReadDir(v.Mountpoint)
+	if err != nil || len(entries) > 0 {
+		return err
+	}
+
+	if err := copyLayer(source, v.Mountpoint); err != nil {
+		return fmt.Errorf("failed to populate the volume %s: %w", v.Name, err)
+	}
+	return nil
+}
+
+// removeVolume removes the named volume and its content, unless used by a
+// container.
+func (s *store) removeVolume(name string) error {
+	unlock, err := s.lockVolumes()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := s.volume(name); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.volumeDir(name), "volume.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		return fmt.Errorf("volume %s is in use", name)
+	} else if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(s.volumeDir(name))
+}
+
+// Usage: your_docker.sh volume <command> [options] <args>...
+func volumeCmd(argv []string) error {
+	return dispatch("volume", []command{
+		{"create", "Create a volume", volumeCreateCmd},
+		{"ls", "List volumes", volumeLsCmd},
+		{"inspect", "Show the details of volumes", volumeInspectCmd},
+		{"rm", "Remove volumes", volumeRmCmd},
+	}, argv)
+}
+
+// Usage: your_docker.sh volume create [options] [name]
+func volumeCreateCmd(argv []string) error {
+	createFlags := newFlagSet("volume create", "[options] [name]")
+	addStoreFlags(createFlags)
+	var labelSpecs []string
+	createFlags.Var((*stringsFlag)(&labelSpecs), "label", "set a label, as <key>=<value> (repeatable)")
+	_ = createFlags.Parse(argv)
+
+	if createFlags.NArg() > 1 {
+		createFlags.Usage()
+		os.Exit(2)
+	}
+
+	// Volumes created without a name are named as containers.
+	name := createFlags.Arg(0)
+	if name == "" {
+		var err error
+		if name, err = (randomIDGenerator{}).generate(); err != nil {
+			return err
+		}
+	}
+
+	labels := map[string]string{}
+	for _, spec := range labelSpecs {
+		i := strings.Index(spec, "=")
+		if i <= 0 {
+			return fmt.Errorf("invalid label %q, expected <key>=<value>", spec)
+		}
+		labels[spec[:i]] = spec[i+1:]
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	v, err := s.createVolume(name, labels)
+	if err != nil {
+		return err
+	}
+	fmt.Println(v.Name)
+
+	return nil
+}
+
+// Usage: your_docker.sh volume ls [options]
+func volumeLsCmd(argv []string) error {
+	lsFlags := newFlagSet("volume ls", "[options]")
+	addStoreFlags(lsFlags)
+	quiet := lsFlags.Bool("q", false, "only print volume names")
+	_ = lsFlags.Parse(argv)
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	volumes, err := s.volumes()
+	if err != nil {
+		return err
+	}
+
+	if !*quiet {
+		fmt.Printf("%-10s %s\n", "DRIVER", "VOLUME NAME")
+	}
+	for _, v := range volumes {
+		if *quiet {
+			fmt.Println(v.Name)
+		} else {
+			fmt.Printf("%-10s %s\n", v.Driver, v.Name)
+		}
+	}
+
+	return nil
+}
+
+// Usage: your_docker.sh volume inspect [options] <name>...
+func volumeInspectCmd(argv []string) error {
+	inspectFlags := newFlagSet("volume inspect", "[options] <name>...")
+	addStoreFlags(inspectFlags)
+	_ = inspectFlags.Parse(argv)
+
+	if inspectFlags.NArg() < 1 {
+		inspectFlags.Usage()
+		os.Exit(2)
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	volumes := []volume{}
+	for _, name := range inspectFlags.Args() {
+		v, err := s.volume(name)
+		if err != nil {
+			return err
+		}
+		volumes = append(volumes, v)
+	}
+
+	data, err := json.MarshalIndent(volumes, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+
+	return nil
+}
+
+// Usage: your_docker.sh volume rm [options] <name>...
+func volumeRmCmd(argv []string) error {
+	rmFlags := newFlagSet("volume rm", "[options] <name>...")
+	addStoreFlags(rmFlags)
+	_ = rmFlags.Parse(argv)
+
+	if rmFlags.NArg() < 1 {
+		rmFlags.Usage()
+		os.Exit(2)
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	for _, name := range rmFlags.Args() {
+		if err := s.removeVolume(name); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+		fmt.Println(name)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	watchInterval    = 500 * time.Millisecond
+	watchStopTimeout = 2 * time.Second
+)
+
+// parseWatchMount parses a --watch value of the form
+// <host path>:<container path>.
+func parseWatchMount(spec string) (bindMount, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || !filepath.IsAbs(parts[1]) {
+		return bindMount{}, fmt.Errorf("invalid watch specification %q, expected <host path>:<absolute container path>", spec)
+	}
+
+	hostPath, err := filepath.Abs(parts[0])
+	if err != nil {
+		return bindMount{}, err
+	}
+
+	return bindMount{hostPath: hostPath, containerPath: filepath.Clean(parts[1])}, nil
+}
+
+// mountBinds bind mounts the host paths in the container root directory, and
+// returns the function unmounting them.
+func mountBinds(rootDir string, mounts []bindMount) (func(), error) {
+	var targets []string
+	unmount := func() {
+		for i := len(targets) - 1; i >= 0; i-- {
+			if err := syscall.Unmount(targets[i], syscall.MNT_DETACH); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to unmount %s: %s\n", targets[i], err)
+			}
+		}
+	}
+
+	for _, m := range mounts {
+		info, err := os.Stat(m.hostPath)
+		if err != nil {
+			unmount()
+			return nil, err
+		}
+
+		// Image symlinks must not lead the mounts to host paths.
+		target, err := resolveTarget(rootDir, m.containerPath)
+		if err != nil {
+			unmount()
+			return nil, err
+		}
+		if info.IsDir() {
+			err = os.MkdirAll(target, 0755)
+		} else if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+			var f *os.File
+			if f, err = os.OpenFile(target, os.O_CREATE, 0644); err == nil {
+				err = f.Close()
+			}
+		}
+		if err != nil {
+			unmount()
+			return nil, err
+		}
+
+		if err := syscall.Mount(m.hostPath, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			unmount()
+			return nil, fmt.Errorf("failed to bind mount %s: %w", m.hostPath, err)
+		}
+		targets = append(targets, target)
+	}
+
+	return unmount, nil
+}
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+}
+
+// snapshotWatched records the size, modification time and mode of every file
+// under the watched host paths.
+func snapshotWatched(mounts []bindMount) map[string]fileStamp {
+	stamps := map[string]fileStamp{}
+	for _, m := range mounts {
+		_ = filepath.Walk(m.hostPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			stamps[path] = fileStamp{size: info.Size(), modTime: info.ModTime(), mode: info.Mode()}
+			return nil
+		})
+	}
+
+	return stamps
+}
+
+func sameSnapshot(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for path, stamp := range a {
+		if other, ok := b[path]; !ok || !other.modTime.Equal(stamp.modTime) || other.size != stamp.size || other.mode != stamp.mode {
+			return false
+		}
+	}
+
+	return true
+}
+
+// stopProcess asks the process to terminate, and kills it if it is still
+// running after watchStopTimeout. done must receive the result of cmd.Wait.
+func stopProcess(cmd *exec.Cmd, done <-chan error) {
+	_ = cmd.Process.Signal(syscall.SIGTERM)
+
+	select {
+	case <-done:
+	case <-time.After(watchStopTimeout):
+		_ = cmd.Process.Kill()
+		<-done
+	}
+}
+
+// runWatched starts the command returned by newCmd with start, and restarts it
+// whenever a file changes under the watched paths. It returns once
+// interrupted.
+func runWatched(newCmd func() *exec.Cmd, start func(*exec.Cmd) error, mounts []bindMount) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	stamps := snapshotWatched(mounts)
+	for {
+		cmd := newCmd()
+		if err := start(cmd); err != nil {
+			return err
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+
+		running := true
+		for restart := false; !restart; {
+			select {
+			case err := <-done:
+				running = false
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "watch: process exited: %s, waiting for changes\n", err)
+				} else {
+					fmt.Fprintf(os.Stderr, "watch: process exited, waiting for changes\n")
+				}
+			case <-signals:
+				if running {
+					stopProcess(cmd, done)
+				}
+				return nil
+			case <-ticker.C:
+				current := snapshotWatched(mounts)
+				if sameSnapshot(stamps, current) {
+					continue
+				}
+				stamps = current
+				restart = true
+
+				fmt.Fprintf(os.Stderr, "watch: change detected, restarting\n")
+				if running {
+					stopProcess(cmd, done)
+				}
+			}
+		}
+	}
+}